@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+	"github.com/mdellandrea/minutes-server/lib/handlers"
+	"github.com/mdellandrea/minutes-server/lib/server"
+	"github.com/mdellandrea/minutes-server/lib/transfer"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// runCommand runs a subcommand against the backend configured in the
+// environment instead of serving HTTP:
+//
+//	minutes-server export [-o file]
+//	minutes-server import [-on-conflict skip|overwrite|fail] [file]
+//
+// export needs a backend that can list timeIds, which Redis Cluster cannot.
+func runCommand(log zerolog.Logger, name string, args []string) error {
+	switch name {
+	case "export":
+		return exportCommand(log, args)
+	case "import":
+		return importCommand(log, args)
+	default:
+		return errors.Errorf("unknown command %q, expected export or import", name)
+	}
+}
+
+// exportCommand writes every timeId as NDJSON to stdout or the -o file. The
+// file is only replaced once the whole export is written, so a failed export
+// leaves any earlier one in place.
+func exportCommand(log zerolog.Logger, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := fs.String("o", "", "write the export to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := server.OpenBackendReadOnly(log)
+	if err != nil {
+		return err
+	}
+	defer closeBackend(log, db)
+
+	var n int
+	if *out == "" {
+		n, err = export(db, os.Stdout)
+	} else {
+		n, err = exportFile(db, *out)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Int("exported", n).
+		Msg("export complete")
+	return nil
+}
+
+// exportFile writes the export to a temporary file beside name and renames it
+// to name once it is complete and synced.
+func exportFile(db handlers.Backend, name string) (int, error) {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".")
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to create export file")
+	}
+	n, err := export(db, f)
+	if err == nil {
+		err = errors.Wrap(f.Sync(), "unable to sync export file")
+	}
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "unable to write export")
+	}
+	if err == nil {
+		err = errors.Wrap(os.Rename(f.Name(), name), "unable to replace export file")
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+// export writes every timeId of db to w, returning how many it wrote.
+func export(db handlers.Backend, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	n, err := transfer.Export(context.Background(), db, bw)
+	if errors.Cause(err) == backend.ErrUnsupported {
+		return n, errors.Wrap(err, "export needs a backend that can list timeIds, which Redis Cluster cannot")
+	}
+	if err != nil {
+		return n, err
+	}
+	if err := bw.Flush(); err != nil {
+		return n, errors.Wrap(err, "unable to write export")
+	}
+	return n, nil
+}
+
+// importCommand reads an export from the file argument or stdin.
+func importCommand(log zerolog.Logger, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	policy := fs.String("on-conflict", transfer.Skip, "what to do with timeIds that already exist: skip, overwrite or fail")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !transfer.ValidPolicy(*policy) {
+		return errors.Errorf("unknown conflict policy %q", *policy)
+	}
+
+	var r io.Reader = os.Stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return errors.Wrap(err, "unable to open import file")
+		}
+		defer f.Close()
+		r = f
+	}
+
+	db, err := server.OpenBackend(log)
+	if err != nil {
+		return err
+	}
+	defer closeBackend(log, db)
+
+	sum, err := transfer.Import(context.Background(), db, r, *policy, backend.Change{Op: backend.ChangeImport})
+	log.Info().
+		Int("imported", sum.Imported).
+		Int("overwritten", sum.Overwritten).
+		Int("skipped", sum.Skipped).
+		Msg("import finished")
+	return err
+}
+
+// closeBackend releases backends that hold resources, such as the log of the
+// file backend.
+func closeBackend(log zerolog.Logger, db handlers.Backend) {
+	if err := backend.Close(db); err != nil {
+		log.Error().
+			Err(err).
+			Msg("unable to close backend")
+	}
+}
@@ -1,29 +1,78 @@
 package backend
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/pkg/errors"
 )
 
+// maxTxRetries bounds how often an optimistic transaction is retried when the
+// watched key changes underneath it.
+const maxTxRetries = 100
+
+// RedisConfig holds the connection settings for Client.
+type RedisConfig struct {
+	// Addrs is a single host:port for a standalone server, or the seed list of
+	// Sentinel or Cluster nodes. Two or more addresses without a MasterName
+	// connect to a Cluster.
+	Addrs []string
+	// MasterName selects a Sentinel-managed master of that name.
+	MasterName string
+	Password   string
+	// DB is ignored by Cluster, which only supports database 0.
+	DB int
+
+	TLS      bool
+	CAFile   string
+	CertFile string
+	KeyFile  string
+
+	// PoolSize is the maximum number of connections per node; zero uses the
+	// go-redis default.
+	PoolSize     int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
 type Client struct {
-	Client *redis.Client
+	Client redis.UniversalClient
+	// historyLimit caps the entries kept per timeId; zero keeps them all.
+	historyLimit int
 }
 
-func NewBackend(host, port string) (*Client, error) {
-	c := redis.NewClient(&redis.Options{
-		Addr:         fmt.Sprintf("%s:%s", host, port),
-		Password:     "",
-		DB:           0,
-		ReadTimeout:  time.Second,
-		WriteTimeout: time.Second,
+func NewBackend(cfg RedisConfig) (*Client, error) {
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	c := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:        cfg.Addrs,
+		MasterName:   cfg.MasterName,
+		Password:     cfg.Password,
+		DB:           cfg.DB,
+		TLSConfig:    tlsConfig,
+		PoolSize:     cfg.PoolSize,
+		DialTimeout:  cfg.DialTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
 	})
 
-	err := c.Ping().Err()
+	err = c.Ping().Err()
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to connect to redis at %s:%s", host, port)
+		c.Close()
+		return nil, errors.Wrapf(err, "unable to connect to redis at %s", strings.Join(cfg.Addrs, ","))
 	}
 
 	return &Client{
@@ -31,31 +80,710 @@ func NewBackend(host, port string) (*Client, error) {
 	}, nil
 }
 
-func (b *Client) SetTimeId(id, val string) error {
-	err := b.Client.Set(id, val, 0).Err()
+// tlsConfig returns nil when TLS is disabled. The server name is taken from
+// the address being dialed.
+func (cfg RedisConfig) tlsConfig() (*tls.Config, error) {
+	if !cfg.TLS {
+		return nil, nil
+	}
+
+	c := &tls.Config{}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read redis CA file")
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in redis CA file %s", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load redis client certificate")
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// SetHistoryLimit keeps only the newest n history entries of each timeId.
+// Older entries are trimmed by the writes of single timeIds, so a history
+// may briefly exceed n after creates and batch deletes. Zero keeps them all.
+// It must be called before the backend is used.
+func (b *Client) SetHistoryLimit(n int) {
+	b.historyLimit = n
+}
+
+// SetTimeId writes the record and its history entry in one MULTI/EXEC
+// transaction.
+func (b *Client) SetTimeId(ctx context.Context, id string, rec Record, change Change) error {
+	now := time.Now()
+	rec = rec.created(now)
+	val, err := json.Marshal(rec)
 	if err != nil {
 		return err
 	}
+	entry, err := json.Marshal(change.entry(0, rec, now))
+	if err != nil {
+		return err
+	}
+	return withContext(ctx, func() error {
+		_, err := b.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(id, val, rec.ttl())
+			pipe.RPush(historyKey(id), entry)
+			return nil
+		})
+		if err != nil {
+			return classifyRedis(err)
+		}
+		return nil
+	})
+}
+
+// Close releases the connections to Redis.
+func (b *Client) Close() error {
+	return b.Client.Close()
+}
+
+// Close closes db if it holds resources to release, like the file backend
+// and Redis clients, or the decorators wrapping them.
+func Close(db interface{}) error {
+	if closer, ok := db.(io.Closer); ok {
+		return closer.Close()
+	}
 	return nil
 }
 
-func (b *Client) GetTimeId(id string) (string, error) {
-	val, err := b.Client.Get(id).Result()
+func (b *Client) Ping(ctx context.Context) error {
+	return withContext(ctx, func() error {
+		return classifyRedis(b.Client.Ping().Err())
+	})
+}
+
+func (b *Client) GetTimeId(ctx context.Context, id string) (Record, error) {
+	var rec Record
+	err := withContext(ctx, func() error {
+		var get *redis.StringCmd
+		var pttl *redis.DurationCmd
+		_, err := b.Client.Pipelined(func(pipe redis.Pipeliner) error {
+			get = pipe.Get(id)
+			pttl = pipe.PTTL(id)
+			return nil
+		})
+		if err != nil {
+			return classifyRedis(err)
+		}
+		rec, err = toRecord(get.Val(), pttl.Val())
+		return err
+	})
 	if err != nil {
-		return "", err
+		return Record{}, err
 	}
-	return val, nil
+	return rec, nil
 }
 
-func (b *Client) DeleteTimeId(id string) error {
-	val, err := b.Client.Del(id).Result()
+// UpdateTimeId applies fn inside a WATCH/MULTI transaction, retrying whenever
+// another client modifies the key between the read and the write. Errors
+// returned by fn are passed through unchanged.
+func (b *Client) UpdateTimeId(ctx context.Context, id string, fn func(Record) (Record, Change, error)) (Record, error) {
+	var rec Record
+	err := b.transact(ctx, id, "update", func(current Record) (func(redis.Pipeliner), error) {
+		next, change, err := fn(current)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		next = next.updated(current, now)
+		data, err := json.Marshal(next)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := json.Marshal(change.entry(0, next, now))
+		if err != nil {
+			return nil, err
+		}
+		rec = next
+		return func(pipe redis.Pipeliner) {
+			pipe.Set(id, data, next.ttl())
+			pipe.RPush(historyKey(id), entry)
+		}, nil
+	})
+	if err != nil {
+		return Record{}, err
+	}
+	return rec, nil
+}
+
+// DeleteTimeId deletes the key inside a WATCH/MULTI transaction, so the
+// history entry records the final time. When fn is given it runs on the
+// current record and the key is only deleted if it succeeds.
+func (b *Client) DeleteTimeId(ctx context.Context, id string, fn func(Record) error, change Change) error {
+	return b.transact(ctx, id, "delete", func(current Record) (func(redis.Pipeliner), error) {
+		if fn != nil {
+			if err := fn(current); err != nil {
+				return nil, err
+			}
+		}
+		entry, err := json.Marshal(change.entry(0, current, time.Now()))
+		if err != nil {
+			return nil, err
+		}
+		return func(pipe redis.Pipeliner) {
+			pipe.Del(id)
+			pipe.RPush(historyKey(id), entry)
+		}, nil
+	})
+}
+
+// ImportTimeId stores rec as is, keeping its version and timestamps, inside a
+// WATCH/MULTI transaction so an existing key is never overwritten by accident.
+func (b *Client) ImportTimeId(ctx context.Context, id string, rec Record, overwrite bool, change Change) error {
+	val, err := json.Marshal(rec)
 	if err != nil {
 		return err
 	}
-	if val == 0 {
-		return redis.Nil
+	entry, err := json.Marshal(change.entry(0, rec, time.Now()))
+	if err != nil {
+		return err
 	}
-	return nil
+
+	return b.watch(ctx, id, "import", func(current *Record) (func(redis.Pipeliner), error) {
+		if current != nil && !overwrite {
+			return nil, ErrExists
+		}
+		return func(pipe redis.Pipeliner) {
+			pipe.Set(id, val, rec.ttl())
+			pipe.RPush(historyKey(id), entry)
+		}, nil
+	})
+}
+
+// SetTimeIds writes every record and its history entry in one MULTI/EXEC
+// transaction. Cluster clients split it into one transaction per slot.
+func (b *Client) SetTimeIds(ctx context.Context, items []BatchItem, change Change) ([]BatchItem, error) {
+	now := time.Now()
+	res := make([]BatchItem, len(items))
+	vals := make([][]byte, len(items))
+	entries := make([][]byte, len(items))
+	for i, item := range items {
+		rec := item.Record.created(now)
+		val, err := json.Marshal(rec)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := json.Marshal(change.entry(0, rec, now))
+		if err != nil {
+			return nil, err
+		}
+		res[i] = BatchItem{Id: item.Id, Record: rec}
+		vals[i], entries[i] = val, entry
+	}
+
+	err := withContext(ctx, func() error {
+		sets := make([]*redis.StatusCmd, len(items))
+		pushes := make([]*redis.IntCmd, len(items))
+		_, err := b.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+			for i, item := range res {
+				sets[i] = pipe.Set(item.Id, vals[i], item.ttl())
+				pushes[i] = pipe.RPush(historyKey(item.Id), entries[i])
+			}
+			return nil
+		})
+		failed := false
+		for i := range res {
+			cmdErr := sets[i].Err()
+			if cmdErr == nil {
+				cmdErr = pushes[i].Err()
+			}
+			if cmdErr != nil {
+				res[i] = BatchItem{Id: res[i].Id, Err: classifyRedis(cmdErr)}
+				failed = true
+			}
+		}
+		// An error not attributed to any command failed the whole batch.
+		if err != nil && !failed {
+			return classifyRedis(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetTimeIds reads every record in one pipeline.
+func (b *Client) GetTimeIds(ctx context.Context, ids []string) ([]BatchItem, error) {
+	var res []BatchItem
+	err := withContext(ctx, func() error {
+		res = b.getMany(ids)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DeleteTimeIds watches every key, reads them in one pipeline and deletes the
+// ones found in a single MULTI/EXEC transaction, so history entries record the
+// final times. The whole batch is retried if any of the keys changes in
+// between. WATCH cannot span Cluster slots, so on Cluster the timeIds are
+// deleted one transaction at a time instead.
+func (b *Client) DeleteTimeIds(ctx context.Context, ids []string, change Change) ([]BatchItem, error) {
+	if len(ids) == 0 {
+		return []BatchItem{}, nil
+	}
+	if _, ok := b.Client.(*redis.ClusterClient); ok {
+		res := make([]BatchItem, len(ids))
+		for i, id := range ids {
+			res[i] = BatchItem{Id: id, Err: b.DeleteTimeId(ctx, id, nil, change)}
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+
+	var res []BatchItem
+	txf := func(tx *redis.Tx) error {
+		// The keys are already watched, so reading them over another
+		// connection still aborts the transaction if they change.
+		current := b.getMany(ids)
+		now := time.Now()
+		res = make([]BatchItem, len(ids))
+		entries := make([][]byte, len(ids))
+		found := 0
+		for i, item := range current {
+			res[i] = BatchItem{Id: item.Id, Err: item.Err}
+			if item.Err != nil {
+				continue
+			}
+			entry, err := json.Marshal(change.entry(0, item.Record, now))
+			if err != nil {
+				return err
+			}
+			entries[i] = entry
+			found++
+		}
+		if found == 0 {
+			return nil
+		}
+		// Abandon the transaction rather than commit a write nobody waits for.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, item := range res {
+				if item.Err == nil {
+					pipe.Del(item.Id)
+					pipe.RPush(historyKey(item.Id), entries[i])
+				}
+			}
+			return nil
+		})
+		return err
+	}
+
+	err := withContext(ctx, func() error {
+		for i := 0; i < maxTxRetries; i++ {
+			err := b.Client.Watch(txf, ids...)
+			if err == redis.TxFailedErr {
+				continue
+			}
+			if err == context.Canceled || err == context.DeadlineExceeded {
+				return err
+			}
+			return classifyRedis(err)
+		}
+		return withKind(ErrConflict, errors.Errorf("batch delete aborted after %d conflicting transactions", maxTxRetries))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// historyChunk is the number of history entries read per LRANGE.
+const historyChunk = 100
+
+// GetHistory reads the history list a chunk at a time, from the first entry
+// after q.After, until q is satisfied. Entries are numbered by their position
+// in the list, following the entries trimmed from its head.
+func (b *Client) GetHistory(ctx context.Context, id string, q HistoryQuery) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	err := withContext(ctx, func() error {
+		entries = []HistoryEntry{}
+		var trimmed int64
+		next := q.After
+		for {
+			start := historyStart(next, trimmed)
+			var exists *redis.IntCmd
+			var count *redis.StringCmd
+			var page *redis.StringSliceCmd
+			b.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+				exists = pipe.Exists(historyKey(id))
+				count = pipe.Get(trimmedKey(id))
+				page = pipe.LRange(historyKey(id), start, start+historyChunk-1)
+				return nil
+			})
+			if err := exists.Err(); err != nil {
+				return classifyRedis(err)
+			}
+			if exists.Val() == 0 {
+				return ErrNotFound
+			}
+			n, err := count.Int64()
+			if err != nil && err != redis.Nil {
+				if _, ok := err.(*strconv.NumError); ok {
+					return withKind(ErrCorrupt, errors.Wrapf(err, "invalid trimmed history count of %s", id))
+				}
+				return classifyRedis(err)
+			}
+			// Entries were trimmed since the last read, which moved the
+			// start of the page.
+			if historyStart(next, n) != start {
+				trimmed = n
+				continue
+			}
+			trimmed = n
+			vals, err := page.Result()
+			if err != nil {
+				return classifyRedis(err)
+			}
+
+			for i, val := range vals {
+				var e HistoryEntry
+				if err := json.Unmarshal([]byte(val), &e); err != nil {
+					return withKind(ErrCorrupt, errors.Wrapf(err, "invalid history entry %d of %s", trimmed+start+int64(i)+1, id))
+				}
+				e.Seq = trimmed + start + int64(i) + 1
+				if !q.match(e) {
+					continue
+				}
+				entries = append(entries, e)
+				if q.Limit > 0 && len(entries) == q.Limit {
+					return nil
+				}
+			}
+			if len(vals) < historyChunk {
+				return nil
+			}
+			next = trimmed + start + int64(len(vals))
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
 }
 
-func (b *Client) NotFoundErrCheck(err error) bool { return err == redis.Nil }
+// historyStart returns the list index of the first history entry after seq,
+// with trimmed entries already dropped from the head of the list.
+func historyStart(seq, trimmed int64) int64 {
+	if seq < trimmed {
+		return 0
+	}
+	return seq - trimmed
+}
+
+// ListTimeIds walks the keyspace with SCAN, fetching the records of each batch
+// and filtering them client side. The cursor holds the SCAN cursor of the batch
+// the page ended in and how many of its keys were consumed, so a page never
+// exceeds the limit. Like SCAN itself, a listing may repeat or miss timeIds
+// that are created or deleted while it runs. Cluster deployments are not
+// supported, as their keyspace is spread over several SCAN cursors.
+func (b *Client) ListTimeIds(ctx context.Context, q ListQuery) ([]Listing, string, error) {
+	if _, ok := b.Client.(*redis.ClusterClient); ok {
+		return nil, "", withKind(ErrUnsupported, errors.New("listing timeIds on Redis Cluster"))
+	}
+
+	cursor, skip, err := decodeScanCursor(q.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var res []Listing
+	var next string
+	err = withContext(ctx, func() error {
+		res = []Listing{}
+		for {
+			keys, nextCursor, err := b.Client.Scan(cursor, timeIdPattern, scanCount).Result()
+			if err != nil {
+				return classifyRedis(err)
+			}
+			if skip > len(keys) {
+				skip = len(keys)
+			}
+			keys = keys[skip:]
+
+			for i, item := range b.getMany(keys) {
+				// Keys deleted since they were scanned are skipped.
+				if item.Err == ErrNotFound {
+					continue
+				}
+				if item.Err != nil {
+					return item.Err
+				}
+				if !q.match(item.Record) {
+					continue
+				}
+				res = append(res, Listing{Id: item.Id, Record: item.Record})
+				if q.Limit > 0 && len(res) == q.Limit {
+					switch {
+					case i < len(keys)-1:
+						next = encodeScanCursor(cursor, skip+i+1)
+					case nextCursor != 0:
+						next = encodeScanCursor(nextCursor, 0)
+					}
+					return nil
+				}
+			}
+
+			if nextCursor == 0 {
+				return nil
+			}
+			cursor, skip = nextCursor, 0
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return res, next, nil
+}
+
+// getMany fetches the records of keys in one pipeline, reporting a failure for
+// each key on its own item. The pipeline's own error is always that of one of
+// its commands, so it is not returned separately.
+func (b *Client) getMany(keys []string) []BatchItem {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	gets := make([]*redis.StringCmd, len(keys))
+	pttls := make([]*redis.DurationCmd, len(keys))
+	b.Client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			gets[i] = pipe.Get(key)
+			pttls[i] = pipe.PTTL(key)
+		}
+		return nil
+	})
+
+	res := make([]BatchItem, len(keys))
+	for i, key := range keys {
+		res[i].Id = key
+		val, err := gets[i].Result()
+		if err != nil {
+			res[i].Err = classifyRedis(err)
+			continue
+		}
+		rec, err := toRecord(val, pttls[i].Val())
+		if err != nil {
+			res[i].Err = errors.Wrapf(err, "timeId %s", key)
+			continue
+		}
+		res[i].Record = rec
+	}
+	return res
+}
+
+const (
+	// timeIdPattern matches the UUID keys of records but not the keys
+	// holding their history.
+	timeIdPattern = "????????-????-????-????-????????????"
+	scanCount     = 100
+)
+
+func encodeScanCursor(cursor uint64, skip int) string {
+	return encodeCursor(strconv.FormatUint(cursor, 10) + ":" + strconv.Itoa(skip))
+}
+
+func decodeScanCursor(c string) (cursor uint64, skip int, err error) {
+	if c == "" {
+		return 0, 0, nil
+	}
+	pos, err := decodeCursor(c)
+	if err != nil {
+		return 0, 0, err
+	}
+	parts := strings.SplitN(pos, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, ErrInvalidCursor
+	}
+	if cursor, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return 0, 0, ErrInvalidCursor
+	}
+	if skip, err = strconv.Atoi(parts[1]); err != nil || skip < 0 {
+		return 0, 0, ErrInvalidCursor
+	}
+	return cursor, skip, nil
+}
+
+// historyKey is the list holding the history of id. The hash tag places it in
+// the same Cluster slot as the record, which MULTI requires.
+func historyKey(id string) string {
+	return "{" + id + "}:history"
+}
+
+// trimmedKey counts the entries trimmed from the head of the history of id.
+func trimmedKey(id string) string {
+	return "{" + id + "}:history:trimmed"
+}
+
+// transact reads the record of id and commits the writes fn queues for it in
+// a single WATCH/MULTI transaction, retrying whenever another client modifies
+// the key in between. Errors returned by fn are passed through unchanged.
+func (b *Client) transact(ctx context.Context, id, op string, fn func(current Record) (func(redis.Pipeliner), error)) error {
+	return b.watch(ctx, id, op, func(current *Record) (func(redis.Pipeliner), error) {
+		if current == nil {
+			return nil, ErrNotFound
+		}
+		return fn(*current)
+	})
+}
+
+// watch is transact for writes that also apply to missing keys, for which fn
+// is called with nil. Every write fn queues appends one history entry, after
+// which the history is trimmed to the history limit.
+func (b *Client) watch(ctx context.Context, id, op string, fn func(current *Record) (func(redis.Pipeliner), error)) error {
+	var fnErr error
+	txf := func(tx *redis.Tx) error {
+		var current *Record
+		val, err := tx.Get(id).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		var length int64
+		if b.historyLimit > 0 {
+			if length, err = tx.LLen(historyKey(id)).Result(); err != nil {
+				return err
+			}
+		}
+		if err == nil {
+			pttl, err := tx.PTTL(id).Result()
+			if err != nil {
+				return err
+			}
+			rec, err := toRecord(val, pttl)
+			if err != nil {
+				return err
+			}
+			current = &rec
+		}
+		var queue func(redis.Pipeliner)
+		queue, fnErr = fn(current)
+		if fnErr != nil {
+			return fnErr
+		}
+		// Abandon the transaction rather than commit a write nobody waits for.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			queue(pipe)
+			if limit := int64(b.historyLimit); limit > 0 && length+1 > limit {
+				pipe.LTrim(historyKey(id), -limit, -1)
+				pipe.IncrBy(trimmedKey(id), length+1-limit)
+			}
+			return nil
+		})
+		return err
+	}
+
+	return withContext(ctx, func() error {
+		for i := 0; i < maxTxRetries; i++ {
+			err := b.Client.Watch(txf, id, historyKey(id))
+			if err == redis.TxFailedErr {
+				continue
+			}
+			if fnErr != nil {
+				return fnErr
+			}
+			if err == context.Canceled || err == context.DeadlineExceeded || errors.Cause(err) == ErrCorrupt {
+				return err
+			}
+			return classifyRedis(err)
+		}
+		return withKind(ErrConflict, errors.Errorf("%s of %s aborted after %d conflicting transactions", op, id, maxTxRetries))
+	})
+}
+
+// withContext runs op but returns as soon as ctx is done. go-redis v6 does not
+// observe contexts, so an abandoned command still runs to completion within
+// the configured socket timeouts; only the caller is released early.
+func withContext(ctx context.Context, op func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- op()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// classifyRedis maps go-redis errors onto the backend error kinds. Anything
+// unrecognised, such as an error reply from the server, is returned as is.
+func classifyRedis(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err == redis.Nil:
+		return ErrNotFound
+	case err == redis.TxFailedErr:
+		return withKind(ErrConflict, err)
+	case strings.HasPrefix(err.Error(), "WRONGTYPE"):
+		return withKind(ErrCorrupt, err)
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return withKind(ErrUnavailable, err)
+	}
+	switch err.Error() {
+	case io.EOF.Error(), io.ErrUnexpectedEOF.Error(), "redis: client is closed", "redis: connection pool timeout":
+		return withKind(ErrUnavailable, err)
+	}
+	return err
+}
+
+// toRecord builds a record from a stored value and its PTTL reply, which is
+// negative for keys without an expiry. Values written before records were
+// structured are plain "HH:MM AM" strings; they are read as version 0 and
+// rewritten as JSON by their next update.
+func toRecord(val string, pttl time.Duration) (Record, error) {
+	var rec Record
+	if strings.HasPrefix(val, "{") {
+		if err := json.Unmarshal([]byte(val), &rec); err != nil {
+			return Record{}, withKind(ErrCorrupt, errors.Wrap(err, "invalid stored record"))
+		}
+	} else {
+		minutes, err := parseLegacyTime(val)
+		if err != nil {
+			return Record{}, err
+		}
+		rec.Minutes = minutes
+	}
+
+	// Redis owns the expiry; the copy inside the value may be stale.
+	rec.ExpiresAt = time.Time{}
+	if pttl > 0 {
+		rec.ExpiresAt = time.Now().Add(pttl)
+	}
+	return rec, nil
+}
@@ -0,0 +1,161 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+func TestRedisTLSConfig(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	values := []struct {
+		name    string
+		cfg     RedisConfig
+		enabled bool
+		fails   bool
+	}{
+		{"Disabled", RedisConfig{}, false, false},
+		{"Disabled Ignores Files", RedisConfig{CAFile: "missing.pem"}, false, false},
+		{"System Roots", RedisConfig{TLS: true}, true, false},
+		{"Missing CA File", RedisConfig{TLS: true, CAFile: filepath.Join(dir, "missing.pem")}, false, true},
+		{"Invalid CA File", RedisConfig{TLS: true, CAFile: empty}, false, true},
+		{"Missing Key Pair", RedisConfig{TLS: true, CertFile: empty}, false, true},
+	}
+
+	for _, tt := range values {
+		c, err := tt.cfg.tlsConfig()
+		if (err != nil) != tt.fails {
+			t.Errorf("tlsConfig() %s: got error <%v> want failure <%t>", tt.name, err, tt.fails)
+		}
+		if (c != nil) != tt.enabled {
+			t.Errorf("tlsConfig() %s: got config <%v> want enabled <%t>", tt.name, c, tt.enabled)
+		}
+	}
+}
+
+func TestClassifyRedis(t *testing.T) {
+	values := []struct {
+		err      error
+		expected error
+	}{
+		{redis.Nil, ErrNotFound},
+		{redis.TxFailedErr, ErrConflict},
+		{io.EOF, ErrUnavailable},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrUnavailable},
+		{errors.New("redis: connection pool timeout"), ErrUnavailable},
+		{errors.New("WRONGTYPE Operation against a key holding the wrong kind of value"), ErrCorrupt},
+	}
+
+	for _, tt := range values {
+		if result := errors.Cause(classifyRedis(tt.err)); result != tt.expected {
+			t.Errorf("classifyRedis(%v) = got <%v> want <%v>", tt.err, result, tt.expected)
+		}
+	}
+
+	other := errors.New("ERR unknown command")
+	if result := classifyRedis(other); result != other {
+		t.Errorf("classifyRedis(%v) = got <%v> want <%v>", other, result, other)
+	}
+}
+
+func TestToRecord(t *testing.T) {
+	values := []struct {
+		name    string
+		val     string
+		minutes int
+		version int64
+		corrupt bool
+	}{
+		{"Structured", `{"minutes":795,"createdAt":"2018-06-01T09:30:00Z","updatedAt":"2018-06-01T09:30:00Z","version":3}`, 795, 3, false},
+		{"Legacy", "01:15 PM", 795, 0, false},
+		{"Legacy Lower Case", "01:15 pm", 795, 0, false},
+		{"Invalid Legacy", "25:00", 0, 0, true},
+		{"Invalid JSON", `{"minutes":`, 0, 0, true},
+	}
+
+	for _, tt := range values {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, err := toRecord(tt.val, -time.Millisecond)
+			if tt.corrupt {
+				if errors.Cause(err) != ErrCorrupt {
+					t.Errorf("TestToRecord - %s: got <%v> want <%v>", tt.name, err, ErrCorrupt)
+				}
+				return
+			}
+			if err != nil {
+				t.Error(err)
+			}
+			if rec.Minutes != tt.minutes {
+				t.Errorf("TestToRecord - %s - minutes: got <%d> want <%d>", tt.name, rec.Minutes, tt.minutes)
+			}
+			if rec.Version != tt.version {
+				t.Errorf("TestToRecord - %s - version: got <%d> want <%d>", tt.name, rec.Version, tt.version)
+			}
+			if !rec.ExpiresAt.IsZero() {
+				t.Errorf("TestToRecord - %s - expiresAt: got <%v> want none", tt.name, rec.ExpiresAt)
+			}
+		})
+	}
+}
+
+func TestPing(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	file, err := NewFile(filepath.Join(dir, "file"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql, err := NewSQL("sqlite3", filepath.Join(dir, "minutes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type pinger interface {
+		Ping(ctx context.Context) error
+	}
+	values := []struct {
+		name  string
+		b     pinger
+		close func() error
+	}{
+		{"Memory", NewMemory(), nil},
+		{"File", file, file.Close},
+		{"SQL", sql, sql.Close},
+	}
+
+	for _, tt := range values {
+		if err := tt.b.Ping(context.Background()); err != nil {
+			t.Errorf("TestPing - %s: got <%v> want <nil>", tt.name, err)
+		}
+		canceled, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := tt.b.Ping(canceled); err == nil {
+			t.Errorf("TestPing - %s - Canceled: got <nil> want error", tt.name)
+		}
+		if tt.close == nil {
+			continue
+		}
+		if err := tt.close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := tt.b.Ping(context.Background()); err == nil {
+			t.Errorf("TestPing - %s - Closed: got <nil> want error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package backend
+
+// BatchItem is one timeId of a batch operation. Batches take the timeIds to
+// work on as items and report back one item per timeId, in the same order.
+// Err holds what the single-item call would have failed with, so one failing
+// timeId does not fail the rest of the batch. Record is only returned by
+// creates and reads that succeeded.
+type BatchItem struct {
+	Id string
+	Record
+	Err error
+}
@@ -0,0 +1,137 @@
+package backend
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+type batcher interface {
+	SetTimeIds(ctx context.Context, items []BatchItem, change Change) ([]BatchItem, error)
+	GetTimeIds(ctx context.Context, ids []string) ([]BatchItem, error)
+	DeleteTimeIds(ctx context.Context, ids []string, change Change) ([]BatchItem, error)
+	GetHistory(ctx context.Context, id string, q HistoryQuery) ([]HistoryEntry, error)
+}
+
+// checkBatch runs the batch operations every backend must answer the same
+// way.
+func checkBatch(t *testing.T, name string, b batcher) {
+	ctx := context.Background()
+	ids := []string{
+		"0b3c1c8e-8a52-4d3c-9f0a-6c4c1f3e2a01",
+		"1d7e9a2b-3f4c-4b5d-8e6f-7a8b9c0d1e02",
+	}
+	missing := "2f1a3b4c-5d6e-4f7a-8b9c-0d1e2f3a4b03"
+
+	created, err := b.SetTimeIds(ctx, []BatchItem{
+		{Id: ids[0], Record: Record{Minutes: 540}},
+		{Id: ids[1], Record: Record{Minutes: 780, Label: "batch", Format: "24h"}},
+	}, Change{Op: ChangeCreate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, item := range created {
+		if item.Id != ids[i] || item.Err != nil || item.Version != 1 {
+			t.Errorf("%s - Batch Set - %d: got <%s, %v, %d> want <%s, <nil>, 1>", name, i, item.Id, item.Err, item.Version, ids[i])
+		}
+	}
+
+	got, err := b.GetTimeIds(ctx, []string{ids[1], missing, ids[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		id      string
+		minutes int
+		err     error
+	}{
+		{ids[1], 780, nil},
+		{missing, 0, ErrNotFound},
+		{ids[0], 540, nil},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("%s - Batch Get: got <%d> items want <%d>", name, len(got), len(expected))
+	}
+	for i, tt := range expected {
+		if got[i].Id != tt.id || got[i].Minutes != tt.minutes || errors.Cause(got[i].Err) != tt.err {
+			t.Errorf("%s - Batch Get - %d: got <%s, %d, %v> want <%s, %d, %v>", name, i, got[i].Id, got[i].Minutes, got[i].Err, tt.id, tt.minutes, tt.err)
+		}
+	}
+	if got[0].Label != "batch" {
+		t.Errorf("%s - Batch Get - Label: got <%s> want <%s>", name, got[0].Label, "batch")
+	}
+	if got[0].Format != "24h" {
+		t.Errorf("%s - Batch Get - Format: got <%s> want <%s>", name, got[0].Format, "24h")
+	}
+
+	deleted, err := b.DeleteTimeIds(ctx, []string{ids[0], missing}, Change{Op: ChangeDelete})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 || deleted[0].Err != nil || errors.Cause(deleted[1].Err) != ErrNotFound {
+		t.Errorf("%s - Batch Delete: got <%v>", name, deleted)
+	}
+
+	got, err = b.GetTimeIds(ctx, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errors.Cause(got[0].Err) != ErrNotFound || got[1].Err != nil {
+		t.Errorf("%s - Batch Delete - Get: got <%v, %v> want <%v, <nil>>", name, got[0].Err, got[1].Err, ErrNotFound)
+	}
+
+	history, err := b.GetHistory(ctx, ids[0], HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[1].Op != ChangeDelete || history[1].Minutes != 540 {
+		t.Errorf("%s - Batch Delete - History: got <%v>", name, history)
+	}
+}
+
+func TestMemoryBatch(t *testing.T) {
+	checkBatch(t, "TestMemoryBatch", NewMemory())
+}
+
+func TestFileBatch(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewFile(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBatch(t, "TestFileBatch", b)
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch must survive a restart like single writes do.
+	b, err = NewFile(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	got, err := b.GetTimeIds(context.Background(), []string{"0b3c1c8e-8a52-4d3c-9f0a-6c4c1f3e2a01", "1d7e9a2b-3f4c-4b5d-8e6f-7a8b9c0d1e02"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errors.Cause(got[0].Err) != ErrNotFound || got[1].Minutes != 780 {
+		t.Errorf("TestFileBatch - Recovery: got <%v>", got)
+	}
+}
+
+func TestSQLBatch(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewSQL("sqlite3", filepath.Join(dir, "minutes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	checkBatch(t, "TestSQLBatch", b)
+}
@@ -0,0 +1,82 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Every backend reports failures as one of these kinds so callers can react
+// without knowing the storage behind the interface. Use errors.Cause to
+// recover the kind from a returned error.
+var (
+	// ErrNotFound means the timeId does not exist or has expired.
+	ErrNotFound = errors.New("timeId not found")
+	// ErrConflict means a write lost to concurrent writers and was abandoned.
+	ErrConflict = errors.New("conflicting write")
+	// ErrUnavailable means the store could not be reached; retrying later may succeed.
+	ErrUnavailable = errors.New("backend unavailable")
+	// ErrCorrupt means stored data could not be interpreted.
+	ErrCorrupt = errors.New("stored data is corrupt")
+	// ErrInvalidCursor means a list cursor was not issued by this backend.
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrExists means a timeId being imported without overwriting is taken.
+	ErrExists = errors.New("timeId already exists")
+	// ErrUnsupported means the operation is not available with this store.
+	ErrUnsupported = errors.New("operation not supported")
+)
+
+// kindError attaches a kind to an underlying error while keeping its message.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string { return e.kind.Error() + ": " + e.err.Error() }
+
+// Cause lets errors.Cause resolve to the kind.
+func (e *kindError) Cause() error { return e.kind }
+
+// withKind classifies err as kind. A nil err stays nil.
+func withKind(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// retryError tells callers how long to wait before retrying a failed call.
+type retryError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryError) Error() string { return e.err.Error() }
+
+// Cause lets errors.Cause see through to the kind of the wrapped error.
+func (e *retryError) Cause() error { return e.err }
+
+// WithRetryAfter attaches to err the time after which the call may succeed.
+// A nil err stays nil.
+func WithRetryAfter(err error, after time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &retryError{err: err, after: after}
+}
+
+// RetryAfter returns the wait attached to err, or anything it wraps, by
+// WithRetryAfter.
+func RetryAfter(err error) (time.Duration, bool) {
+	for err != nil {
+		if r, ok := err.(*retryError); ok {
+			return r.after, true
+		}
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return 0, false
+}
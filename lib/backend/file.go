@@ -0,0 +1,536 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	logFileName      = "timeids.log"
+	snapshotFileName = "timeids.snapshot"
+	lockFileName     = "LOCK"
+
+	opSet    = "set"
+	opDelete = "del"
+)
+
+type logEntry struct {
+	Op   string        `json:"op"`
+	Id   string        `json:"id"`
+	Rec  *Record       `json:"rec,omitempty"`
+	Hist *HistoryEntry `json:"hist,omitempty"`
+}
+
+// snapshotState is the content of the snapshot file. Snapshots written before
+// history was recorded hold just the map of records.
+type snapshotState struct {
+	Times   map[string]Record         `json:"times"`
+	History map[string][]HistoryEntry `json:"history"`
+}
+
+// File is a single-node backend persisted to a local data directory. Every
+// write is appended to a log and synced to disk before it is acknowledged, and
+// the log is periodically compacted into a snapshot. On startup the snapshot is
+// loaded and the log replayed on top of it.
+//
+// A File holds an exclusive lock on its data directory until it is closed, so
+// two processes never append to the same log.
+type File struct {
+	mu            sync.Mutex
+	mem           *Memory
+	dir           string
+	lock          *os.File
+	readOnly      bool
+	log           *os.File
+	logSize       int64
+	pending       int
+	snapshotEvery int
+}
+
+func NewFile(dir string, snapshotEvery int) (*File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "unable to create data directory %s", dir)
+	}
+
+	lock, err := lockDir(dir, syscall.LOCK_EX)
+	if err != nil {
+		return nil, err
+	}
+	b := &File{
+		mem:           NewMemory(),
+		dir:           dir,
+		lock:          lock,
+		snapshotEvery: snapshotEvery,
+	}
+	if err := b.load(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	// Compact whatever was replayed so the log starts empty.
+	if err := b.snapshot(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// NewFileReadOnly loads the data directory without compacting or otherwise
+// writing to it, for offline reads such as an export. Writes fail with
+// ErrUnsupported. It shares the lock with other readers, so it fails while a
+// server has the directory open.
+func NewFileReadOnly(dir string) (*File, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, errors.Wrapf(err, "unable to open data directory %s", dir)
+	}
+
+	lock, err := lockDir(dir, syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	b := &File{
+		mem:      NewMemory(),
+		dir:      dir,
+		lock:     lock,
+		readOnly: true,
+	}
+	if err := b.load(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// lockDir takes a lock of the given flock kind on the lock file of dir,
+// failing at once if another process holds a conflicting one. The lock is
+// released when the returned file is closed, or when the process exits.
+func lockDir(dir string, how int) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open lock file")
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errors.Errorf("data directory %s is in use by another process", dir)
+		}
+		return nil, errors.Wrap(err, "unable to lock data directory")
+	}
+	return f, nil
+}
+
+// SetHistoryLimit keeps only the newest n history entries of each timeId,
+// like Memory.SetHistoryLimit.
+func (b *File) SetHistoryLimit(n int) {
+	b.mem.SetHistoryLimit(n)
+}
+
+func (b *File) SetTimeId(ctx context.Context, id string, rec Record, change Change) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	rec = rec.created(now)
+	e := change.entry(b.nextSeq(id), rec, now)
+	if err := b.append(logEntry{Op: opSet, Id: id, Rec: &rec, Hist: &e}); err != nil {
+		return err
+	}
+	b.mem.apply(id, &rec, e)
+	b.compact()
+	return nil
+}
+
+func (b *File) GetTimeId(ctx context.Context, id string) (Record, error) {
+	return b.mem.GetTimeId(ctx, id)
+}
+
+func (b *File) UpdateTimeId(ctx context.Context, id string, fn func(Record) (Record, Change, error)) (Record, error) {
+	if err := ctx.Err(); err != nil {
+		return Record{}, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current, err := b.mem.GetTimeId(ctx, id)
+	if err != nil {
+		return Record{}, err
+	}
+	rec, change, err := fn(current)
+	if err != nil {
+		return Record{}, err
+	}
+	now := time.Now()
+	rec = rec.updated(current, now)
+	e := change.entry(b.nextSeq(id), rec, now)
+	if err := b.append(logEntry{Op: opSet, Id: id, Rec: &rec, Hist: &e}); err != nil {
+		return Record{}, err
+	}
+	b.mem.apply(id, &rec, e)
+	b.compact()
+	return rec, nil
+}
+
+func (b *File) DeleteTimeId(ctx context.Context, id string, fn func(Record) error, change Change) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current, err := b.mem.GetTimeId(ctx, id)
+	if err != nil {
+		return err
+	}
+	if fn != nil {
+		if err := fn(current); err != nil {
+			return err
+		}
+	}
+	e := change.entry(b.nextSeq(id), current, time.Now())
+	if err := b.append(logEntry{Op: opDelete, Id: id, Hist: &e}); err != nil {
+		return err
+	}
+	b.mem.apply(id, nil, e)
+	b.compact()
+	return nil
+}
+
+func (b *File) GetHistory(ctx context.Context, id string, q HistoryQuery) ([]HistoryEntry, error) {
+	return b.mem.GetHistory(ctx, id, q)
+}
+
+// ImportTimeId stores rec as is, keeping its version and timestamps.
+func (b *File) ImportTimeId(ctx context.Context, id string, rec Record, overwrite bool, change Change) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.mem.GetTimeId(ctx, id); err == nil && !overwrite {
+		return ErrExists
+	}
+	e := change.entry(b.nextSeq(id), rec, time.Now())
+	if err := b.append(logEntry{Op: opSet, Id: id, Rec: &rec, Hist: &e}); err != nil {
+		return err
+	}
+	b.mem.apply(id, &rec, e)
+	b.compact()
+	return nil
+}
+
+// SetTimeIds appends the whole batch to the log with a single sync.
+func (b *File) SetTimeIds(ctx context.Context, items []BatchItem, change Change) ([]BatchItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	res := make([]BatchItem, len(items))
+	entries := make([]logEntry, len(items))
+	for i, item := range items {
+		rec := item.Record.created(now)
+		e := change.entry(b.nextSeq(item.Id), rec, now)
+		res[i] = BatchItem{Id: item.Id, Record: rec}
+		entries[i] = logEntry{Op: opSet, Id: item.Id, Rec: &res[i].Record, Hist: &e}
+	}
+	if err := b.append(entries...); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		b.mem.apply(e.Id, e.Rec, *e.Hist)
+	}
+	b.compact()
+	return res, nil
+}
+
+func (b *File) GetTimeIds(ctx context.Context, ids []string) ([]BatchItem, error) {
+	return b.mem.GetTimeIds(ctx, ids)
+}
+
+// DeleteTimeIds appends the deletes of every timeId found to the log with a
+// single sync.
+func (b *File) DeleteTimeIds(ctx context.Context, ids []string, change Change) ([]BatchItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	res := make([]BatchItem, len(ids))
+	var entries []logEntry
+	for i, id := range ids {
+		current, err := b.mem.GetTimeId(ctx, id)
+		if err != nil {
+			res[i] = BatchItem{Id: id, Err: err}
+			continue
+		}
+		e := change.entry(b.nextSeq(id), current, now)
+		res[i] = BatchItem{Id: id}
+		entries = append(entries, logEntry{Op: opDelete, Id: id, Hist: &e})
+	}
+	if len(entries) == 0 {
+		return res, nil
+	}
+	if err := b.append(entries...); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		b.mem.apply(e.Id, nil, *e.Hist)
+	}
+	b.compact()
+	return res, nil
+}
+
+func (b *File) ListTimeIds(ctx context.Context, q ListQuery) ([]Listing, string, error) {
+	return b.mem.ListTimeIds(ctx, q)
+}
+
+// nextSeq returns the sequence number of the next history entry of id.
+// Callers must hold b.mu, which serialises every write to b.mem.
+func (b *File) nextSeq(id string) int64 {
+	b.mem.mu.RLock()
+	defer b.mem.mu.RUnlock()
+
+	return b.mem.nextSeq(id)
+}
+
+// Ping checks that the log is still open and accessible.
+func (b *File) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.readOnly {
+		return nil
+	}
+	if _, err := b.log.Stat(); err != nil {
+		return withKind(ErrUnavailable, errors.Wrap(err, "unable to stat log"))
+	}
+	return nil
+}
+
+// Close compacts the log into a snapshot, unless opened read-only, and
+// releases the log file and the lock on the data directory.
+func (b *File) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	defer b.lock.Close()
+	if b.readOnly {
+		return nil
+	}
+	if err := b.snapshot(); err != nil {
+		return err
+	}
+	return b.log.Close()
+}
+
+// append durably records entries in the log with a single sync. Callers must
+// hold b.mu.
+func (b *File) append(entries ...logEntry) error {
+	if b.readOnly {
+		return withKind(ErrUnsupported, errors.New("file backend opened read-only"))
+	}
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	data := buf.Bytes()
+
+	// On failure the log is cut back to its last good size so a partial entry
+	// never ends up in front of later ones.
+	if _, err := b.log.Write(data); err != nil {
+		b.log.Truncate(b.logSize)
+		return withKind(ErrUnavailable, errors.Wrap(err, "unable to write log"))
+	}
+	if err := b.log.Sync(); err != nil {
+		b.log.Truncate(b.logSize)
+		return withKind(ErrUnavailable, errors.Wrap(err, "unable to sync log"))
+	}
+
+	b.logSize += int64(len(data))
+	b.pending += len(entries)
+	return nil
+}
+
+// compact snapshots the state once enough entries have accumulated in the log.
+// Callers must hold b.mu and have applied the appended entries to b.mem.
+func (b *File) compact() {
+	if b.snapshotEvery > 0 && b.pending >= b.snapshotEvery {
+		// Entries are already durable in the log, so a failed compaction is
+		// retried on the next write rather than failing this one.
+		_ = b.snapshot()
+	}
+}
+
+// load reads the snapshot and replays the log on top of it.
+func (b *File) load() error {
+	if err := b.loadSnapshot(); err != nil {
+		return err
+	}
+	return b.replayLog()
+}
+
+func (b *File) loadSnapshot() error {
+	data, err := ioutil.ReadFile(filepath.Join(b.dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to read snapshot")
+	}
+
+	var state snapshotState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return withKind(ErrCorrupt, errors.Wrap(err, "unable to decode snapshot"))
+	}
+	if state.Times == nil {
+		if err := json.Unmarshal(data, &state.Times); err != nil {
+			return withKind(ErrCorrupt, errors.Wrap(err, "unable to decode snapshot"))
+		}
+	}
+	for id, rec := range state.Times {
+		b.mem.times[id] = rec
+	}
+	for id, entries := range state.History {
+		b.mem.history[id] = entries
+	}
+	return nil
+}
+
+// replayLog applies every complete log entry to the in-memory state. A torn
+// final line left by a crash mid-write was never acknowledged and is dropped.
+func (b *File) replayLog() error {
+	f, err := os.Open(filepath.Join(b.dir, logFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to open log")
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "unable to read log")
+		}
+
+		var e logEntry
+		if err := json.Unmarshal(bytes.TrimSpace(line), &e); err != nil {
+			return withKind(ErrCorrupt, errors.Wrap(err, "unable to decode log entry"))
+		}
+		switch e.Op {
+		case opSet:
+			if e.Rec == nil {
+				return withKind(ErrCorrupt, errors.Errorf("log entry for %s has no record", e.Id))
+			}
+			b.mem.times[e.Id] = *e.Rec
+		case opDelete:
+			delete(b.mem.times, e.Id)
+		default:
+			return withKind(ErrCorrupt, errors.Errorf("unknown log operation %q", e.Op))
+		}
+		if e.Hist != nil && e.Hist.Seq == b.mem.nextSeq(e.Id) {
+			b.mem.history[e.Id] = append(b.mem.history[e.Id], *e.Hist)
+		}
+	}
+}
+
+// snapshot writes the live state to a new snapshot file, atomically replaces
+// the previous one and truncates the log. Expired timeIds are left out, but
+// their history is kept. A crash between the rename and the truncate replays
+// the log over a snapshot that already contains it, which would duplicate
+// history entries, so entries already in the snapshot are skipped on replay.
+func (b *File) snapshot() error {
+	data, err := json.Marshal(snapshotState{
+		Times:   b.mem.live(),
+		History: b.mem.histories(),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(b.dir, snapshotFileName+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "unable to create snapshot")
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errors.Wrap(err, "unable to write snapshot")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "unable to sync snapshot")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "unable to close snapshot")
+	}
+	if err := os.Rename(tmp, filepath.Join(b.dir, snapshotFileName)); err != nil {
+		return errors.Wrap(err, "unable to replace snapshot")
+	}
+	if err := syncDir(b.dir); err != nil {
+		return err
+	}
+
+	if b.log != nil {
+		b.log.Close()
+	}
+	b.log, err = os.OpenFile(filepath.Join(b.dir, logFileName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "unable to open log")
+	}
+	b.logSize = 0
+	b.pending = 0
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "unable to open data directory")
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return errors.Wrap(err, "unable to sync data directory")
+	}
+	return nil
+}
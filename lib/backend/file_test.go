@@ -0,0 +1,172 @@
+package backend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func tempDataDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "minutes-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestFileRecovery(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewFile(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetTimeId(ctx, "a", Record{Minutes: 60}, Change{Op: ChangeCreate}); err != nil {
+		t.Error(err)
+	}
+	if err := b.SetTimeId(ctx, "b", Record{Minutes: 120}, Change{Op: ChangeCreate}); err != nil {
+		t.Error(err)
+	}
+	if _, err := b.UpdateTimeId(ctx, "a", func(rec Record) (Record, Change, error) {
+		rec.Minutes = 180
+		return rec, Change{Op: ChangeSet}, nil
+	}); err != nil {
+		t.Error(err)
+	}
+	if err := b.SetTimeId(ctx, "d", Record{Minutes: 240, ExpiresAt: time.Now().Add(-time.Second)}, Change{Op: ChangeCreate}); err != nil {
+		t.Error(err)
+	}
+	if err := b.DeleteTimeId(ctx, "b", nil, Change{Op: ChangeDelete}); err != nil {
+		t.Error(err)
+	}
+	// Simulate a crash: the log is never compacted and a torn entry is left behind.
+	b.log.Write([]byte(`{"op":"set","id":"c","va`))
+	b.log.Close()
+	b.lock.Close()
+
+	b, err = NewFile(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	rec, err := b.GetTimeId(ctx, "a")
+	if err != nil {
+		t.Error(err)
+	}
+	if rec.Minutes != 180 {
+		t.Errorf("TestFileRecovery - Get a: got <%d> want <%d>", rec.Minutes, 180)
+	}
+	if _, err := b.GetTimeId(ctx, "b"); errors.Cause(err) != ErrNotFound {
+		t.Errorf("TestFileRecovery - Get b: got <%v> want <%v>", err, ErrNotFound)
+	}
+	if _, err := b.GetTimeId(ctx, "c"); errors.Cause(err) != ErrNotFound {
+		t.Errorf("TestFileRecovery - Get c: got <%v> want <%v>", err, ErrNotFound)
+	}
+	if _, err := b.GetTimeId(ctx, "d"); errors.Cause(err) != ErrNotFound {
+		t.Errorf("TestFileRecovery - Get d: got <%v> want <%v>", err, ErrNotFound)
+	}
+	checkHistory(t, "TestFileRecovery", b, "a", ChangeCreate, ChangeSet)
+	checkHistory(t, "TestFileRecovery", b, "b", ChangeCreate, ChangeDelete)
+}
+
+func TestFileSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewFile(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if err := b.SetTimeId(ctx, id, Record{Minutes: 720}, Change{Op: ChangeCreate}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Two entries were compacted into the snapshot, leaving one in the log.
+	if b.pending != 1 {
+		t.Errorf("TestFileSnapshot - pending log entries: got <%d> want <%d>", b.pending, 1)
+	}
+	if _, err := os.Stat(filepath.Join(dir, snapshotFileName)); err != nil {
+		t.Error(err)
+	}
+
+	b.log.Close()
+	b.lock.Close()
+	b, err = NewFile(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := b.GetTimeId(ctx, id); err != nil {
+			t.Errorf("TestFileSnapshot - Get %s: <%v>", id, err)
+		}
+		checkHistory(t, "TestFileSnapshot", b, id, ChangeCreate)
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewFile(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetTimeId(ctx, "a", Record{Minutes: 60}, Change{Op: ChangeCreate}); err != nil {
+		t.Error(err)
+	}
+	if _, err := NewFile(dir, 0); err == nil {
+		t.Errorf("TestFileLock - NewFile while open: got <%v> want an error", err)
+	}
+	if _, err := NewFileReadOnly(dir); err == nil {
+		t.Errorf("TestFileLock - NewFileReadOnly while open: got <%v> want an error", err)
+	}
+	// Leave the write in the log, as a crashed server would.
+	b.log.Close()
+	b.lock.Close()
+
+	r, err := NewFileReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFile(dir, 0); err == nil {
+		t.Errorf("TestFileLock - NewFile while read: got <%v> want an error", err)
+	}
+	if _, err := r.GetTimeId(ctx, "a"); err != nil {
+		t.Errorf("TestFileLock - Get a: <%v>", err)
+	}
+	if err := r.SetTimeId(ctx, "b", Record{Minutes: 60}, Change{Op: ChangeCreate}); errors.Cause(err) != ErrUnsupported {
+		t.Errorf("TestFileLock - Set read-only: got <%v> want <%v>", err, ErrUnsupported)
+	}
+	if err := r.Close(); err != nil {
+		t.Error(err)
+	}
+	// The read-only open left the log as it was.
+	if info, err := os.Stat(filepath.Join(dir, logFileName)); err != nil || info.Size() == 0 {
+		t.Errorf("TestFileLock - log after read-only open: got <%v> want a non-empty log", err)
+	}
+}
+
+func TestFileImport(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewFile(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	checkImport(t, "TestFileImport", b)
+}
@@ -0,0 +1,103 @@
+package backend
+
+import (
+	"time"
+)
+
+// Operations recorded in the history of a timeId.
+const (
+	ChangeCreate = "create"
+	ChangeAdd    = "add"
+	ChangeSet    = "set"
+	ChangeDelete = "delete"
+	ChangeUndo   = "undo"
+	ChangeRedo   = "redo"
+	ChangeImport = "import"
+)
+
+// Change describes a write for the history of the timeId it is applied to.
+type Change struct {
+	Op string
+	// Delta is the number of minutes the time was moved by. Timers kept to
+	// the second also set DeltaSeconds, with Delta rounded toward zero.
+	Delta        int
+	DeltaSeconds int
+	RequestId    string
+	Caller       string
+}
+
+// HistoryEntry is a change recorded together with its outcome. History
+// outlives the timeId, so deleted and expired timeIds can still be audited.
+type HistoryEntry struct {
+	// Seq numbers the entries of a timeId from 1 in the order they were made.
+	Seq          int64  `json:"seq"`
+	Op           string `json:"op"`
+	Delta        int    `json:"delta"`
+	DeltaSeconds int    `json:"deltaSeconds,omitempty"`
+	// Minutes, Seconds and DayOffset are the time after the change, or the
+	// last time for deletes.
+	Minutes   int       `json:"minutes"`
+	Seconds   int       `json:"seconds,omitempty"`
+	DayOffset int       `json:"dayOffset,omitempty"`
+	Version   int64     `json:"version"`
+	Time      time.Time `json:"time"`
+	RequestId string    `json:"requestId,omitempty"`
+	Caller    string    `json:"caller,omitempty"`
+}
+
+// HistoryQuery selects a page of the history of a timeId.
+type HistoryQuery struct {
+	// After skips the entries up to and including this sequence number.
+	After int64
+	// From and To bound the entry times, inclusive and exclusive
+	// respectively. The zero value leaves that side open.
+	From time.Time
+	To   time.Time
+	// Limit caps the number of entries returned. Zero returns them all.
+	Limit int
+}
+
+// entry records the change against the record it resulted in.
+func (c Change) entry(seq int64, rec Record, now time.Time) HistoryEntry {
+	return HistoryEntry{
+		Seq:          seq,
+		Op:           c.Op,
+		Delta:        c.Delta,
+		DeltaSeconds: c.DeltaSeconds,
+		Minutes:      rec.Minutes,
+		Seconds:      rec.Seconds,
+		DayOffset:    rec.DayOffset,
+		Version:      rec.Version,
+		Time:         now.UTC(),
+		RequestId:    c.RequestId,
+		Caller:       c.Caller,
+	}
+}
+
+func (q HistoryQuery) match(e HistoryEntry) bool {
+	if e.Seq <= q.After {
+		return false
+	}
+	if !q.From.IsZero() && e.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !e.Time.Before(q.To) {
+		return false
+	}
+	return true
+}
+
+// page applies q to entries ordered by sequence number.
+func (q HistoryQuery) page(entries []HistoryEntry) []HistoryEntry {
+	res := []HistoryEntry{}
+	for _, e := range entries {
+		if !q.match(e) {
+			continue
+		}
+		if q.Limit > 0 && len(res) == q.Limit {
+			break
+		}
+		res = append(res, e)
+	}
+	return res
+}
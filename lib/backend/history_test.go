@@ -0,0 +1,164 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryQueryPage(t *testing.T) {
+	start := time.Date(2018, 6, 1, 9, 0, 0, 0, time.UTC)
+	var entries []HistoryEntry
+	for i := 0; i < 5; i++ {
+		entries = append(entries, HistoryEntry{Seq: int64(i + 1), Time: start.Add(time.Duration(i) * time.Hour)})
+	}
+
+	values := []struct {
+		name     string
+		q        HistoryQuery
+		expected []int64
+	}{
+		{"All", HistoryQuery{}, []int64{1, 2, 3, 4, 5}},
+		{"Limit", HistoryQuery{Limit: 2}, []int64{1, 2}},
+		{"After", HistoryQuery{After: 2, Limit: 2}, []int64{3, 4}},
+		{"From", HistoryQuery{From: start.Add(3 * time.Hour)}, []int64{4, 5}},
+		{"To", HistoryQuery{To: start.Add(2 * time.Hour)}, []int64{1, 2}},
+		{"Empty", HistoryQuery{After: 5}, nil},
+	}
+
+	for _, tt := range values {
+		var seqs []int64
+		for _, e := range tt.q.page(entries) {
+			seqs = append(seqs, e.Seq)
+		}
+		if fmt.Sprint(seqs) != fmt.Sprint(tt.expected) {
+			t.Errorf("TestHistoryQueryPage - %s: got <%v> want <%v>", tt.name, seqs, tt.expected)
+		}
+	}
+}
+
+// checkHistory verifies the operations recorded for id and their numbering.
+func checkHistory(t *testing.T, name string, b interface {
+	GetHistory(ctx context.Context, id string, q HistoryQuery) ([]HistoryEntry, error)
+}, id string, ops ...string) {
+	entries, err := b.GetHistory(context.Background(), id, HistoryQuery{})
+	if err != nil {
+		t.Errorf("%s - history of %s: <%v>", name, id, err)
+		return
+	}
+	var got []string
+	for i, e := range entries {
+		got = append(got, e.Op)
+		if e.Seq != int64(i+1) {
+			t.Errorf("%s - history of %s - seq: got <%d> want <%d>", name, id, e.Seq, i+1)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(ops) {
+		t.Errorf("%s - history of %s: got <%v> want <%v>", name, id, got, ops)
+	}
+}
+
+// historyLimitBackend is implemented by every backend.
+type historyLimitBackend interface {
+	SetHistoryLimit(n int)
+	SetTimeId(ctx context.Context, id string, rec Record, change Change) error
+	UpdateTimeId(ctx context.Context, id string, fn func(Record) (Record, Change, error)) (Record, error)
+	GetHistory(ctx context.Context, id string, q HistoryQuery) ([]HistoryEntry, error)
+}
+
+// redisTestClient connects to the Redis server at REDIS_HOST, skipping the
+// test when it is unset, and deletes the given keys once the test is done.
+func redisTestClient(t *testing.T, keys ...string) *Client {
+	host := os.Getenv("REDIS_HOST")
+	if host == "" {
+		t.Skip("REDIS_HOST not set")
+	}
+	b, err := NewBackend(RedisConfig{Addrs: []string{host}, DialTimeout: time.Second, ReadTimeout: time.Second, WriteTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		b.Client.Del(keys...)
+		b.Client.Close()
+	})
+	return b
+}
+
+func TestHistoryLimit(t *testing.T) {
+	const id = "7c1e4b2a-5d3f-4a6b-9c8d-0e1f2a3b4c5d"
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	file, err := NewFile(filepath.Join(dir, "file"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	sql, err := NewSQL("sqlite3", filepath.Join(dir, "minutes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sql.Close()
+
+	values := []struct {
+		name string
+		b    func(t *testing.T) historyLimitBackend
+	}{
+		{"Memory", func(*testing.T) historyLimitBackend { return NewMemory() }},
+		{"File", func(*testing.T) historyLimitBackend { return file }},
+		{"SQL", func(*testing.T) historyLimitBackend { return sql }},
+		{"Redis", func(t *testing.T) historyLimitBackend {
+			return redisTestClient(t, id, historyKey(id), trimmedKey(id))
+		}},
+	}
+
+	for _, tt := range values {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			b := tt.b(t)
+			b.SetHistoryLimit(3)
+			if err := b.SetTimeId(ctx, id, Record{Minutes: 0}, Change{Op: ChangeCreate}); err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i <= 4; i++ {
+				if _, err := b.UpdateTimeId(ctx, id, func(rec Record) (Record, Change, error) {
+					rec.Minutes++
+					return rec, Change{Op: ChangeAdd, Delta: 1}, nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			queries := []struct {
+				name     string
+				q        HistoryQuery
+				expected []int64
+			}{
+				{"All", HistoryQuery{}, []int64{3, 4, 5}},
+				{"Limit", HistoryQuery{Limit: 2}, []int64{3, 4}},
+				{"After Trimmed", HistoryQuery{After: 1, Limit: 1}, []int64{3}},
+				{"After", HistoryQuery{After: 4}, []int64{5}},
+				{"Empty", HistoryQuery{After: 5}, nil},
+			}
+			for _, qq := range queries {
+				entries, err := b.GetHistory(ctx, id, qq.q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var seqs []int64
+				for _, e := range entries {
+					seqs = append(seqs, e.Seq)
+					if e.Minutes != int(e.Seq)-1 {
+						t.Errorf("TestHistoryLimit - %s - %s - minutes of %d: got <%d> want <%d>", tt.name, qq.name, e.Seq, e.Minutes, e.Seq-1)
+					}
+				}
+				if fmt.Sprint(seqs) != fmt.Sprint(qq.expected) {
+					t.Errorf("TestHistoryLimit - %s - %s: got <%v> want <%v>", tt.name, qq.name, seqs, qq.expected)
+				}
+			}
+		})
+	}
+}
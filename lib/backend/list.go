@@ -0,0 +1,68 @@
+package backend
+
+import (
+	"encoding/base64"
+	"time"
+)
+
+// ListQuery selects a page of live timeIds.
+type ListQuery struct {
+	// Cursor is the opaque position returned with the previous page. The
+	// empty string starts from the beginning.
+	Cursor string
+	// Limit caps the number of timeIds returned. Zero returns them all.
+	Limit int
+	// MinutesFrom and MinutesTo bound the current time, both inclusive. When
+	// MinutesFrom is greater than MinutesTo the range wraps around midnight.
+	// Nil leaves the current time unrestricted; both must be set together.
+	MinutesFrom *int
+	MinutesTo   *int
+	// CreatedFrom and CreatedTo bound the creation time, inclusive and
+	// exclusive respectively. The zero value leaves that side open.
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// Label, when not empty, only matches timeIds with exactly this label.
+	Label string
+}
+
+// Listing is a timeId returned by a list query.
+type Listing struct {
+	Id string
+	Record
+}
+
+func (q ListQuery) match(rec Record) bool {
+	if q.MinutesFrom != nil && q.MinutesTo != nil {
+		from, to := *q.MinutesFrom, *q.MinutesTo
+		if from <= to && (rec.Minutes < from || rec.Minutes > to) {
+			return false
+		}
+		if from > to && rec.Minutes < from && rec.Minutes > to {
+			return false
+		}
+	}
+	if !q.CreatedFrom.IsZero() && rec.CreatedAt.Before(q.CreatedFrom) {
+		return false
+	}
+	if !q.CreatedTo.IsZero() && !rec.CreatedAt.Before(q.CreatedTo) {
+		return false
+	}
+	if q.Label != "" && rec.Label != q.Label {
+		return false
+	}
+	return true
+}
+
+// encodeCursor and decodeCursor wrap backend specific positions so clients
+// treat them as opaque.
+func encodeCursor(pos string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(pos))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	pos, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+	return string(pos), nil
+}
@@ -0,0 +1,149 @@
+package backend
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type lister interface {
+	SetTimeId(ctx context.Context, id string, rec Record, change Change) error
+	ListTimeIds(ctx context.Context, q ListQuery) ([]Listing, string, error)
+}
+
+// checkList runs the list queries every backend must answer the same way.
+func checkList(t *testing.T, name string, b lister) {
+	ctx := context.Background()
+	recs := map[string]Record{
+		"0b3c1c8e-8a52-4d3c-9f0a-6c4c1f3e2a01": {Minutes: 540, Label: "standup"},
+		"1d7e9a2b-3f4c-4b5d-8e6f-7a8b9c0d1e02": {Minutes: 1410, Label: "standup"},
+		"2f1a3b4c-5d6e-4f7a-8b9c-0d1e2f3a4b03": {Minutes: 780},
+		"3a2b1c0d-9e8f-4a7b-6c5d-4e3f2a1b0c04": {Minutes: 60, ExpiresAt: time.Now().Add(-time.Minute)},
+	}
+	for id, rec := range recs {
+		if err := b.SetTimeId(ctx, id, rec, Change{Op: ChangeCreate}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	minutes := func(m int) *int { return &m }
+	values := []struct {
+		name     string
+		q        ListQuery
+		expected []string
+	}{
+		{"All", ListQuery{}, []string{"0b3c1c8e-8a52-4d3c-9f0a-6c4c1f3e2a01", "1d7e9a2b-3f4c-4b5d-8e6f-7a8b9c0d1e02", "2f1a3b4c-5d6e-4f7a-8b9c-0d1e2f3a4b03"}},
+		{"Label", ListQuery{Label: "standup"}, []string{"0b3c1c8e-8a52-4d3c-9f0a-6c4c1f3e2a01", "1d7e9a2b-3f4c-4b5d-8e6f-7a8b9c0d1e02"}},
+		{"Range", ListQuery{MinutesFrom: minutes(500), MinutesTo: minutes(800)}, []string{"0b3c1c8e-8a52-4d3c-9f0a-6c4c1f3e2a01", "2f1a3b4c-5d6e-4f7a-8b9c-0d1e2f3a4b03"}},
+		{"Wrapping Range", ListQuery{MinutesFrom: minutes(1380), MinutesTo: minutes(600)}, []string{"0b3c1c8e-8a52-4d3c-9f0a-6c4c1f3e2a01", "1d7e9a2b-3f4c-4b5d-8e6f-7a8b9c0d1e02"}},
+		{"Created Before", ListQuery{CreatedTo: time.Now().Add(-time.Hour)}, []string{}},
+		{"Created After", ListQuery{CreatedFrom: time.Now().Add(-time.Hour)}, []string{"0b3c1c8e-8a52-4d3c-9f0a-6c4c1f3e2a01", "1d7e9a2b-3f4c-4b5d-8e6f-7a8b9c0d1e02", "2f1a3b4c-5d6e-4f7a-8b9c-0d1e2f3a4b03"}},
+	}
+
+	for _, tt := range values {
+		t.Run(tt.name, func(t *testing.T) {
+			res, next, err := b.ListTimeIds(ctx, tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next != "" {
+				t.Errorf("%s - List - %s - Cursor: got <%s> want <>", name, tt.name, next)
+			}
+			ids := make([]string, len(res))
+			for i, l := range res {
+				ids[i] = l.Id
+				if l.Minutes != recs[l.Id].Minutes {
+					t.Errorf("%s - List - %s - Minutes: got <%d> want <%d>", name, tt.name, l.Minutes, recs[l.Id].Minutes)
+				}
+			}
+			if len(ids) != len(tt.expected) {
+				t.Fatalf("%s - List - %s: got <%v> want <%v>", name, tt.name, ids, tt.expected)
+			}
+			for i := range ids {
+				if ids[i] != tt.expected[i] {
+					t.Errorf("%s - List - %s: got <%v> want <%v>", name, tt.name, ids, tt.expected)
+					break
+				}
+			}
+		})
+	}
+
+	t.Run("Pagination", func(t *testing.T) {
+		first, next, err := b.ListTimeIds(ctx, ListQuery{Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(first) != 2 || next == "" {
+			t.Fatalf("%s - List - Pagination - First Page: got <%d, %q> want <2, cursor>", name, len(first), next)
+		}
+		second, next, err := b.ListTimeIds(ctx, ListQuery{Limit: 2, Cursor: next})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(second) != 1 || next != "" {
+			t.Errorf("%s - List - Pagination - Second Page: got <%d, %q> want <1, >", name, len(second), next)
+		}
+		if len(second) == 1 && second[0].Id != "2f1a3b4c-5d6e-4f7a-8b9c-0d1e2f3a4b03" {
+			t.Errorf("%s - List - Pagination - Second Page: got <%s> want <%s>", name, second[0].Id, "2f1a3b4c-5d6e-4f7a-8b9c-0d1e2f3a4b03")
+		}
+	})
+
+	t.Run("Invalid Cursor", func(t *testing.T) {
+		_, _, err := b.ListTimeIds(ctx, ListQuery{Cursor: "!!"})
+		if errors.Cause(err) != ErrInvalidCursor {
+			t.Errorf("%s - List - Invalid Cursor: got <%v> want <%v>", name, err, ErrInvalidCursor)
+		}
+	})
+}
+
+func TestMemoryList(t *testing.T) {
+	checkList(t, "TestMemoryList", NewMemory())
+}
+
+func TestSQLList(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewSQL("sqlite3", filepath.Join(dir, "minutes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	checkList(t, "TestSQLList", b)
+}
+
+func TestScanCursor(t *testing.T) {
+	values := []struct {
+		name   string
+		cursor string
+		pos    uint64
+		skip   int
+		fails  bool
+	}{
+		{"Empty", "", 0, 0, false},
+		{"Round Trip", encodeScanCursor(1234, 7), 1234, 7, false},
+		{"Not Base64", "!!", 0, 0, true},
+		{"Missing Skip", encodeCursor("1234"), 0, 0, true},
+		{"Negative Skip", encodeCursor("1234:-1"), 0, 0, true},
+		{"Bad Cursor", encodeCursor("abc:0"), 0, 0, true},
+	}
+
+	for _, tt := range values {
+		t.Run(tt.name, func(t *testing.T) {
+			pos, skip, err := decodeScanCursor(tt.cursor)
+			if tt.fails {
+				if err != ErrInvalidCursor {
+					t.Errorf("TestScanCursor - %s: got <%v> want <%v>", tt.name, err, ErrInvalidCursor)
+				}
+				return
+			}
+			if err != nil || pos != tt.pos || skip != tt.skip {
+				t.Errorf("TestScanCursor - %s: got <%d, %d, %v> want <%d, %d, <nil>>", tt.name, pos, skip, err, tt.pos, tt.skip)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package backend
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory is a concurrency-safe in-process backend. All state is lost when the
+// process exits, which makes it suitable for development and tests. Expired
+// timeIds are removed lazily the next time they are accessed. Operations never
+// block, so contexts are only checked on entry.
+type Memory struct {
+	mu      sync.RWMutex
+	times   map[string]Record
+	history map[string][]HistoryEntry
+	// historyLimit caps the entries kept per timeId; zero keeps them all.
+	historyLimit int
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		times:   make(map[string]Record),
+		history: make(map[string][]HistoryEntry),
+	}
+}
+
+// SetHistoryLimit keeps only the newest n history entries of each timeId,
+// dropping older ones as new entries are appended. Zero keeps them all. It
+// must be called before the backend is used.
+func (b *Memory) SetHistoryLimit(n int) {
+	b.historyLimit = n
+}
+
+func (b *Memory) SetTimeId(ctx context.Context, id string, rec Record, change Change) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	rec = rec.created(now)
+	b.record(id, &rec, change.entry(b.nextSeq(id), rec, now))
+	return nil
+}
+
+// Ping always succeeds while ctx is live; the memory backend cannot become
+// unreachable.
+func (b *Memory) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (b *Memory) GetTimeId(ctx context.Context, id string) (Record, error) {
+	if err := ctx.Err(); err != nil {
+		return Record{}, err
+	}
+
+	b.mu.RLock()
+	rec, ok := b.times[id]
+	b.mu.RUnlock()
+	if !ok {
+		return Record{}, ErrNotFound
+	}
+
+	if rec.Expired(time.Now()) {
+		b.mu.Lock()
+		b.lookup(id)
+		b.mu.Unlock()
+		return Record{}, ErrNotFound
+	}
+	return rec, nil
+}
+
+func (b *Memory) UpdateTimeId(ctx context.Context, id string, fn func(Record) (Record, Change, error)) (Record, error) {
+	if err := ctx.Err(); err != nil {
+		return Record{}, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current, ok := b.lookup(id)
+	if !ok {
+		return Record{}, ErrNotFound
+	}
+	rec, change, err := fn(current)
+	if err != nil {
+		return Record{}, err
+	}
+	now := time.Now()
+	rec = rec.updated(current, now)
+	b.record(id, &rec, change.entry(b.nextSeq(id), rec, now))
+	return rec, nil
+}
+
+func (b *Memory) DeleteTimeId(ctx context.Context, id string, fn func(Record) error, change Change) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current, ok := b.lookup(id)
+	if !ok {
+		return ErrNotFound
+	}
+	if fn != nil {
+		if err := fn(current); err != nil {
+			return err
+		}
+	}
+	b.record(id, nil, change.entry(b.nextSeq(id), current, time.Now()))
+	return nil
+}
+
+func (b *Memory) GetHistory(ctx context.Context, id string, q HistoryQuery) ([]HistoryEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	entries, ok := b.history[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return q.page(entries), nil
+}
+
+// ImportTimeId stores rec as is, keeping its version and timestamps.
+func (b *Memory) ImportTimeId(ctx context.Context, id string, rec Record, overwrite bool, change Change) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.lookup(id); ok && !overwrite {
+		return ErrExists
+	}
+	b.record(id, &rec, change.entry(b.nextSeq(id), rec, time.Now()))
+	return nil
+}
+
+func (b *Memory) SetTimeIds(ctx context.Context, items []BatchItem, change Change) ([]BatchItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	res := make([]BatchItem, len(items))
+	for i, item := range items {
+		rec := item.Record.created(now)
+		b.record(item.Id, &rec, change.entry(b.nextSeq(item.Id), rec, now))
+		res[i] = BatchItem{Id: item.Id, Record: rec}
+	}
+	return res, nil
+}
+
+func (b *Memory) GetTimeIds(ctx context.Context, ids []string) ([]BatchItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res := make([]BatchItem, len(ids))
+	for i, id := range ids {
+		rec, ok := b.lookup(id)
+		if !ok {
+			res[i] = BatchItem{Id: id, Err: ErrNotFound}
+			continue
+		}
+		res[i] = BatchItem{Id: id, Record: rec}
+	}
+	return res, nil
+}
+
+func (b *Memory) DeleteTimeIds(ctx context.Context, ids []string, change Change) ([]BatchItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	res := make([]BatchItem, len(ids))
+	for i, id := range ids {
+		current, ok := b.lookup(id)
+		if !ok {
+			res[i] = BatchItem{Id: id, Err: ErrNotFound}
+			continue
+		}
+		b.record(id, nil, change.entry(b.nextSeq(id), current, now))
+		res[i] = BatchItem{Id: id}
+	}
+	return res, nil
+}
+
+// ListTimeIds pages through live timeIds in id order. The cursor holds the
+// last id of the previous page.
+func (b *Memory) ListTimeIds(ctx context.Context, q ListQuery) ([]Listing, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var after string
+	if q.Cursor != "" {
+		var err error
+		if after, err = decodeCursor(q.Cursor); err != nil {
+			return nil, "", err
+		}
+	}
+
+	live := b.live()
+	ids := make([]string, 0, len(live))
+	for id, rec := range live {
+		if id > after && q.match(rec) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var next string
+	if q.Limit > 0 && len(ids) > q.Limit {
+		ids = ids[:q.Limit]
+		next = encodeCursor(ids[len(ids)-1])
+	}
+	res := make([]Listing, len(ids))
+	for i, id := range ids {
+		res[i] = Listing{Id: id, Record: live[id]}
+	}
+	return res, next, nil
+}
+
+// apply stores rec as is, without stamping it, or deletes the timeId if rec is
+// nil, and appends e to its history.
+func (b *Memory) apply(id string, rec *Record, e HistoryEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.record(id, rec, e)
+}
+
+// record is apply for callers that already hold the write lock.
+func (b *Memory) record(id string, rec *Record, e HistoryEntry) {
+	if rec == nil {
+		delete(b.times, id)
+	} else {
+		b.times[id] = *rec
+	}
+	entries := append(b.history[id], e)
+	if b.historyLimit > 0 && len(entries) > b.historyLimit {
+		// Copy the entries kept, so the dropped ones can be collected.
+		entries = append([]HistoryEntry(nil), entries[len(entries)-b.historyLimit:]...)
+	}
+	b.history[id] = entries
+}
+
+// nextSeq returns the sequence number of the next history entry of id, which
+// follows the last one kept. Callers must hold the lock.
+func (b *Memory) nextSeq(id string) int64 {
+	entries := b.history[id]
+	if len(entries) == 0 {
+		return 1
+	}
+	return entries[len(entries)-1].Seq + 1
+}
+
+// lookup returns the live record for id, dropping it if it has expired.
+// Callers must hold the write lock.
+func (b *Memory) lookup(id string) (Record, bool) {
+	rec, ok := b.times[id]
+	if !ok {
+		return Record{}, false
+	}
+	if rec.Expired(time.Now()) {
+		delete(b.times, id)
+		return Record{}, false
+	}
+	return rec, true
+}
+
+// histories returns a copy of the history of every timeId.
+func (b *Memory) histories() map[string][]HistoryEntry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	history := make(map[string][]HistoryEntry, len(b.history))
+	for id, entries := range b.history {
+		history[id] = append([]HistoryEntry(nil), entries...)
+	}
+	return history
+}
+
+// live returns a copy of every record that has not expired.
+func (b *Memory) live() map[string]Record {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := time.Now()
+	times := make(map[string]Record, len(b.times))
+	for id, rec := range b.times {
+		if !rec.Expired(now) {
+			times[id] = rec
+		}
+	}
+	return times
+}
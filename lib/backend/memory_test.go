@@ -0,0 +1,218 @@
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemory()
+	id := "fe2eaa26-babd-48f0-b4e0-e32c61ed7543"
+
+	t.Run("Get Not Found", func(t *testing.T) {
+		_, err := b.GetTimeId(ctx, id)
+		if errors.Cause(err) != ErrNotFound {
+			t.Errorf("TestMemory - Get Not Found: got <%v> want <%v>", err, ErrNotFound)
+		}
+	})
+
+	t.Run("Set and Get", func(t *testing.T) {
+		if err := b.SetTimeId(ctx, id, Record{Minutes: 795}, Change{Op: ChangeCreate}); err != nil {
+			t.Error(err)
+		}
+		rec, err := b.GetTimeId(ctx, id)
+		if err != nil {
+			t.Error(err)
+		}
+		if rec.Minutes != 795 {
+			t.Errorf("TestMemory - Set and Get: got <%d> want <%d>", rec.Minutes, 795)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		rec, err := b.UpdateTimeId(ctx, id, func(current Record) (Record, Change, error) {
+			if current.Minutes != 795 {
+				t.Errorf("TestMemory - Update - current: got <%d> want <%d>", current.Minutes, 795)
+			}
+			current.Minutes = 840
+			return current, Change{Op: ChangeSet}, nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		if rec.Minutes != 840 {
+			t.Errorf("TestMemory - Update: got <%d> want <%d>", rec.Minutes, 840)
+		}
+		if rec.Version != 2 {
+			t.Errorf("TestMemory - Update - version: got <%d> want <%d>", rec.Version, 2)
+		}
+		if rec.CreatedAt.IsZero() || rec.UpdatedAt.Before(rec.CreatedAt) {
+			t.Errorf("TestMemory - Update - timestamps: got <%v, %v>", rec.CreatedAt, rec.UpdatedAt)
+		}
+	})
+
+	t.Run("Delete - Check Fails", func(t *testing.T) {
+		errCheck := errors.New("check failed")
+		err := b.DeleteTimeId(ctx, id, func(current Record) error {
+			if current.Version != 2 {
+				t.Errorf("TestMemory - Delete - Check Fails - version: got <%d> want <%d>", current.Version, 2)
+			}
+			return errCheck
+		}, Change{Op: ChangeDelete})
+		if err != errCheck {
+			t.Errorf("TestMemory - Delete - Check Fails: got <%v> want <%v>", err, errCheck)
+		}
+		if _, err := b.GetTimeId(ctx, id); err != nil {
+			t.Errorf("TestMemory - Delete - Check Fails - Get: <%v>", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := b.DeleteTimeId(ctx, id, nil, Change{Op: ChangeDelete}); err != nil {
+			t.Error(err)
+		}
+		if _, err := b.GetTimeId(ctx, id); errors.Cause(err) != ErrNotFound {
+			t.Errorf("TestMemory - Delete - Get: got <%v> want <%v>", err, ErrNotFound)
+		}
+	})
+
+	t.Run("Update Not Found", func(t *testing.T) {
+		_, err := b.UpdateTimeId(ctx, id, func(current Record) (Record, Change, error) { return current, Change{}, nil })
+		if errors.Cause(err) != ErrNotFound {
+			t.Errorf("TestMemory - Update Not Found: got <%v> want <%v>", err, ErrNotFound)
+		}
+	})
+
+	t.Run("Delete Not Found", func(t *testing.T) {
+		err := b.DeleteTimeId(ctx, id, nil, Change{Op: ChangeDelete})
+		if errors.Cause(err) != ErrNotFound {
+			t.Errorf("TestMemory - Delete Not Found: got <%v> want <%v>", err, ErrNotFound)
+		}
+	})
+}
+
+func TestMemoryExpiry(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemory()
+	id := "fe2eaa26-babd-48f0-b4e0-e32c61ed7543"
+
+	if err := b.SetTimeId(ctx, id, Record{Minutes: 795, ExpiresAt: time.Now().Add(-time.Second)}, Change{Op: ChangeCreate}); err != nil {
+		t.Error(err)
+	}
+	if _, err := b.GetTimeId(ctx, id); errors.Cause(err) != ErrNotFound {
+		t.Errorf("TestMemoryExpiry - Get: got <%v> want <%v>", err, ErrNotFound)
+	}
+	if _, ok := b.times[id]; ok {
+		t.Error("TestMemoryExpiry - expired record was not removed")
+	}
+
+	if err := b.SetTimeId(ctx, id, Record{Minutes: 795, ExpiresAt: time.Now().Add(time.Hour)}, Change{Op: ChangeCreate}); err != nil {
+		t.Error(err)
+	}
+	if _, err := b.GetTimeId(ctx, id); err != nil {
+		t.Errorf("TestMemoryExpiry - Get before expiry: <%v>", err)
+	}
+}
+
+func TestMemoryHistory(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemory()
+	id := "fe2eaa26-babd-48f0-b4e0-e32c61ed7543"
+
+	if _, err := b.GetHistory(ctx, id, HistoryQuery{}); errors.Cause(err) != ErrNotFound {
+		t.Errorf("TestMemoryHistory - Not Found: got <%v> want <%v>", err, ErrNotFound)
+	}
+
+	change := Change{Op: ChangeCreate, RequestId: "req", Caller: "10.0.0.1"}
+	if err := b.SetTimeId(ctx, id, Record{Minutes: 795}, change); err != nil {
+		t.Error(err)
+	}
+	if _, err := b.UpdateTimeId(ctx, id, func(current Record) (Record, Change, error) {
+		current.Minutes += 5
+		return current, Change{Op: ChangeAdd, Delta: 5}, nil
+	}); err != nil {
+		t.Error(err)
+	}
+	// A failed update leaves no trace.
+	if _, err := b.UpdateTimeId(ctx, id, func(current Record) (Record, Change, error) {
+		return current, Change{}, errors.New("rejected")
+	}); err == nil {
+		t.Error("TestMemoryHistory - rejected update succeeded")
+	}
+	if err := b.DeleteTimeId(ctx, id, nil, Change{Op: ChangeDelete}); err != nil {
+		t.Error(err)
+	}
+
+	checkHistory(t, "TestMemoryHistory", b, id, ChangeCreate, ChangeAdd, ChangeDelete)
+
+	entries, err := b.GetHistory(ctx, id, HistoryQuery{Limit: 2})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("TestMemoryHistory - limit: got <%d> want <%d>", len(entries), 2)
+	}
+	if entries[0].RequestId != "req" || entries[0].Caller != "10.0.0.1" {
+		t.Errorf("TestMemoryHistory - create: got <%+v>", entries[0])
+	}
+	if entries[1].Minutes != 800 || entries[1].Delta != 5 || entries[1].Version != 2 {
+		t.Errorf("TestMemoryHistory - add: got <%+v>", entries[1])
+	}
+}
+
+func TestMemoryCanceledContext(t *testing.T) {
+	b := NewMemory()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := b.SetTimeId(ctx, "a", Record{Minutes: 795}, Change{Op: ChangeCreate}); err != context.Canceled {
+		t.Errorf("TestMemoryCanceledContext - Set: got <%v> want <%v>", err, context.Canceled)
+	}
+	if _, err := b.GetTimeId(context.Background(), "a"); errors.Cause(err) != ErrNotFound {
+		t.Errorf("TestMemoryCanceledContext - Get: got <%v> want <%v>", err, ErrNotFound)
+	}
+}
+
+type importer interface {
+	ImportTimeId(ctx context.Context, id string, rec Record, overwrite bool, change Change) error
+	GetTimeId(ctx context.Context, id string) (Record, error)
+}
+
+// checkImport verifies that imports keep records as given and only replace
+// live timeIds when asked to.
+func checkImport(t *testing.T, name string, b importer) {
+	ctx := context.Background()
+	id := "fe2eaa26-babd-48f0-b4e0-e32c61ed7543"
+	created := time.Date(2018, 6, 1, 9, 30, 0, 0, time.UTC)
+	rec := Record{Minutes: 570, CreatedAt: created, UpdatedAt: created.Add(time.Hour), Version: 7, Label: "moved", UndoStack: []int{540}}
+
+	if err := b.ImportTimeId(ctx, id, rec, false, Change{Op: ChangeImport}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := b.GetTimeId(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Minutes != 570 || got.Version != 7 || !got.CreatedAt.Equal(created) || got.Label != "moved" || len(got.UndoStack) != 1 {
+		t.Errorf("%s - Import: got <%+v> want <%+v>", name, got, rec)
+	}
+
+	rec.Minutes = 600
+	if err := b.ImportTimeId(ctx, id, rec, false, Change{Op: ChangeImport}); errors.Cause(err) != ErrExists {
+		t.Errorf("%s - Import Existing: got <%v> want <%v>", name, err, ErrExists)
+	}
+	if err := b.ImportTimeId(ctx, id, rec, true, Change{Op: ChangeImport}); err != nil {
+		t.Errorf("%s - Import Overwrite: <%v>", name, err)
+	}
+	if got, _ := b.GetTimeId(ctx, id); got.Minutes != 600 {
+		t.Errorf("%s - Import Overwrite: got <%d> want <%d>", name, got.Minutes, 600)
+	}
+}
+
+func TestMemoryImport(t *testing.T) {
+	checkImport(t, "TestMemoryImport", NewMemory())
+}
@@ -0,0 +1,254 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Record is the stored state of a timeId. Backends maintain CreatedAt,
+// UpdatedAt and Version themselves; values supplied by callers are ignored,
+// except by imports, which restore records exactly.
+type Record struct {
+	// Minutes is the current time as minutes since midnight, and Seconds the
+	// seconds past that minute. Seconds is always zero unless Precision is
+	// PrecisionSeconds.
+	Minutes   int    `json:"minutes"`
+	Seconds   int    `json:"seconds,omitempty"`
+	Precision string `json:"precision,omitempty"`
+	// DayOffset counts the midnights crossed since the timeId was created,
+	// negative when the time went back before the day it started on.
+	DayOffset int `json:"dayOffset,omitempty"`
+	// CreatedAt and UpdatedAt are zero for records migrated from the legacy
+	// string format until they are next written.
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Version is 1 on creation and increases with every change.
+	Version int64 `json:"version"`
+	// Label is an optional tag for finding timeIds again.
+	Label string `json:"label,omitempty"`
+	// Format is the output format of the time chosen for the timeId, if any.
+	// Backends store it without interpreting it.
+	Format string `json:"format,omitempty"`
+	// Zone is the IANA time zone of the timeId, if any, and Date the
+	// calendar date, as YYYY-MM-DD, of the day it was created on in that
+	// zone. Backends store them without interpreting them.
+	Zone string `json:"zone,omitempty"`
+	Date string `json:"date,omitempty"`
+	// ExpiresAt is when the timeId is removed. The zero value never expires.
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+	// UndoStack and RedoStack hold the times to return to on undo and redo,
+	// most recent last, in minutes since midnight of the day the timeId was
+	// created, or in seconds with PrecisionSeconds.
+	UndoStack []int `json:"undo,omitempty"`
+	RedoStack []int `json:"redo,omitempty"`
+}
+
+// PrecisionSeconds marks records kept to the second rather than the minute.
+const PrecisionSeconds = "seconds"
+
+// maxUndo bounds the number of changes that can be undone, and with it the
+// size of a record.
+const maxUndo = 50
+
+// UnmarshalJSON also accepts records written before they were structured,
+// which only carried the formatted time.
+func (r *Record) UnmarshalJSON(data []byte) error {
+	type record Record
+	var v struct {
+		record
+		Time string `json:"time"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*r = Record(v.record)
+
+	if v.Time != "" {
+		minutes, err := parseLegacyTime(v.Time)
+		if err != nil {
+			return err
+		}
+		r.Minutes = minutes
+	}
+	return nil
+}
+
+// Expired reports whether the record has expired at the given instant.
+func (r Record) Expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt)
+}
+
+// ttl converts the absolute expiry into the relative duration Redis expects.
+// Zero means no expiry; a record that already expired gets the smallest TTL
+// Redis accepts so it disappears straight away.
+func (r Record) ttl() time.Duration {
+	if r.ExpiresAt.IsZero() {
+		return 0
+	}
+	d := time.Until(r.ExpiresAt)
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	return d
+}
+
+// created stamps the bookkeeping fields of a new record.
+func (r Record) created(now time.Time) Record {
+	r.CreatedAt = now.UTC()
+	r.UpdatedAt = now.UTC()
+	r.Version = 1
+	return r
+}
+
+// updated carries the bookkeeping fields of prev over to r and advances them.
+func (r Record) updated(prev Record, now time.Time) Record {
+	r.CreatedAt = prev.CreatedAt
+	r.UpdatedAt = now.UTC()
+	r.Version = prev.Version + 1
+	return r
+}
+
+// SecondOfDay returns the time as seconds since midnight.
+func (r Record) SecondOfDay() int {
+	return r.Minutes*60 + r.Seconds
+}
+
+// TotalSeconds returns the time as seconds since midnight of the day the
+// timeId was created.
+func (r Record) TotalSeconds() int {
+	return r.DayOffset*86400 + r.SecondOfDay()
+}
+
+// SetMinutes moves the time to minutes, making the move undoable. Moves that
+// leave the time unchanged are not recorded.
+func (r Record) SetMinutes(minutes int) Record {
+	return r.SetSecondOfDay(minutes * 60)
+}
+
+// SetSecondOfDay moves the time to the given second since midnight of the
+// current day, making the move undoable. Records without PrecisionSeconds
+// drop the seconds.
+func (r Record) SetSecondOfDay(second int) Record {
+	return r.MoveTo(r.DayOffset, second)
+}
+
+// MoveTo moves the time to the given second since midnight of the day
+// dayOffset days after the one the timeId was created on, making the move
+// undoable. Moves that leave the time unchanged are not recorded.
+func (r Record) MoveTo(dayOffset int, second int) Record {
+	next := r
+	next.DayOffset = dayOffset
+	next.setTimeOfDay(second)
+	if next.TotalSeconds() == r.TotalSeconds() {
+		return r
+	}
+	next.UndoStack = push(r.UndoStack, r.step())
+	next.RedoStack = nil
+	return next
+}
+
+// perDay returns the number of units of the undo and redo stacks in a day.
+func (r Record) perDay() int {
+	if r.Precision == PrecisionSeconds {
+		return 86400
+	}
+	return 1440
+}
+
+// step returns the time in the unit of the undo and redo stacks.
+func (r Record) step() int {
+	if r.Precision == PrecisionSeconds {
+		return r.TotalSeconds()
+	}
+	return r.DayOffset*1440 + r.Minutes
+}
+
+// setStep sets the time from a value in the unit of the stacks.
+func (r *Record) setStep(v int) {
+	perDay := r.perDay()
+	r.DayOffset = v / perDay
+	v %= perDay
+	if v < 0 {
+		r.DayOffset--
+		v += perDay
+	}
+	if r.Precision == PrecisionSeconds {
+		r.Minutes, r.Seconds = v/60, v%60
+		return
+	}
+	r.Minutes, r.Seconds = v, 0
+}
+
+// setTimeOfDay sets the time from seconds since midnight, keeping the day.
+func (r *Record) setTimeOfDay(second int) {
+	if r.Precision == PrecisionSeconds {
+		r.Minutes, r.Seconds = second/60, second%60
+		return
+	}
+	r.Minutes, r.Seconds = second/60, 0
+}
+
+// Undo returns the time to what it was before the most recent move. ok is
+// false if there is nothing to undo.
+func (r Record) Undo() (rec Record, ok bool) {
+	if len(r.UndoStack) == 0 {
+		return r, false
+	}
+	last := len(r.UndoStack) - 1
+	r.RedoStack = push(r.RedoStack, r.step())
+	r.setStep(r.UndoStack[last])
+	r.UndoStack = r.UndoStack[:last:last]
+	return r, true
+}
+
+// Redo re-applies the most recently undone move. ok is false if there is
+// nothing to redo.
+func (r Record) Redo() (rec Record, ok bool) {
+	if len(r.RedoStack) == 0 {
+		return r, false
+	}
+	last := len(r.RedoStack) - 1
+	r.UndoStack = push(r.UndoStack, r.step())
+	r.setStep(r.RedoStack[last])
+	r.RedoStack = r.RedoStack[:last:last]
+	return r, true
+}
+
+// push returns a copy of stack with v on top, dropping the oldest entries
+// beyond maxUndo. Records are passed by value, so stacks are never appended to
+// in place.
+func push(stack []int, v int) []int {
+	if len(stack) >= maxUndo {
+		stack = stack[len(stack)-maxUndo+1:]
+	}
+	res := make([]int, len(stack), len(stack)+1)
+	copy(res, stack)
+	return append(res, v)
+}
+
+// parseLegacyTime reads the "HH:MM AM" strings timeIds were stored as before
+// records were structured.
+func parseLegacyTime(s string) (int, error) {
+	t, err := time.Parse("03:04 PM", strings.ToUpper(s))
+	if err != nil {
+		return 0, withKind(ErrCorrupt, errors.Wrapf(err, "invalid legacy time %q", s))
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// formatLegacyTime renders minutes in the legacy "HH:MM AM" form.
+func formatLegacyTime(minutes int) string {
+	meridiem := "AM"
+	if minutes >= 720 {
+		meridiem = "PM"
+	}
+	h := minutes / 60 % 12
+	if h == 0 {
+		h = 12
+	}
+	return fmt.Sprintf("%02d:%02d %s", h, minutes%60, meridiem)
+}
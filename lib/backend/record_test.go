@@ -0,0 +1,147 @@
+package backend
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRecordUndoRedo(t *testing.T) {
+	rec := Record{Minutes: 720}
+	rec = rec.SetMinutes(730)
+	rec = rec.SetMinutes(730)
+	rec = rec.SetMinutes(60)
+
+	if fmt.Sprint(rec.UndoStack) != "[720 730]" {
+		t.Errorf("TestRecordUndoRedo - SetMinutes - undo stack: got <%v> want <%v>", rec.UndoStack, "[720 730]")
+	}
+
+	values := []struct {
+		name     string
+		move     func(Record) (Record, bool)
+		ok       bool
+		expected int
+	}{
+		{"Undo", Record.Undo, true, 730},
+		{"Undo", Record.Undo, true, 720},
+		{"Undo Empty", Record.Undo, false, 720},
+		{"Redo", Record.Redo, true, 730},
+		{"Redo", Record.Redo, true, 60},
+		{"Redo Empty", Record.Redo, false, 60},
+		{"Undo", Record.Undo, true, 730},
+	}
+
+	for _, tt := range values {
+		var ok bool
+		rec, ok = tt.move(rec)
+		if ok != tt.ok || rec.Minutes != tt.expected {
+			t.Errorf("TestRecordUndoRedo - %s: got <%d, %t> want <%d, %t>", tt.name, rec.Minutes, ok, tt.expected, tt.ok)
+		}
+	}
+
+	// A new move discards whatever could be redone.
+	rec = rec.SetMinutes(0)
+	if _, ok := rec.Redo(); ok {
+		t.Error("TestRecordUndoRedo - redo after SetMinutes succeeded")
+	}
+}
+
+func TestRecordUndoLimit(t *testing.T) {
+	var rec Record
+	for i := 1; i <= maxUndo+10; i++ {
+		rec = rec.SetMinutes(i)
+	}
+	if len(rec.UndoStack) != maxUndo {
+		t.Errorf("TestRecordUndoLimit - undo stack: got <%d> want <%d>", len(rec.UndoStack), maxUndo)
+	}
+	if rec.UndoStack[0] != 10 {
+		t.Errorf("TestRecordUndoLimit - oldest entry: got <%d> want <%d>", rec.UndoStack[0], 10)
+	}
+}
+
+func TestRecordStacksNotShared(t *testing.T) {
+	base := Record{Minutes: 1}.SetMinutes(2).SetMinutes(3)
+	undone, _ := base.Undo()
+	a := undone.SetMinutes(10)
+	b := undone.SetMinutes(20)
+	if a.UndoStack[len(a.UndoStack)-1] != 2 || b.UndoStack[len(b.UndoStack)-1] != 2 {
+		t.Errorf("TestRecordStacksNotShared - undo stacks: got <%v, %v>", a.UndoStack, b.UndoStack)
+	}
+	if fmt.Sprint(base.UndoStack) != "[1 2]" {
+		t.Errorf("TestRecordStacksNotShared - base undo stack: got <%v> want <%v>", base.UndoStack, "[1 2]")
+	}
+}
+
+func TestRecordSeconds(t *testing.T) {
+	values := []struct {
+		name      string
+		precision string
+		set       int
+		minutes   int
+		seconds   int
+		undo      string
+	}{
+		{"Minutes", "", 45296, 754, 0, "[720]"},
+		{"Seconds", PrecisionSeconds, 45296, 754, 56, "[43200]"},
+		{"Same Minute", "", 43230, 720, 0, "[]"},
+	}
+
+	for _, tt := range values {
+		rec := Record{Minutes: 720, Precision: tt.precision}.SetSecondOfDay(tt.set)
+		if rec.Minutes != tt.minutes || rec.Seconds != tt.seconds {
+			t.Errorf("TestRecordSeconds - %s - Set: got <%d, %d> want <%d, %d>", tt.name, rec.Minutes, rec.Seconds, tt.minutes, tt.seconds)
+		}
+		if fmt.Sprint(rec.UndoStack) != tt.undo {
+			t.Errorf("TestRecordSeconds - %s - Undo Stack: got <%v> want <%v>", tt.name, rec.UndoStack, tt.undo)
+		}
+	}
+
+	rec := Record{Minutes: 754, Seconds: 56, Precision: PrecisionSeconds}.SetSecondOfDay(10)
+	rec, _ = rec.Undo()
+	if rec.SecondOfDay() != 45296 {
+		t.Errorf("TestRecordSeconds - Undo: got <%d> want <%d>", rec.SecondOfDay(), 45296)
+	}
+	rec, _ = rec.Redo()
+	if rec.Minutes != 0 || rec.Seconds != 10 {
+		t.Errorf("TestRecordSeconds - Redo: got <%d, %d> want <%d, %d>", rec.Minutes, rec.Seconds, 0, 10)
+	}
+}
+
+func TestRecordDayOffset(t *testing.T) {
+	values := []struct {
+		name      string
+		precision string
+		day       int
+		second    int
+		undo      string
+	}{
+		{"Minutes Forward", "", 2, 3600, "[720]"},
+		{"Minutes Back", "", -1, 86340, "[720]"},
+		{"Seconds Forward", PrecisionSeconds, 1, 30, "[43200]"},
+		{"Seconds Back", PrecisionSeconds, -3, 43200, "[43200]"},
+	}
+
+	for _, tt := range values {
+		rec := Record{Minutes: 720, Precision: tt.precision}.MoveTo(tt.day, tt.second)
+		if rec.DayOffset != tt.day || rec.SecondOfDay() != tt.second {
+			t.Errorf("TestRecordDayOffset - %s - Move: got <%d, %d> want <%d, %d>", tt.name, rec.DayOffset, rec.SecondOfDay(), tt.day, tt.second)
+		}
+		if fmt.Sprint(rec.UndoStack) != tt.undo {
+			t.Errorf("TestRecordDayOffset - %s - Undo Stack: got <%v> want <%v>", tt.name, rec.UndoStack, tt.undo)
+		}
+
+		// Setting the time keeps the day, and undo and redo restore it.
+		rec = rec.SetSecondOfDay(0)
+		if rec.DayOffset != tt.day {
+			t.Errorf("TestRecordDayOffset - %s - Set: got <%d> want <%d>", tt.name, rec.DayOffset, tt.day)
+		}
+		rec, _ = rec.Undo()
+		rec, _ = rec.Undo()
+		if rec.DayOffset != 0 || rec.Minutes != 720 {
+			t.Errorf("TestRecordDayOffset - %s - Undo: got <%d, %d> want <%d, %d>", tt.name, rec.DayOffset, rec.Minutes, 0, 720)
+		}
+		rec, _ = rec.Redo()
+		if rec.DayOffset != tt.day || rec.SecondOfDay() != tt.second {
+			t.Errorf("TestRecordDayOffset - %s - Redo: got <%d, %d> want <%d, %d>", tt.name, rec.DayOffset, rec.SecondOfDay(), tt.day, tt.second)
+		}
+	}
+}
@@ -0,0 +1,669 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// migrations are applied in order and recorded in schema_migrations. Released
+// entries must never be edited; schema changes are made by appending.
+var migrations = []string{
+	`CREATE TABLE timeids (
+		id         VARCHAR(36) PRIMARY KEY,
+		time_value VARCHAR(8)  NOT NULL,
+		created_at TIMESTAMP   NOT NULL,
+		updated_at TIMESTAMP   NOT NULL
+	)`,
+	`ALTER TABLE timeids ADD COLUMN expires_at TIMESTAMP`,
+	`CREATE INDEX timeids_expires_at ON timeids (expires_at)`,
+	`ALTER TABLE timeids ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE timeids ADD COLUMN minutes INTEGER NOT NULL DEFAULT 0`,
+	`UPDATE timeids SET minutes =
+		(CAST(substr(time_value, 1, 2) AS INTEGER) % 12) * 60 + CAST(substr(time_value, 4, 2) AS INTEGER) +
+		CASE WHEN upper(substr(time_value, 7, 2)) = 'PM' THEN 720 ELSE 0 END`,
+	`CREATE TABLE timeid_history (
+		timeid     VARCHAR(36)  NOT NULL,
+		seq        INTEGER      NOT NULL,
+		op         VARCHAR(16)  NOT NULL,
+		delta      INTEGER      NOT NULL,
+		minutes    INTEGER      NOT NULL,
+		version    INTEGER      NOT NULL,
+		changed_at TIMESTAMP    NOT NULL,
+		request_id VARCHAR(64)  NOT NULL,
+		caller     VARCHAR(255) NOT NULL,
+		PRIMARY KEY (timeid, seq)
+	)`,
+	`ALTER TABLE timeids ADD COLUMN undo_stack TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE timeids ADD COLUMN redo_stack TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE timeids ADD COLUMN label VARCHAR(128) NOT NULL DEFAULT ''`,
+	`CREATE INDEX timeids_label ON timeids (label)`,
+	`ALTER TABLE timeids ADD COLUMN format VARCHAR(8) NOT NULL DEFAULT ''`,
+	`ALTER TABLE timeids ADD COLUMN seconds INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE timeids ADD COLUMN time_precision VARCHAR(8) NOT NULL DEFAULT ''`,
+	`ALTER TABLE timeid_history ADD COLUMN seconds INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE timeid_history ADD COLUMN delta_seconds INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE timeids ADD COLUMN day_offset INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE timeid_history ADD COLUMN day_offset INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE timeids ADD COLUMN zone VARCHAR(64) NOT NULL DEFAULT ''`,
+	`ALTER TABLE timeids ADD COLUMN zone_date VARCHAR(10) NOT NULL DEFAULT ''`,
+}
+
+// SQL is a backend for relational databases reachable through database/sql.
+// Queries are written for SQLite. The minutes column is authoritative;
+// time_value keeps the formatted time for people reading the table directly.
+type SQL struct {
+	db *sql.DB
+	// historyLimit caps the entries kept per timeId; zero keeps them all.
+	historyLimit int
+}
+
+func NewSQL(driver, dsn string) (*SQL, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open %s database", driver)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "unable to connect to %s database", driver)
+	}
+	if driver == "sqlite3" {
+		// SQLite locks the whole database for writes; funnelling everything
+		// through one connection queues writers instead of failing them.
+		db.SetMaxOpenConns(1)
+	}
+
+	b := &SQL{
+		db: db,
+	}
+	if err := b.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// SetHistoryLimit keeps only the newest n history entries of each timeId,
+// deleting older ones as new entries are inserted. Zero keeps them all. It
+// must be called before the backend is used.
+func (b *SQL) SetHistoryLimit(n int) {
+	b.historyLimit = n
+}
+
+// sqlBatchSize bounds the ids bound into one IN list, staying clear of the
+// 999 parameter limit of older SQLite builds.
+const sqlBatchSize = 500
+
+// SetTimeId stores the record and opportunistically purges expired rows, which
+// are otherwise only hidden from reads.
+func (b *SQL) SetTimeId(ctx context.Context, id string, rec Record, change Change) error {
+	_, err := b.SetTimeIds(ctx, []BatchItem{{Id: id, Record: rec}}, change)
+	return err
+}
+
+// SetTimeIds stores the whole batch in one transaction, so it either succeeds
+// or fails as a whole.
+func (b *SQL) SetTimeIds(ctx context.Context, items []BatchItem, change Change) ([]BatchItem, error) {
+	now := time.Now().UTC()
+	res := make([]BatchItem, len(items))
+
+	err := b.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `DELETE FROM timeids WHERE expires_at <= ?`, now)
+		if err != nil {
+			return err
+		}
+
+		for i, item := range items {
+			rec := item.Record.created(now)
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO timeids (id, minutes, time_value, created_at, updated_at, expires_at, version, undo_stack, redo_stack, label, format, seconds, time_precision, day_offset, zone, zone_date)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (id) DO UPDATE SET minutes = excluded.minutes, time_value = excluded.time_value,
+					created_at = excluded.created_at, updated_at = excluded.updated_at,
+					expires_at = excluded.expires_at, version = timeids.version + 1,
+					undo_stack = excluded.undo_stack, redo_stack = excluded.redo_stack, label = excluded.label, format = excluded.format,
+					seconds = excluded.seconds, time_precision = excluded.time_precision, day_offset = excluded.day_offset,
+					zone = excluded.zone, zone_date = excluded.zone_date`,
+				item.Id, rec.Minutes, formatLegacyTime(rec.Minutes), rec.CreatedAt, rec.UpdatedAt, nullTime(rec.ExpiresAt), rec.Version,
+				encodeStack(rec.UndoStack), encodeStack(rec.RedoStack), rec.Label, rec.Format, rec.Seconds, rec.Precision, rec.DayOffset, rec.Zone, rec.Date)
+			if err != nil {
+				return err
+			}
+			// Overwriting an existing row bumped its version instead.
+			if err := tx.QueryRowContext(ctx, `SELECT version FROM timeids WHERE id = ?`, item.Id).Scan(&rec.Version); err != nil {
+				return err
+			}
+			if err := b.insertHistory(ctx, tx, item.Id, change.entry(0, rec, now)); err != nil {
+				return err
+			}
+			res[i] = BatchItem{Id: item.Id, Record: rec}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (b *SQL) GetTimeId(ctx context.Context, id string) (Record, error) {
+	return b.get(ctx, id)
+}
+
+// UpdateTimeId performs a compare-and-swap on the row version, retrying when a
+// concurrent writer changed the row between the read and the update. Errors
+// returned by fn are passed through unchanged.
+func (b *SQL) UpdateTimeId(ctx context.Context, id string, fn func(Record) (Record, Change, error)) (Record, error) {
+	for i := 0; i < maxTxRetries; i++ {
+		current, err := b.get(ctx, id)
+		if err != nil {
+			return Record{}, err
+		}
+		rec, change, err := fn(current)
+		if err != nil {
+			return Record{}, err
+		}
+		now := time.Now()
+		rec = rec.updated(current, now)
+
+		swapped := false
+		err = b.inTx(ctx, func(tx *sql.Tx) error {
+			res, err := tx.ExecContext(ctx, `
+				UPDATE timeids SET minutes = ?, time_value = ?, updated_at = ?, expires_at = ?, version = ?,
+					undo_stack = ?, redo_stack = ?, label = ?, format = ?, seconds = ?, time_precision = ?, day_offset = ?,
+					zone = ?, zone_date = ?
+				WHERE id = ? AND version = ?`,
+				rec.Minutes, formatLegacyTime(rec.Minutes), rec.UpdatedAt, nullTime(rec.ExpiresAt), rec.Version,
+				encodeStack(rec.UndoStack), encodeStack(rec.RedoStack), rec.Label, rec.Format, rec.Seconds, rec.Precision, rec.DayOffset, rec.Zone, rec.Date, id, current.Version)
+			if err != nil {
+				return err
+			}
+			if swapped, err = affected(res); err != nil || !swapped {
+				return err
+			}
+			return b.insertHistory(ctx, tx, id, change.entry(0, rec, now))
+		})
+		if err != nil {
+			return Record{}, err
+		}
+		if swapped {
+			return rec, nil
+		}
+	}
+	return Record{}, withKind(ErrConflict, errors.Errorf("update of %s aborted after %d conflicting transactions", id, maxTxRetries))
+}
+
+// DeleteTimeId performs a compare-and-swap on the row version, so that fn, when
+// given, and the history entry both see the record being deleted.
+func (b *SQL) DeleteTimeId(ctx context.Context, id string, fn func(Record) error, change Change) error {
+	for i := 0; i < maxTxRetries; i++ {
+		current, err := b.get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if fn != nil {
+			if err := fn(current); err != nil {
+				return err
+			}
+		}
+
+		deleted := false
+		err = b.inTx(ctx, func(tx *sql.Tx) error {
+			res, err := tx.ExecContext(ctx, `DELETE FROM timeids WHERE id = ? AND version = ?`, id, current.Version)
+			if err != nil {
+				return err
+			}
+			if deleted, err = affected(res); err != nil || !deleted {
+				return err
+			}
+			return b.insertHistory(ctx, tx, id, change.entry(0, current, time.Now()))
+		})
+		if err != nil {
+			return err
+		}
+		if deleted {
+			return nil
+		}
+	}
+	return withKind(ErrConflict, errors.Errorf("delete of %s aborted after %d conflicting transactions", id, maxTxRetries))
+}
+
+// ImportTimeId stores rec as is, keeping its version and timestamps. An
+// expired row for id is purged first so it does not count as taken.
+func (b *SQL) ImportTimeId(ctx context.Context, id string, rec Record, overwrite bool, change Change) error {
+	onConflict := `DO NOTHING`
+	if overwrite {
+		onConflict = `DO UPDATE SET minutes = excluded.minutes, time_value = excluded.time_value,
+			created_at = excluded.created_at, updated_at = excluded.updated_at,
+			expires_at = excluded.expires_at, version = excluded.version,
+			undo_stack = excluded.undo_stack, redo_stack = excluded.redo_stack, label = excluded.label, format = excluded.format,
+			seconds = excluded.seconds, time_precision = excluded.time_precision, day_offset = excluded.day_offset,
+			zone = excluded.zone, zone_date = excluded.zone_date`
+	}
+
+	return b.inTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		_, err := tx.ExecContext(ctx, `DELETE FROM timeids WHERE id = ? AND expires_at <= ?`, id, now)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO timeids (id, minutes, time_value, created_at, updated_at, expires_at, version, undo_stack, redo_stack, label, format, seconds, time_precision, day_offset, zone, zone_date)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) `+onConflict,
+			id, rec.Minutes, formatLegacyTime(rec.Minutes), rec.CreatedAt.UTC(), rec.UpdatedAt.UTC(), nullTime(rec.ExpiresAt), rec.Version,
+			encodeStack(rec.UndoStack), encodeStack(rec.RedoStack), rec.Label, rec.Format, rec.Seconds, rec.Precision, rec.DayOffset, rec.Zone, rec.Date)
+		if err != nil {
+			return err
+		}
+		stored, err := affected(res)
+		if err != nil {
+			return err
+		}
+		if !stored {
+			return ErrExists
+		}
+		return b.insertHistory(ctx, tx, id, change.entry(0, rec, now))
+	})
+}
+
+func (b *SQL) GetTimeIds(ctx context.Context, ids []string) ([]BatchItem, error) {
+	recs, err := b.getMany(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]BatchItem, len(ids))
+	for i, id := range ids {
+		rec, ok := recs[id]
+		if !ok {
+			res[i] = BatchItem{Id: id, Err: ErrNotFound}
+			continue
+		}
+		res[i] = BatchItem{Id: id, Record: rec}
+	}
+	return res, nil
+}
+
+// DeleteTimeIds deletes every timeId found in one transaction, with a
+// compare-and-swap on each row version. TimeIds changed between the read and
+// the delete are retried one at a time through DeleteTimeId.
+func (b *SQL) DeleteTimeIds(ctx context.Context, ids []string, change Change) ([]BatchItem, error) {
+	recs, err := b.getMany(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]BatchItem, len(ids))
+	var conflicts []int
+	err = b.inTx(ctx, func(tx *sql.Tx) error {
+		conflicts = conflicts[:0]
+		now := time.Now()
+		for i, id := range ids {
+			current, ok := recs[id]
+			if !ok {
+				res[i] = BatchItem{Id: id, Err: ErrNotFound}
+				continue
+			}
+			r, err := tx.ExecContext(ctx, `DELETE FROM timeids WHERE id = ? AND version = ?`, id, current.Version)
+			if err != nil {
+				return err
+			}
+			deleted, err := affected(r)
+			if err != nil {
+				return err
+			}
+			if !deleted {
+				conflicts = append(conflicts, i)
+				continue
+			}
+			if err := b.insertHistory(ctx, tx, id, change.entry(0, current, now)); err != nil {
+				return err
+			}
+			res[i] = BatchItem{Id: id}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range conflicts {
+		res[i] = BatchItem{Id: ids[i], Err: b.DeleteTimeId(ctx, ids[i], nil, change)}
+	}
+	return res, nil
+}
+
+func (b *SQL) GetHistory(ctx context.Context, id string, q HistoryQuery) ([]HistoryEntry, error) {
+	query := `SELECT seq, op, delta, delta_seconds, minutes, seconds, day_offset, version, changed_at, request_id, caller FROM timeid_history
+		WHERE timeid = ? AND seq > ?`
+	args := []interface{}{id, q.After}
+	if !q.From.IsZero() {
+		query += ` AND changed_at >= ?`
+		args = append(args, q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		query += ` AND changed_at < ?`
+		args = append(args, q.To.UTC())
+	}
+	query += ` ORDER BY seq`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := b.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, classifySQL(err)
+	}
+	defer rows.Close()
+
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		var e HistoryEntry
+		if err := rows.Scan(&e.Seq, &e.Op, &e.Delta, &e.DeltaSeconds, &e.Minutes, &e.Seconds, &e.DayOffset, &e.Version, &e.Time, &e.RequestId, &e.Caller); err != nil {
+			return nil, classifySQL(err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, classifySQL(err)
+	}
+
+	if len(entries) == 0 {
+		var n int
+		err := b.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM timeid_history WHERE timeid = ?`, id).Scan(&n)
+		if err != nil {
+			return nil, classifySQL(err)
+		}
+		if n == 0 {
+			return nil, ErrNotFound
+		}
+	}
+	return entries, nil
+}
+
+// insertHistory appends e to the history of id, numbering it after the
+// existing entries, and deletes the entries that fall beyond the history
+// limit. Row locks taken by the write it records serialise concurrent appends
+// for the same timeId.
+func (b *SQL) insertHistory(ctx context.Context, tx *sql.Tx, id string, e HistoryEntry) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO timeid_history (timeid, seq, op, delta, delta_seconds, minutes, seconds, day_offset, version, changed_at, request_id, caller)
+		SELECT ?, COALESCE(MAX(seq), 0) + 1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? FROM timeid_history WHERE timeid = ?`,
+		id, e.Op, e.Delta, e.DeltaSeconds, e.Minutes, e.Seconds, e.DayOffset, e.Version, e.Time, e.RequestId, e.Caller, id)
+	if err != nil || b.historyLimit <= 0 {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM timeid_history WHERE timeid = ? AND seq <= (SELECT MAX(seq) FROM timeid_history WHERE timeid = ?) - ?`,
+		id, id, b.historyLimit)
+	return err
+}
+
+// inTx runs fn in a transaction, committing it if fn succeeds. Errors are
+// classified on the way out.
+func (b *SQL) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return classifySQL(err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return classifySQL(err)
+	}
+	return classifySQL(tx.Commit())
+}
+
+// affected reports whether a statement changed exactly one row.
+func affected(res sql.Result) (bool, error) {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ListTimeIds pages through live timeIds in id order, filtering in the
+// database. The cursor holds the last id of the previous page.
+func (b *SQL) ListTimeIds(ctx context.Context, q ListQuery) ([]Listing, string, error) {
+	var after string
+	if q.Cursor != "" {
+		var err error
+		if after, err = decodeCursor(q.Cursor); err != nil {
+			return nil, "", err
+		}
+	}
+
+	query := `SELECT id, ` + recordColumns + ` FROM timeids
+		WHERE id > ? AND (expires_at IS NULL OR expires_at > ?)`
+	args := []interface{}{after, time.Now().UTC()}
+	if q.MinutesFrom != nil && q.MinutesTo != nil {
+		if *q.MinutesFrom <= *q.MinutesTo {
+			query += ` AND minutes >= ? AND minutes <= ?`
+		} else {
+			query += ` AND (minutes >= ? OR minutes <= ?)`
+		}
+		args = append(args, *q.MinutesFrom, *q.MinutesTo)
+	}
+	if !q.CreatedFrom.IsZero() {
+		query += ` AND created_at >= ?`
+		args = append(args, q.CreatedFrom.UTC())
+	}
+	if !q.CreatedTo.IsZero() {
+		query += ` AND created_at < ?`
+		args = append(args, q.CreatedTo.UTC())
+	}
+	if q.Label != "" {
+		query += ` AND label = ?`
+		args = append(args, q.Label)
+	}
+	query += ` ORDER BY id`
+	if q.Limit > 0 {
+		// One extra row tells whether another page follows.
+		query += ` LIMIT ?`
+		args = append(args, q.Limit+1)
+	}
+
+	rows, err := b.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", classifySQL(err)
+	}
+	defer rows.Close()
+
+	res := []Listing{}
+	for rows.Next() {
+		var l Listing
+		if l.Record, err = scanRecord(rows, &l.Id); err != nil {
+			return nil, "", err
+		}
+		res = append(res, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", classifySQL(err)
+	}
+
+	var next string
+	if q.Limit > 0 && len(res) > q.Limit {
+		res = res[:q.Limit]
+		next = encodeCursor(res[len(res)-1].Id)
+	}
+	return res, next, nil
+}
+
+// recordColumns are the columns scanRecord reads, in order.
+const recordColumns = `minutes, created_at, updated_at, version, expires_at, undo_stack, redo_stack, label, format, seconds, time_precision, day_offset, zone, zone_date`
+
+// scanRecord reads recordColumns from row into a record, preceded by the
+// destinations in dest.
+func scanRecord(row interface {
+	Scan(dest ...interface{}) error
+}, dest ...interface{}) (Record, error) {
+	var rec Record
+	var expiresAt *time.Time
+	var undo, redo string
+	dest = append(dest, &rec.Minutes, &rec.CreatedAt, &rec.UpdatedAt, &rec.Version, &expiresAt, &undo, &redo, &rec.Label, &rec.Format, &rec.Seconds, &rec.Precision, &rec.DayOffset, &rec.Zone, &rec.Date)
+	if err := row.Scan(dest...); err != nil {
+		return Record{}, classifySQL(err)
+	}
+	if expiresAt != nil {
+		rec.ExpiresAt = *expiresAt
+	}
+
+	var err error
+	if rec.UndoStack, err = decodeStack(undo); err != nil {
+		return Record{}, err
+	}
+	if rec.RedoStack, err = decodeStack(redo); err != nil {
+		return Record{}, err
+	}
+	return rec, nil
+}
+
+// get returns the live record for id.
+func (b *SQL) get(ctx context.Context, id string) (Record, error) {
+	row := b.db.QueryRowContext(ctx, `SELECT `+recordColumns+` FROM timeids
+		WHERE id = ? AND (expires_at IS NULL OR expires_at > ?)`,
+		id, time.Now().UTC())
+	return scanRecord(row)
+}
+
+// getMany returns the live records among ids, keyed by id.
+func (b *SQL) getMany(ctx context.Context, ids []string) (map[string]Record, error) {
+	recs := make(map[string]Record, len(ids))
+	for start := 0; start < len(ids); start += sqlBatchSize {
+		chunk := ids[start:]
+		if len(chunk) > sqlBatchSize {
+			chunk = chunk[:sqlBatchSize]
+		}
+
+		args := make([]interface{}, 0, len(chunk)+1)
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+		args = append(args, time.Now().UTC())
+		rows, err := b.db.QueryContext(ctx, `SELECT id, `+recordColumns+` FROM timeids
+			WHERE id IN (?`+strings.Repeat(", ?", len(chunk)-1)+`) AND (expires_at IS NULL OR expires_at > ?)`,
+			args...)
+		if err != nil {
+			return nil, classifySQL(err)
+		}
+		for rows.Next() {
+			var id string
+			rec, err := scanRecord(rows, &id)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			recs[id] = rec
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, classifySQL(err)
+		}
+	}
+	return recs, nil
+}
+
+func (b *SQL) Ping(ctx context.Context) error {
+	return classifySQL(b.db.PingContext(ctx))
+}
+
+func (b *SQL) Close() error {
+	return b.db.Close()
+}
+
+// migrate brings the schema up to date, applying each pending migration in its
+// own transaction together with its schema_migrations record.
+func (b *SQL) migrate() error {
+	_, err := b.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER   PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "unable to create schema_migrations")
+	}
+
+	var current int
+	err = b.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return errors.Wrap(err, "unable to read schema version")
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		tx, err := b.db.Begin()
+		if err != nil {
+			return errors.Wrapf(err, "migration %d", version)
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "migration %d", version)
+		}
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now().UTC())
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "migration %d", version)
+		}
+		if err := tx.Commit(); err != nil {
+			return errors.Wrapf(err, "migration %d", version)
+		}
+	}
+	return nil
+}
+
+// classifySQL maps database/sql errors onto the backend error kinds. Driver
+// specific errors are matched on their message to stay driver agnostic.
+func classifySQL(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err == sql.ErrNoRows:
+		return ErrNotFound
+	case err == driver.ErrBadConn, err == sql.ErrConnDone:
+		return withKind(ErrUnavailable, err)
+	case strings.Contains(err.Error(), "database is locked"), strings.Contains(err.Error(), "connection refused"):
+		return withKind(ErrUnavailable, err)
+	}
+	if _, ok := err.(net.Error); ok {
+		return withKind(ErrUnavailable, err)
+	}
+	return err
+}
+
+// encodeStack stores an undo or redo stack as a JSON array, or the empty
+// string when it is empty.
+func encodeStack(stack []int) string {
+	if len(stack) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(stack)
+	return string(data)
+}
+
+func decodeStack(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var stack []int
+	if err := json.Unmarshal([]byte(s), &stack); err != nil {
+		return nil, withKind(ErrCorrupt, errors.Wrap(err, "invalid undo stack"))
+	}
+	return stack, nil
+}
+
+// nullTime maps the zero time to SQL NULL.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
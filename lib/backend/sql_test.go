@@ -0,0 +1,169 @@
+package backend
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+func TestSQL(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "minutes.db")
+
+	b, err := NewSQL("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := "fe2eaa26-babd-48f0-b4e0-e32c61ed7543"
+
+	if _, err := b.GetTimeId(ctx, id); errors.Cause(err) != ErrNotFound {
+		t.Errorf("TestSQL - Get Not Found: got <%v> want <%v>", err, ErrNotFound)
+	}
+	if err := b.SetTimeId(ctx, id, Record{Minutes: 795}, Change{Op: ChangeCreate}); err != nil {
+		t.Error(err)
+	}
+	if _, err := b.UpdateTimeId(ctx, id, func(rec Record) (Record, Change, error) {
+		rec = rec.MoveTo(-1, 870*60)
+		rec.ExpiresAt = time.Now().Add(time.Hour)
+		return rec, Change{Op: ChangeSet}, nil
+	}); err != nil {
+		t.Error(err)
+	}
+	b.Close()
+
+	// Reopening must not re-run migrations that were already applied.
+	b, err = NewSQL("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	rec, err := b.GetTimeId(ctx, id)
+	if err != nil {
+		t.Error(err)
+	}
+	if rec.Minutes != 870 || rec.DayOffset != -1 {
+		t.Errorf("TestSQL - Get: got <%d, %d> want <%d, %d>", rec.Minutes, rec.DayOffset, 870, -1)
+	}
+	if rec.ExpiresAt.IsZero() {
+		t.Error("TestSQL - Get: expiresAt missing")
+	}
+	if rec.Version != 2 {
+		t.Errorf("TestSQL - Get - version: got <%d> want <%d>", rec.Version, 2)
+	}
+	if len(rec.UndoStack) != 1 || rec.UndoStack[0] != 795 {
+		t.Errorf("TestSQL - Get - undo stack: got <%v> want <%v>", rec.UndoStack, []int{795})
+	}
+
+	var version int
+	if err := b.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Error(err)
+	}
+	if version != len(migrations) {
+		t.Errorf("TestSQL - schema version: got <%d> want <%d>", version, len(migrations))
+	}
+
+	errCheck := errors.New("check failed")
+	if err := b.DeleteTimeId(ctx, id, func(Record) error { return errCheck }, Change{Op: ChangeDelete}); err != errCheck {
+		t.Errorf("TestSQL - Delete Check Fails: got <%v> want <%v>", err, errCheck)
+	}
+	if err := b.DeleteTimeId(ctx, id, func(Record) error { return nil }, Change{Op: ChangeDelete}); err != nil {
+		t.Error(err)
+	}
+	checkHistory(t, "TestSQL", b, id, ChangeCreate, ChangeSet, ChangeDelete)
+	if err := b.DeleteTimeId(ctx, id, nil, Change{Op: ChangeDelete}); errors.Cause(err) != ErrNotFound {
+		t.Errorf("TestSQL - Delete Not Found: got <%v> want <%v>", err, ErrNotFound)
+	}
+
+	if err := b.SetTimeId(ctx, id, Record{Minutes: 795, ExpiresAt: time.Now().Add(-time.Second)}, Change{Op: ChangeCreate}); err != nil {
+		t.Error(err)
+	}
+	if _, err := b.GetTimeId(ctx, id); errors.Cause(err) != ErrNotFound {
+		t.Errorf("TestSQL - Get Expired: got <%v> want <%v>", err, ErrNotFound)
+	}
+
+	// Overwriting a row bumps its version, which the result must report.
+	if err := b.SetTimeId(ctx, id, Record{Minutes: 60}, Change{Op: ChangeCreate}); err != nil {
+		t.Error(err)
+	}
+	res, err := b.SetTimeIds(ctx, []BatchItem{{Id: id, Record: Record{Minutes: 120}}}, Change{Op: ChangeCreate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, err = b.GetTimeId(ctx, id); err != nil {
+		t.Error(err)
+	}
+	if res[0].Version != 2 || rec.Version != 2 {
+		t.Errorf("TestSQL - Overwrite - version: got <%d, %d> want <%d, %d>", res[0].Version, rec.Version, 2, 2)
+	}
+	entries, err := b.GetHistory(ctx, id, HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := entries[len(entries)-1]; last.Version != 2 {
+		t.Errorf("TestSQL - Overwrite - history version: got <%d> want <%d>", last.Version, 2)
+	}
+}
+
+func TestSQLColumns(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewSQL("sqlite3", filepath.Join(dir, "minutes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	id := "fe2eaa26-babd-48f0-b4e0-e32c61ed7543"
+
+	if err := b.SetTimeId(ctx, id, Record{Minutes: 795, Seconds: 30, Precision: PrecisionSeconds, Zone: "Europe/Rome", Date: "2018-08-26"}, Change{Op: ChangeCreate}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.UpdateTimeId(ctx, id, func(rec Record) (Record, Change, error) {
+		return rec.SetSecondOfDay(rec.SecondOfDay() + 45), Change{Op: ChangeAdd, DeltaSeconds: 45}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := b.GetTimeId(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Minutes != 796 || rec.Seconds != 15 || rec.Precision != PrecisionSeconds {
+		t.Errorf("TestSQLColumns - Get: got <%d, %d, %s> want <%d, %d, %s>", rec.Minutes, rec.Seconds, rec.Precision, 796, 15, PrecisionSeconds)
+	}
+	if rec.Zone != "Europe/Rome" || rec.Date != "2018-08-26" {
+		t.Errorf("TestSQLColumns - Get - zone: got <%s, %s> want <%s, %s>", rec.Zone, rec.Date, "Europe/Rome", "2018-08-26")
+	}
+	if len(rec.UndoStack) != 1 || rec.UndoStack[0] != 47730 {
+		t.Errorf("TestSQLColumns - Get - undo stack: got <%v> want <%v>", rec.UndoStack, []int{47730})
+	}
+
+	entries, err := b.GetHistory(ctx, id, HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := entries[len(entries)-1]; last.Seconds != 15 || last.DeltaSeconds != 45 {
+		t.Errorf("TestSQLColumns - History: got <%d, %d> want <%d, %d>", last.Seconds, last.DeltaSeconds, 15, 45)
+	}
+}
+
+func TestSQLImport(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewSQL("sqlite3", filepath.Join(dir, "minutes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	checkImport(t, "TestSQLImport", b)
+}
@@ -0,0 +1,267 @@
+// Package cache keeps recently read records in memory in front of a backend,
+// so hot timeIds are not read from the data store on every request.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+	"github.com/mdellandrea/minutes-server/lib/handlers"
+
+	"github.com/rs/zerolog"
+)
+
+// Bus carries invalidations between the caches of the server replicas that
+// share a backend.
+type Bus interface {
+	// Publish tells every cache listening on the bus, including the one
+	// publishing, that the records of ids changed.
+	Publish(ids []string) error
+	// Listen delivers the invalidations published on the bus to c until the
+	// bus is closed. It suspends c whenever invalidations may have been
+	// missed and resumes it once they are delivered again.
+	Listen(c *Cache)
+	Close() error
+}
+
+// Options configure a Cache.
+type Options struct {
+	// Size is the maximum number of records kept. Zero keeps none, which
+	// still publishes the invalidations of writes on Bus.
+	Size int
+	// TTL bounds how long a record is served from the cache, as a backstop
+	// for invalidations that never arrive.
+	TTL time.Duration
+	// Bus shares invalidations with other replicas. Without one, writes made
+	// by other processes are only seen once cached records reach their TTL.
+	Bus Bus
+	Log zerolog.Logger
+}
+
+// Cache is a handlers.Backend that serves GetTimeId from a bounded LRU of
+// records and passes every other call to the backend it wraps. Writes
+// invalidate the timeIds they touch locally and on the bus.
+//
+// A cache with a bus starts suspended and bypasses itself until the bus
+// reports that it is listening, so it never serves a record whose
+// invalidation it could have missed.
+type Cache struct {
+	handlers.Backend
+
+	size int
+	ttl  time.Duration
+	bus  Bus
+	log  zerolog.Logger
+
+	mu        sync.Mutex
+	entries   map[string]*list.Element
+	lru       *list.List
+	suspended bool
+	// tokens identifies the reads filling entries, see lookup.
+	tokens uint64
+}
+
+type entry struct {
+	id      string
+	rec     backend.Record
+	expires time.Time
+	// token is set while a read of the backend is filling the entry.
+	token uint64
+}
+
+// New wraps db in a cache and starts listening on opts.Bus if there is one.
+func New(db handlers.Backend, opts Options) *Cache {
+	c := &Cache{
+		Backend:   db,
+		size:      opts.Size,
+		ttl:       opts.TTL,
+		bus:       opts.Bus,
+		log:       opts.Log,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+		suspended: opts.Bus != nil,
+	}
+	if c.bus != nil {
+		go c.bus.Listen(c)
+	}
+	return c
+}
+
+// Close stops listening on the bus and closes the wrapped backend if it can
+// be closed.
+func (c *Cache) Close() error {
+	var err error
+	if c.bus != nil {
+		err = c.bus.Close()
+	}
+	if cerr := backend.Close(c.Backend); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *Cache) GetTimeId(ctx context.Context, id string) (backend.Record, error) {
+	rec, token, ok := c.lookup(id, time.Now())
+	if ok {
+		return rec, nil
+	}
+	rec, err := c.Backend.GetTimeId(ctx, id)
+	if token != 0 {
+		c.fill(id, token, rec, err, time.Now())
+	}
+	return rec, err
+}
+
+// lookup returns the cached record of id. On a miss it reserves an entry for
+// the record and returns the token the read of the backend must present to
+// fill it; invalidating the entry in the meantime drops the reservation, so
+// a read that raced with a write never caches what it read. The token is zero
+// when the record must not be cached at all.
+func (c *Cache) lookup(id string, now time.Time) (backend.Record, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.suspended || c.size <= 0 {
+		return backend.Record{}, 0, false
+	}
+
+	el, ok := c.entries[id]
+	if ok {
+		e := el.Value.(*entry)
+		if e.token == 0 && now.Before(e.expires) {
+			c.lru.MoveToFront(el)
+			return e.rec, 0, true
+		}
+	} else {
+		el = c.lru.PushFront(&entry{id: id})
+		c.entries[id] = el
+	}
+
+	c.tokens++
+	el.Value.(*entry).token = c.tokens
+	return backend.Record{}, c.tokens, false
+}
+
+// fill stores the record read for the entry reserved with token, evicting
+// the least recently used entries beyond the size of the cache, or drops the
+// reservation if the read failed.
+func (c *Cache) fill(id string, token uint64, rec backend.Record, err error, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[id]
+	if !ok || el.Value.(*entry).token != token {
+		return
+	}
+	if err != nil {
+		c.remove(el)
+		return
+	}
+	e := el.Value.(*entry)
+	e.rec = rec
+	e.token = 0
+	e.expires = now.Add(c.ttl)
+	if !rec.ExpiresAt.IsZero() && rec.ExpiresAt.Before(e.expires) {
+		e.expires = rec.ExpiresAt
+	}
+	c.lru.MoveToFront(el)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*entry).id)
+}
+
+// Invalidate drops the cached records of ids.
+func (c *Cache) Invalidate(ids ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, id := range ids {
+		if el, ok := c.entries[id]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+// Suspend drops every cached record and bypasses the cache until Resume is
+// called. Buses call it when invalidations may be lost.
+func (c *Cache) Suspend() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.suspended = true
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Resume starts caching again after Suspend.
+func (c *Cache) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.suspended = false
+}
+
+// Len returns the number of records cached.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// changed invalidates ids after a write, whether or not it succeeded: a
+// write that failed late, e.g. on a timeout, may still have been applied.
+func (c *Cache) changed(ids ...string) {
+	c.Invalidate(ids...)
+	if c.bus == nil || len(ids) == 0 {
+		return
+	}
+	if err := c.bus.Publish(ids); err != nil {
+		c.log.Error().
+			Err(err).
+			Strs("timeIds", ids).
+			Msg("unable to publish cache invalidation")
+	}
+}
+
+func (c *Cache) SetTimeId(ctx context.Context, id string, rec backend.Record, change backend.Change) error {
+	defer c.changed(id)
+	return c.Backend.SetTimeId(ctx, id, rec, change)
+}
+
+func (c *Cache) UpdateTimeId(ctx context.Context, id string, fn func(current backend.Record) (backend.Record, backend.Change, error)) (backend.Record, error) {
+	defer c.changed(id)
+	return c.Backend.UpdateTimeId(ctx, id, fn)
+}
+
+func (c *Cache) DeleteTimeId(ctx context.Context, id string, fn func(current backend.Record) error, change backend.Change) error {
+	defer c.changed(id)
+	return c.Backend.DeleteTimeId(ctx, id, fn, change)
+}
+
+func (c *Cache) SetTimeIds(ctx context.Context, items []backend.BatchItem, change backend.Change) ([]backend.BatchItem, error) {
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = item.Id
+	}
+	defer c.changed(ids...)
+	return c.Backend.SetTimeIds(ctx, items, change)
+}
+
+func (c *Cache) DeleteTimeIds(ctx context.Context, ids []string, change backend.Change) ([]backend.BatchItem, error) {
+	defer c.changed(ids...)
+	return c.Backend.DeleteTimeIds(ctx, ids, change)
+}
+
+func (c *Cache) ImportTimeId(ctx context.Context, id string, rec backend.Record, overwrite bool, change backend.Change) error {
+	defer c.changed(id)
+	return c.Backend.ImportTimeId(ctx, id, rec, overwrite, change)
+}
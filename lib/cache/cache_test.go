@@ -0,0 +1,314 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+	"github.com/mdellandrea/minutes-server/lib/handlers"
+
+	"github.com/go-redis/redis"
+	"github.com/rs/zerolog"
+)
+
+const (
+	idA = "0b3c1c8e-8a52-4d3c-9f0a-6c4c1f3e2a01"
+	idB = "1d7e9a2b-3f4c-4b5d-8e6f-7a8b9c0d1e02"
+	idC = "2f1a3b4c-5d6e-4f7a-8b9c-0d1e2f3a4b03"
+)
+
+// countingBackend counts the reads that reach the backend and runs during,
+// if set, in the middle of each of them.
+type countingBackend struct {
+	handlers.Backend
+	mu     sync.Mutex
+	reads  int
+	during func()
+}
+
+func (b *countingBackend) GetTimeId(ctx context.Context, id string) (backend.Record, error) {
+	b.mu.Lock()
+	b.reads++
+	during := b.during
+	b.mu.Unlock()
+
+	rec, err := b.Backend.GetTimeId(ctx, id)
+	if during != nil {
+		during()
+	}
+	return rec, err
+}
+
+func (b *countingBackend) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reads
+}
+
+// localBus delivers invalidations to every cache in the process, standing in
+// for replicas sharing a Redis channel.
+type localBus struct {
+	mu     sync.Mutex
+	caches []*Cache
+	ready  sync.WaitGroup
+}
+
+func (b *localBus) Publish(ids []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.caches {
+		c.Invalidate(ids...)
+	}
+	return nil
+}
+
+func (b *localBus) Listen(c *Cache) {
+	b.mu.Lock()
+	b.caches = append(b.caches, c)
+	b.mu.Unlock()
+	c.Resume()
+	b.ready.Done()
+}
+
+func (b *localBus) Close() error { return nil }
+
+func newTestBackend(t *testing.T, minutes map[string]int) *countingBackend {
+	db := backend.NewMemory()
+	for id, m := range minutes {
+		if err := db.SetTimeId(context.Background(), id, backend.Record{Minutes: m}, backend.Change{Op: backend.ChangeCreate}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &countingBackend{Backend: db}
+}
+
+func addMinutes(minutes int) func(backend.Record) (backend.Record, backend.Change, error) {
+	return func(current backend.Record) (backend.Record, backend.Change, error) {
+		return current.SetMinutes(current.Minutes + minutes), backend.Change{Op: backend.ChangeAdd}, nil
+	}
+}
+
+func TestCacheGet(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBackend(t, map[string]int{idA: 540, idB: 600, idC: 660})
+	c := New(db, Options{Size: 2, TTL: time.Minute})
+
+	values := []struct {
+		name    string
+		id      string
+		minutes int
+		reads   int
+	}{
+		{"Miss", idA, 540, 1},
+		{"Hit", idA, 540, 1},
+		{"Second Miss", idB, 600, 2},
+		{"Evicts Least Recent", idC, 660, 3},
+		{"Kept", idB, 600, 3},
+		{"Evicted", idA, 540, 4},
+	}
+
+	for _, tt := range values {
+		rec, err := c.GetTimeId(ctx, tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Minutes != tt.minutes {
+			t.Errorf("TestCacheGet - %s - Minutes: got <%d> want <%d>", tt.name, rec.Minutes, tt.minutes)
+		}
+		if got := db.count(); got != tt.reads {
+			t.Errorf("TestCacheGet - %s - Backend Reads: got <%d> want <%d>", tt.name, got, tt.reads)
+		}
+	}
+	if c.Len() != 2 {
+		t.Errorf("TestCacheGet - Len: got <%d> want <%d>", c.Len(), 2)
+	}
+
+	if _, err := c.GetTimeId(ctx, "3c2b1a4d-6e5f-4a7b-9c8d-1e0f2a3b4c04"); err == nil {
+		t.Errorf("TestCacheGet - Not Found: got <nil> want error")
+	}
+	if c.Len() != 2 {
+		t.Errorf("TestCacheGet - Not Found - Len: got <%d> want <%d>", c.Len(), 2)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBackend(t, map[string]int{idA: 540})
+	c := New(db, Options{Size: 10, TTL: 20 * time.Millisecond})
+
+	c.GetTimeId(ctx, idA)
+	c.GetTimeId(ctx, idA)
+	time.Sleep(30 * time.Millisecond)
+	c.GetTimeId(ctx, idA)
+	if got := db.count(); got != 2 {
+		t.Errorf("TestCacheExpiry - TTL: got <%d> reads want <%d>", got, 2)
+	}
+
+	// A record is never served past its own expiry.
+	expires := time.Now().Add(20 * time.Millisecond)
+	err := db.SetTimeId(ctx, idB, backend.Record{Minutes: 600, ExpiresAt: expires}, backend.Change{Op: backend.ChangeCreate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = New(db, Options{Size: 10, TTL: time.Minute})
+	if _, err := c.GetTimeId(ctx, idB); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := c.GetTimeId(ctx, idB); err == nil {
+		t.Errorf("TestCacheExpiry - Record Expiry: got <nil> want error")
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBackend(t, map[string]int{idA: 540, idB: 600})
+	bus := &localBus{}
+	bus.ready.Add(2)
+	replicas := []*Cache{
+		New(db, Options{Size: 10, TTL: time.Minute, Bus: bus}),
+		New(db, Options{Size: 10, TTL: time.Minute, Bus: bus}),
+	}
+	bus.ready.Wait()
+
+	for _, c := range replicas {
+		for _, id := range []string{idA, idB} {
+			if _, err := c.GetTimeId(ctx, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	values := []struct {
+		name    string
+		write   func() error
+		id      string
+		minutes int
+	}{
+		{"Update", func() error {
+			_, err := replicas[0].UpdateTimeId(ctx, idA, addMinutes(15))
+			return err
+		}, idA, 555},
+		{"Batch Set", func() error {
+			_, err := replicas[0].SetTimeIds(ctx, []backend.BatchItem{{Id: idB, Record: backend.Record{Minutes: 700}}}, backend.Change{Op: backend.ChangeCreate})
+			return err
+		}, idB, 700},
+		{"Import", func() error {
+			return replicas[1].ImportTimeId(ctx, idA, backend.Record{Minutes: 60, Version: 9}, true, backend.Change{Op: backend.ChangeImport})
+		}, idA, 60},
+	}
+
+	for _, tt := range values {
+		if err := tt.write(); err != nil {
+			t.Fatal(err)
+		}
+		for i, c := range replicas {
+			rec, err := c.GetTimeId(ctx, tt.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Minutes != tt.minutes {
+				t.Errorf("TestCacheInvalidation - %s - Replica %d: got <%d> want <%d>", tt.name, i, rec.Minutes, tt.minutes)
+			}
+		}
+	}
+
+	if err := replicas[1].DeleteTimeId(ctx, idB, nil, backend.Change{Op: backend.ChangeDelete}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replicas[0].GetTimeId(ctx, idB); err == nil {
+		t.Errorf("TestCacheInvalidation - Delete: got <nil> want error")
+	}
+}
+
+func TestCacheReadRacingWrite(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBackend(t, map[string]int{idA: 540})
+	c := New(db, Options{Size: 10, TTL: time.Minute})
+
+	// The write lands after the read got the old record but before it is
+	// cached, which must not leave the old record in the cache.
+	db.during = func() {
+		db.during = nil
+		if _, err := c.UpdateTimeId(ctx, idA, addMinutes(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rec, _ := c.GetTimeId(ctx, idA); rec.Minutes != 540 {
+		t.Errorf("TestCacheReadRacingWrite - Racing Read: got <%d> want <%d>", rec.Minutes, 540)
+	}
+	if rec, _ := c.GetTimeId(ctx, idA); rec.Minutes != 541 {
+		t.Errorf("TestCacheReadRacingWrite - Next Read: got <%d> want <%d>", rec.Minutes, 541)
+	}
+}
+
+func TestCacheSuspended(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBackend(t, map[string]int{idA: 540})
+	c := New(db, Options{Size: 10, TTL: time.Minute})
+
+	c.GetTimeId(ctx, idA)
+	c.Suspend()
+	if c.Len() != 0 {
+		t.Errorf("TestCacheSuspended - Len: got <%d> want <%d>", c.Len(), 0)
+	}
+	c.GetTimeId(ctx, idA)
+	c.GetTimeId(ctx, idA)
+	if got := db.count(); got != 3 {
+		t.Errorf("TestCacheSuspended - Backend Reads: got <%d> want <%d>", got, 3)
+	}
+
+	c.Resume()
+	c.GetTimeId(ctx, idA)
+	c.GetTimeId(ctx, idA)
+	if got := db.count(); got != 4 {
+		t.Errorf("TestCacheSuspended - Resumed - Backend Reads: got <%d> want <%d>", got, 4)
+	}
+}
+
+func TestRedisBusUnreachable(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond})
+	defer client.Close()
+
+	ctx := context.Background()
+	db := newTestBackend(t, map[string]int{idA: 540})
+	c := New(db, Options{Size: 10, TTL: time.Minute, Bus: NewRedisBus(client, "minutes:test", zerolog.New(ioutil.Discard))})
+
+	// Without a subscription the cache must not serve anything.
+	c.GetTimeId(ctx, idA)
+	c.GetTimeId(ctx, idA)
+	if got := db.count(); got != 2 {
+		t.Errorf("TestRedisBusUnreachable - Backend Reads: got <%d> want <%d>", got, 2)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- c.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Errorf("TestRedisBusUnreachable - Close: did not return")
+	}
+}
+
+func TestRedisBusClose(t *testing.T) {
+	values := []struct {
+		name   string
+		newBus func(redis.UniversalClient, string, zerolog.Logger) *RedisBus
+		open   bool
+	}{
+		{"Shared", NewRedisBus, true},
+		{"Dedicated", NewDedicatedRedisBus, false},
+	}
+
+	for _, tt := range values {
+		client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond})
+		tt.newBus(client, "minutes:test", zerolog.New(ioutil.Discard)).Close()
+		err := client.Close()
+		if open := err == nil; open != tt.open {
+			t.Errorf("TestRedisBusClose - %s - Client Open: got <%t> want <%t>", tt.name, open, tt.open)
+		}
+	}
+}
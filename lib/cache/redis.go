@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// busPingInterval is how long the subscription may stay silent before it
+	// is checked with a PING.
+	busPingInterval = 5 * time.Second
+	// busRetryDelay is the pause before subscribing again after a failure.
+	busRetryDelay = time.Second
+)
+
+// RedisBus is a Bus over a Redis pub/sub channel. Messages are the changed
+// timeIds separated by spaces.
+//
+// Redis does not keep messages for subscribers that are not connected, so
+// the caches listening are suspended from the moment the subscription fails,
+// or stops answering PINGs, until it is established again.
+type RedisBus struct {
+	client  redis.UniversalClient
+	channel string
+	log     zerolog.Logger
+
+	// owner is set if the bus closes client when it is closed.
+	owner bool
+
+	mu     sync.Mutex
+	pubsub *redis.PubSub
+	closed bool
+	done   chan struct{}
+}
+
+// NewRedisBus subscribes to channel with client. Closing the bus leaves
+// client open.
+func NewRedisBus(client redis.UniversalClient, channel string, log zerolog.Logger) *RedisBus {
+	return &RedisBus{
+		client:  client,
+		channel: channel,
+		log:     log,
+		pubsub:  client.Subscribe(channel),
+		done:    make(chan struct{}),
+	}
+}
+
+// NewDedicatedRedisBus is like NewRedisBus for a client used by nothing else,
+// which closing the bus closes too.
+func NewDedicatedRedisBus(client redis.UniversalClient, channel string, log zerolog.Logger) *RedisBus {
+	b := NewRedisBus(client, channel, log)
+	b.owner = true
+	return b
+}
+
+func (b *RedisBus) Publish(ids []string) error {
+	return b.client.Publish(b.channel, strings.Join(ids, " ")).Err()
+}
+
+func (b *RedisBus) Listen(c *Cache) {
+	pinged := false
+	for {
+		pubsub := b.subscription()
+		if pubsub == nil {
+			return
+		}
+
+		msg, err := pubsub.ReceiveTimeout(busPingInterval)
+		if err != nil {
+			if b.subscription() == nil {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && !pinged {
+				pinged = true
+				if err := pubsub.Ping(); err == nil {
+					continue
+				}
+			}
+
+			c.Suspend()
+			b.log.Error().
+				Err(err).
+				Str("channel", b.channel).
+				Msg("cache invalidations lost, bypassing the cache until resubscribed")
+			b.resubscribe()
+			pinged = false
+			continue
+		}
+
+		pinged = false
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if m.Kind == "subscribe" {
+				c.Resume()
+			}
+		case *redis.Message:
+			c.Invalidate(strings.Fields(m.Payload)...)
+		}
+	}
+}
+
+// subscription returns the current subscription, or nil once the bus is
+// closed.
+func (b *RedisBus) subscription() *redis.PubSub {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	return b.pubsub
+}
+
+// resubscribe replaces the subscription after busRetryDelay. A new
+// subscription is confirmed with a subscribe message, which resumes the
+// cache.
+func (b *RedisBus) resubscribe() {
+	select {
+	case <-b.done:
+		return
+	case <-time.After(busRetryDelay):
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.pubsub.Close()
+	b.pubsub = b.client.Subscribe(b.channel)
+}
+
+func (b *RedisBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	err := b.pubsub.Close()
+	if b.owner {
+		if cerr := b.client.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
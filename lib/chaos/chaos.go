@@ -0,0 +1,271 @@
+// Package chaos injects faults into backend operations, to see how the
+// server and its clients cope with a slow or failing data store without
+// breaking a real one.
+package chaos
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+	"github.com/mdellandrea/minutes-server/lib/handlers"
+
+	"github.com/pkg/errors"
+)
+
+// AllOperations keys the faults of every operation without its own entry.
+const AllOperations = "*"
+
+// Operations are the methods of handlers.Backend faults can be injected into.
+var Operations = []string{
+	"Ping",
+	"SetTimeId",
+	"GetTimeId",
+	"UpdateTimeId",
+	"DeleteTimeId",
+	"GetHistory",
+	"ListTimeIds",
+	"SetTimeIds",
+	"GetTimeIds",
+	"DeleteTimeIds",
+	"ImportTimeId",
+}
+
+// Fault describes what happens to calls of an operation. Each rate is the
+// probability, between 0 and 1, that a call is affected.
+//
+// A call first waits LatencyMs with probability LatencyRate. It then times
+// out with TimeoutRate, waiting until its context is done, or fails with
+// backend.ErrUnavailable with ErrorRate, or with backend.ErrNotFound with
+// NotFoundRate. Calls that fail never reach the backend.
+type Fault struct {
+	LatencyMs    int     `json:"latencyMs,omitempty"`
+	LatencyRate  float64 `json:"latencyRate,omitempty"`
+	TimeoutRate  float64 `json:"timeoutRate,omitempty"`
+	ErrorRate    float64 `json:"errorRate,omitempty"`
+	NotFoundRate float64 `json:"notFoundRate,omitempty"`
+}
+
+type Faults map[string]Fault
+
+func ParseFaults(data []byte) (Faults, error) {
+	var f Faults
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, errors.Wrap(err, "invalid faults")
+	}
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f Faults) Validate() error {
+	for op, fault := range f {
+		if op != AllOperations && !knownOperation(op) {
+			return errors.Errorf("unknown operation %q", op)
+		}
+		if fault.LatencyMs < 0 {
+			return errors.Errorf("%s: negative latencyMs", op)
+		}
+		for _, rate := range []float64{fault.LatencyRate, fault.TimeoutRate, fault.ErrorRate, fault.NotFoundRate} {
+			if rate < 0 || rate > 1 {
+				return errors.Errorf("%s: rate %v outside [0, 1]", op, rate)
+			}
+		}
+	}
+	return nil
+}
+
+func knownOperation(op string) bool {
+	for _, o := range Operations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Injector holds the faults injected into the backends it wraps.
+type Injector struct {
+	mu     sync.RWMutex
+	faults Faults
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+func NewInjector(faults Faults) *Injector {
+	return &Injector{
+		faults: faults,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (i *Injector) Faults() Faults {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	f := make(Faults, len(i.faults))
+	for op, fault := range i.faults {
+		f[op] = fault
+	}
+	return f
+}
+
+// SetFaults replaces the faults being injected. Calls already waiting on a
+// fault are not affected.
+func (i *Injector) SetFaults(f Faults) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.faults = f
+	return nil
+}
+
+func (i *Injector) fault(op string) Fault {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if fault, ok := i.faults[op]; ok {
+		return fault
+	}
+	return i.faults[AllOperations]
+}
+
+func (i *Injector) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	i.randMu.Lock()
+	defer i.randMu.Unlock()
+
+	return i.rand.Float64() < rate
+}
+
+func (i *Injector) inject(ctx context.Context, op string) error {
+	fault := i.fault(op)
+
+	if fault.LatencyMs > 0 && i.roll(fault.LatencyRate) {
+		t := time.NewTimer(time.Duration(fault.LatencyMs) * time.Millisecond)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	switch {
+	case i.roll(fault.TimeoutRate):
+		// Without a deadline the call would hang forever, so it times out
+		// straight away.
+		if _, ok := ctx.Deadline(); ok {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return context.DeadlineExceeded
+	case i.roll(fault.ErrorRate):
+		return errors.Wrapf(backend.ErrUnavailable, "chaos: injected into %s", op)
+	case i.roll(fault.NotFoundRate):
+		return errors.Wrapf(backend.ErrNotFound, "chaos: injected into %s", op)
+	}
+	return nil
+}
+
+type Backend struct {
+	db  handlers.Backend
+	inj *Injector
+}
+
+func (i *Injector) Wrap(db handlers.Backend) *Backend {
+	return &Backend{db: db, inj: i}
+}
+
+func (b *Backend) Close() error {
+	return backend.Close(b.db)
+}
+
+func (b *Backend) Ping(ctx context.Context) error {
+	if err := b.inj.inject(ctx, "Ping"); err != nil {
+		return err
+	}
+	return b.db.Ping(ctx)
+}
+
+func (b *Backend) SetTimeId(ctx context.Context, id string, rec backend.Record, change backend.Change) error {
+	if err := b.inj.inject(ctx, "SetTimeId"); err != nil {
+		return err
+	}
+	return b.db.SetTimeId(ctx, id, rec, change)
+}
+
+func (b *Backend) GetTimeId(ctx context.Context, id string) (backend.Record, error) {
+	if err := b.inj.inject(ctx, "GetTimeId"); err != nil {
+		return backend.Record{}, err
+	}
+	return b.db.GetTimeId(ctx, id)
+}
+
+func (b *Backend) UpdateTimeId(ctx context.Context, id string, fn func(current backend.Record) (backend.Record, backend.Change, error)) (backend.Record, error) {
+	if err := b.inj.inject(ctx, "UpdateTimeId"); err != nil {
+		return backend.Record{}, err
+	}
+	return b.db.UpdateTimeId(ctx, id, fn)
+}
+
+func (b *Backend) DeleteTimeId(ctx context.Context, id string, fn func(current backend.Record) error, change backend.Change) error {
+	if err := b.inj.inject(ctx, "DeleteTimeId"); err != nil {
+		return err
+	}
+	return b.db.DeleteTimeId(ctx, id, fn, change)
+}
+
+func (b *Backend) GetHistory(ctx context.Context, id string, q backend.HistoryQuery) ([]backend.HistoryEntry, error) {
+	if err := b.inj.inject(ctx, "GetHistory"); err != nil {
+		return nil, err
+	}
+	return b.db.GetHistory(ctx, id, q)
+}
+
+func (b *Backend) ListTimeIds(ctx context.Context, q backend.ListQuery) ([]backend.Listing, string, error) {
+	if err := b.inj.inject(ctx, "ListTimeIds"); err != nil {
+		return nil, "", err
+	}
+	return b.db.ListTimeIds(ctx, q)
+}
+
+func (b *Backend) SetTimeIds(ctx context.Context, items []backend.BatchItem, change backend.Change) ([]backend.BatchItem, error) {
+	if err := b.inj.inject(ctx, "SetTimeIds"); err != nil {
+		return nil, err
+	}
+	return b.db.SetTimeIds(ctx, items, change)
+}
+
+func (b *Backend) GetTimeIds(ctx context.Context, ids []string) ([]backend.BatchItem, error) {
+	if err := b.inj.inject(ctx, "GetTimeIds"); err != nil {
+		return nil, err
+	}
+	return b.db.GetTimeIds(ctx, ids)
+}
+
+func (b *Backend) DeleteTimeIds(ctx context.Context, ids []string, change backend.Change) ([]backend.BatchItem, error) {
+	if err := b.inj.inject(ctx, "DeleteTimeIds"); err != nil {
+		return nil, err
+	}
+	return b.db.DeleteTimeIds(ctx, ids, change)
+}
+
+func (b *Backend) ImportTimeId(ctx context.Context, id string, rec backend.Record, overwrite bool, change backend.Change) error {
+	if err := b.inj.inject(ctx, "ImportTimeId"); err != nil {
+		return err
+	}
+	return b.db.ImportTimeId(ctx, id, rec, overwrite, change)
+}
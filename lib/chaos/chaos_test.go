@@ -0,0 +1,141 @@
+package chaos
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+
+	"github.com/pkg/errors"
+)
+
+const testId = "0b3c1c8e-8a52-4d3c-9f0a-6c4c1f3e2a01"
+
+func TestInject(t *testing.T) {
+	values := []struct {
+		name     string
+		faults   Faults
+		deadline time.Duration
+		err      error
+		minDelay time.Duration
+	}{
+		{"No Faults", Faults{}, 0, nil, 0},
+		{"Error", Faults{"GetTimeId": {ErrorRate: 1}}, 0, backend.ErrUnavailable, 0},
+		{"Not Found", Faults{"GetTimeId": {NotFoundRate: 1}}, 0, backend.ErrNotFound, 0},
+		{"Timeout", Faults{"GetTimeId": {TimeoutRate: 1}}, 20 * time.Millisecond, context.DeadlineExceeded, 20 * time.Millisecond},
+		{"Timeout Without Deadline", Faults{"GetTimeId": {TimeoutRate: 1}}, 0, context.DeadlineExceeded, 0},
+		{"Latency", Faults{"GetTimeId": {LatencyMs: 30, LatencyRate: 1}}, 0, nil, 30 * time.Millisecond},
+		{"Latency Past Deadline", Faults{"GetTimeId": {LatencyMs: 1000, LatencyRate: 1}}, 20 * time.Millisecond, context.DeadlineExceeded, 20 * time.Millisecond},
+		{"All Operations", Faults{AllOperations: {ErrorRate: 1}}, 0, backend.ErrUnavailable, 0},
+		{"Operation Overrides All", Faults{AllOperations: {ErrorRate: 1}, "GetTimeId": {}}, 0, nil, 0},
+		{"Other Operation", Faults{"SetTimeId": {ErrorRate: 1}}, 0, nil, 0},
+		{"Zero Rate", Faults{"GetTimeId": {ErrorRate: 0, NotFoundRate: 0}}, 0, nil, 0},
+	}
+
+	for _, tt := range values {
+		t.Run(tt.name, func(t *testing.T) {
+			db := backend.NewMemory()
+			if err := db.SetTimeId(context.Background(), testId, backend.Record{Minutes: 540}, backend.Change{Op: backend.ChangeCreate}); err != nil {
+				t.Fatal(err)
+			}
+			b := NewInjector(tt.faults).Wrap(db)
+
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+			start := time.Now()
+			rec, err := b.GetTimeId(ctx, testId)
+			if errors.Cause(err) != tt.err {
+				t.Errorf("TestInject - %s - Error: got <%v> want <%v>", tt.name, err, tt.err)
+			}
+			if err == nil && rec.Minutes != 540 {
+				t.Errorf("TestInject - %s - Minutes: got <%d> want <%d>", tt.name, rec.Minutes, 540)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minDelay {
+				t.Errorf("TestInject - %s - Delay: got <%v> want at least <%v>", tt.name, elapsed, tt.minDelay)
+			}
+		})
+	}
+}
+
+func TestInjectedWritesSkipBackend(t *testing.T) {
+	ctx := context.Background()
+	db := backend.NewMemory()
+	inj := NewInjector(Faults{"SetTimeId": {ErrorRate: 1}})
+	b := inj.Wrap(db)
+
+	if err := b.SetTimeId(ctx, testId, backend.Record{Minutes: 540}, backend.Change{Op: backend.ChangeCreate}); errors.Cause(err) != backend.ErrUnavailable {
+		t.Errorf("TestInjectedWritesSkipBackend - Set: got <%v> want <%v>", err, backend.ErrUnavailable)
+	}
+	if _, err := db.GetTimeId(ctx, testId); errors.Cause(err) != backend.ErrNotFound {
+		t.Errorf("TestInjectedWritesSkipBackend - Get: got <%v> want <%v>", err, backend.ErrNotFound)
+	}
+
+	// Faults replaced at runtime apply to the next call.
+	if err := inj.SetFaults(Faults{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetTimeId(ctx, testId, backend.Record{Minutes: 540}, backend.Change{Op: backend.ChangeCreate}); err != nil {
+		t.Errorf("TestInjectedWritesSkipBackend - Set After Reset: got <%v> want <nil>", err)
+	}
+}
+
+func TestParseFaults(t *testing.T) {
+	values := []struct {
+		name  string
+		input string
+		fails bool
+	}{
+		{"Valid", `{"*":{"latencyMs":100,"latencyRate":0.5},"GetTimeId":{"errorRate":0.1,"notFoundRate":0.1,"timeoutRate":0.01}}`, false},
+		{"Empty", `{}`, false},
+		{"Not JSON", `{"GetTimeId":`, true},
+		{"Unknown Operation", `{"GetTime":{"errorRate":0.1}}`, true},
+		{"Rate Above One", `{"GetTimeId":{"errorRate":1.5}}`, true},
+		{"Negative Rate", `{"GetTimeId":{"timeoutRate":-0.1}}`, true},
+		{"Negative Latency", `{"GetTimeId":{"latencyMs":-1,"latencyRate":1}}`, true},
+	}
+
+	for _, tt := range values {
+		_, err := ParseFaults([]byte(tt.input))
+		if (err != nil) != tt.fails {
+			t.Errorf("TestParseFaults - %s: got <%v> want failure <%t>", tt.name, err, tt.fails)
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	inj := NewInjector(Faults{})
+
+	values := []struct {
+		name     string
+		method   string
+		body     string
+		expected int
+		response string
+	}{
+		{"Get Empty", "GET", "", http.StatusOK, `{}`},
+		{"Put", "PUT", `{"GetTimeId":{"errorRate":0.5}}`, http.StatusOK, `{"GetTimeId":{"errorRate":0.5}}`},
+		{"Get", "GET", "", http.StatusOK, `{"GetTimeId":{"errorRate":0.5}}`},
+		{"Put Invalid", "PUT", `{"GetTimeId":{"errorRate":2}}`, http.StatusBadRequest, `{"error":"GetTimeId: rate 2 outside [0, 1]"}`},
+		{"Kept After Invalid", "GET", "", http.StatusOK, `{"GetTimeId":{"errorRate":0.5}}`},
+		{"Post", "POST", `{}`, http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, tt := range values {
+		rr := httptest.NewRecorder()
+		inj.ServeHTTP(rr, httptest.NewRequest(tt.method, "/admin/chaos", strings.NewReader(tt.body)))
+		if rr.Code != tt.expected {
+			t.Errorf("TestServeHTTP - %s - Response Status Code: got <%d> want <%d>", tt.name, rr.Code, tt.expected)
+		}
+		if tt.response != "" && rr.Body.String() != tt.response {
+			t.Errorf("TestServeHTTP - %s - Body: got <%s> want <%s>", tt.name, rr.Body.String(), tt.response)
+		}
+	}
+}
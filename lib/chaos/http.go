@@ -0,0 +1,60 @@
+package chaos
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/mdellandrea/minutes-server/lib/handlers"
+
+	"github.com/pkg/errors"
+)
+
+const maxFaultsSize = 64 * 1024
+
+// ServeHTTP reads the faults being injected with GET and replaces them with
+// PUT, responding with the faults in effect either way. An empty object stops
+// injecting faults.
+func (i *Injector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		defer r.Body.Close()
+		bdy, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxFaultsSize))
+		if err != nil {
+			badRequest(w, errors.Wrap(err, "unable to read faults"))
+			return
+		}
+		faults, err := ParseFaults(bdy)
+		if err == nil {
+			err = i.SetFaults(faults)
+		}
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp, err := json.Marshal(i.Faults())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(resp)
+}
+
+func badRequest(w http.ResponseWriter, err error) {
+	resp, err := json.Marshal(handlers.ErrorResponse{Error: err.Error()})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(resp)
+}
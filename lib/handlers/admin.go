@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+	"github.com/mdellandrea/minutes-server/lib/transfer"
+
+	"github.com/pkg/errors"
+)
+
+// ExportTimes streams every live timeId as NDJSON. Once the first line is
+// written the status can no longer change, so a later failure aborts the
+// response and the client sees a truncated transfer rather than a clean end.
+func (t *TimeHandler) ExportTimes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	n, err := transfer.Export(r.Context(), t.Db, w)
+	if err == nil {
+		return
+	}
+	if n == 0 {
+		w.Header().Del("Content-Type")
+		t.backendError(w, err)
+		return
+	}
+
+	t.Log.Error().
+		Err(err).
+		Int("exported", n).
+		Msg("export aborted")
+	panic(http.ErrAbortHandler)
+}
+
+// ImportTimes reads an export from the request body. The onConflict
+// parameter picks what happens to timeIds that already exist: skip (the
+// default), overwrite or fail.
+func (t *TimeHandler) ImportTimes(w http.ResponseWriter, r *http.Request) {
+	policy := r.URL.Query().Get("onConflict")
+	if policy == "" {
+		policy = transfer.Skip
+	}
+	if !transfer.ValidPolicy(policy) {
+		t.badRequest(w, errors.Errorf("unknown onConflict %q", policy))
+		return
+	}
+
+	defer r.Body.Close()
+	sum, err := transfer.Import(r.Context(), t.Db, r.Body, policy, newChange(r, backend.ChangeImport, 0))
+	res := ImportResult{Summary: sum}
+	status := http.StatusOK
+	if err != nil {
+		status = t.errorStatus(err)
+		res.Error = err.Error()
+		setRetryAfter(w, err)
+	}
+
+	resp, err := json.Marshal(res)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	_, err = w.Write(resp)
+	if err != nil {
+		t.Log.Debug().
+			Err(err).
+			Msg("failure during write response")
+	}
+}
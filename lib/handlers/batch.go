@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+)
+
+// maxBatchSize bounds the number of items in one batch request.
+const maxBatchSize = 1000
+
+// BatchCreateTimes creates a timeId for every valid item. Invalid items are
+// reported with status 400 without failing the rest of the batch.
+func (t *TimeHandler) BatchCreateTimes(w http.ResponseWriter, r *http.Request) {
+	format, err := requestedFormat(r)
+	if err != nil {
+		t.badRequest(w, err)
+		return
+	}
+	var req BatchCreateRequest
+	if !t.readBatch(w, r, &req) {
+		return
+	}
+	if len(req.Times) == 0 || len(req.Times) > maxBatchSize {
+		t.badRequest(w, errors.Errorf("batches must hold between 1 and %d times", maxBatchSize))
+		return
+	}
+
+	res := make([]BatchItemResult, len(req.Times))
+	var items []backend.BatchItem
+	var index []int
+	for i, newTime := range req.Times {
+		rec, err := t.newRecord(newTime)
+		if err != nil {
+			res[i] = BatchItemResult{Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		items = append(items, backend.BatchItem{Id: uuid.NewV4().String(), Record: rec})
+		index = append(index, i)
+	}
+
+	if len(items) > 0 {
+		created, err := t.Db.SetTimeIds(r.Context(), items, newChange(r, backend.ChangeCreate, 0))
+		if err != nil {
+			t.backendError(w, err)
+			return
+		}
+		for j, item := range created {
+			res[index[j]] = t.batchItemResult(item, http.StatusOK, true, format)
+		}
+	}
+	w.Header().Add("Vary", "Accept")
+	t.writeBatch(w, res)
+}
+
+func (t *TimeHandler) BatchGetTimes(w http.ResponseWriter, r *http.Request) {
+	format, err := requestedFormat(r)
+	if err != nil {
+		t.badRequest(w, err)
+		return
+	}
+	var req BatchTimeIdsRequest
+	if !t.readBatch(w, r, &req) {
+		return
+	}
+	ids, index, res, err := batchTimeIds(req.TimeIds)
+	if err != nil {
+		t.badRequest(w, err)
+		return
+	}
+
+	if len(ids) > 0 {
+		items, err := t.Db.GetTimeIds(r.Context(), ids)
+		if err != nil {
+			t.backendError(w, err)
+			return
+		}
+		for j, item := range items {
+			res[index[j]] = t.batchItemResult(item, http.StatusOK, true, format)
+		}
+	}
+	w.Header().Add("Vary", "Accept")
+	t.writeBatch(w, res)
+}
+
+func (t *TimeHandler) BatchDeleteTimes(w http.ResponseWriter, r *http.Request) {
+	var req BatchTimeIdsRequest
+	if !t.readBatch(w, r, &req) {
+		return
+	}
+	ids, index, res, err := batchTimeIds(req.TimeIds)
+	if err != nil {
+		t.badRequest(w, err)
+		return
+	}
+
+	if len(ids) > 0 {
+		items, err := t.Db.DeleteTimeIds(r.Context(), ids, newChange(r, backend.ChangeDelete, 0))
+		if err != nil {
+			t.backendError(w, err)
+			return
+		}
+		for j, item := range items {
+			res[index[j]] = t.batchItemResult(item, http.StatusNoContent, false, "")
+		}
+	}
+	t.writeBatch(w, res)
+}
+
+// batchTimeIds picks the valid timeIds out of a batch request. It returns
+// them with their positions in the request and the results of the batch, in
+// which invalid timeIds are already reported. Empty, oversized and repeating
+// batches fail as a whole.
+func batchTimeIds(timeIds []string) (ids []string, index []int, res []BatchItemResult, err error) {
+	if len(timeIds) == 0 || len(timeIds) > maxBatchSize {
+		return nil, nil, nil, errors.Errorf("batches must hold between 1 and %d timeIds", maxBatchSize)
+	}
+
+	seen := make(map[string]bool, len(timeIds))
+	res = make([]BatchItemResult, len(timeIds))
+	for i, id := range timeIds {
+		if seen[id] {
+			return nil, nil, nil, errors.Errorf("timeId %s repeated", id)
+		}
+		seen[id] = true
+
+		if _, err := uuid.FromString(id); err != nil {
+			res[i] = BatchItemResult{TimeId: id, Status: http.StatusBadRequest, Error: errInvalidTimeId.Error()}
+			continue
+		}
+		ids = append(ids, id)
+		index = append(index, i)
+	}
+	return ids, index, res, nil
+}
+
+// batchItemResult reports a backend batch item with the status of the
+// equivalent single-item request, and its time in format if withTime is set.
+func (t *TimeHandler) batchItemResult(item backend.BatchItem, status int, withTime bool, format string) BatchItemResult {
+	if item.Err != nil {
+		status := t.errorStatus(item.Err)
+		return BatchItemResult{TimeId: item.Id, Status: status, Error: http.StatusText(status)}
+	}
+
+	res := BatchItemResult{TimeId: item.Id, Status: status}
+	if withTime {
+		current := currentTime(item.Record, format)
+		res.CurrentTime = &current
+	}
+	return res
+}
+
+// readBatch decodes the body of a batch request into v, responding with an
+// error status and returning false if it cannot.
+func (t *TimeHandler) readBatch(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.ContentLength == 0 {
+		t.badRequest(w, errNoBody)
+		return false
+	}
+
+	defer r.Body.Close()
+	bdy, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+
+	if err := json.Unmarshal(bdy, v); err != nil {
+		t.badRequest(w, errors.Wrap(err, "invalid request body"))
+		return false
+	}
+	return true
+}
+
+func (t *TimeHandler) writeBatch(w http.ResponseWriter, res []BatchItemResult) {
+	resp, err := json.Marshal(BatchResult{Items: res})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	_, err = w.Write(resp)
+	if err != nil {
+		t.Log.Debug().
+			Err(err).
+			Msg("failure during write response")
+	}
+}
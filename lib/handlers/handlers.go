@@ -1,34 +1,79 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+	"github.com/mdellandrea/minutes-server/lib/transfer"
 
 	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/satori/go.uuid"
 )
 
-func SetupRoutes(mux *chi.Mux, db Backend, log zerolog.Logger) *chi.Mux {
+func SetupRoutes(mux *chi.Mux, db Backend, log zerolog.Logger, opts Options) *chi.Mux {
 	timeHandler := TimeHandler{
-		Db:  db,
-		Log: log,
+		Db:         db,
+		Log:        log,
+		DefaultTTL: opts.DefaultTTL,
+	}
+
+	timeout := func(operationId string) func(http.Handler) http.Handler {
+		d, ok := opts.Timeouts[operationId]
+		if !ok {
+			d = opts.DefaultTimeout
+		}
+		return Timeout(d)
 	}
 
 	mux.Route("/time", func(r chi.Router) {
-		r.Post("/", timeHandler.CreateTime)
-		r.Get("/{timeId}", timeHandler.GetTime)
-		r.Put("/{timeId}", timeHandler.ChangeTime)
-		r.Delete("/{timeId}", timeHandler.DeleteTime)
+		r.With(timeout("listTimes")).Get("/", timeHandler.ListTimes)
+		r.With(timeout("createTime")).Post("/", timeHandler.CreateTime)
+		r.With(timeout("getTime")).Get("/{timeId}", timeHandler.GetTime)
+		r.With(timeout("changeTime")).Put("/{timeId}", timeHandler.ChangeTime)
+		r.With(timeout("deleteTime")).Delete("/{timeId}", timeHandler.DeleteTime)
+		r.With(timeout("getTimeHistory")).Get("/{timeId}/history", timeHandler.GetTimeHistory)
+		r.With(timeout("undoTime")).Post("/{timeId}/undo", timeHandler.UndoTime)
+		r.With(timeout("redoTime")).Post("/{timeId}/redo", timeHandler.RedoTime)
 	})
 
+	// Admin operations walk the whole data set, so only an explicit entry in
+	// Timeouts bounds them.
+	adminTimeout := func(operationId string) func(http.Handler) http.Handler {
+		return Timeout(opts.Timeouts[operationId])
+	}
+	if opts.Transfer {
+		mux.With(adminTimeout("exportTimes")).Get("/admin/export", timeHandler.ExportTimes)
+		mux.With(adminTimeout("importTimes")).Post("/admin/import", timeHandler.ImportTimes)
+	}
+	if opts.Chaos != nil {
+		mux.Handle("/admin/chaos", opts.Chaos)
+	}
+
+	// Batch operations sit beside /time rather than under it, so they cannot
+	// be mistaken for a timeId.
+	mux.With(timeout("batchCreateTimes")).Post("/time:batchCreate", timeHandler.BatchCreateTimes)
+	mux.With(timeout("batchGetTimes")).Post("/time:batchGet", timeHandler.BatchGetTimes)
+	mux.With(timeout("batchDeleteTimes")).Post("/time:batchDelete", timeHandler.BatchDeleteTimes)
+
 	return mux
 }
 
 func (t *TimeHandler) CreateTime(w http.ResponseWriter, r *http.Request) {
+	format, err := requestedFormat(r)
+	if err != nil {
+		t.badRequest(w, err)
+		return
+	}
+
 	// default start time
-	timeStr := "12:00 PM"
+	newTime := NewTimeRequest{InitialTime: "12:00 PM"}
 
 	if r.ContentLength > 0 {
 		defer r.Body.Close()
@@ -38,29 +83,37 @@ func (t *TimeHandler) CreateTime(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		newTime := NewTimeRequest{}
+		newTime = NewTimeRequest{}
 		err = json.Unmarshal(bdy, &newTime)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		if !validTimeFormat(newTime.InitialTime) {
-			w.WriteHeader(http.StatusBadRequest)
+			t.badRequest(w, errors.Wrap(err, "invalid request body"))
 			return
 		}
-		timeStr = newTime.InitialTime
+	}
+
+	rec, err := t.newRecord(newTime)
+	if err != nil {
+		t.badRequest(w, err)
+		return
 	}
 
 	id := uuid.NewV4().String()
-	err := t.Db.SetTimeId(id, timeStr)
+	err = t.Db.SetTimeId(r.Context(), id, rec, newChange(r, backend.ChangeCreate, 0))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		t.backendError(w, err)
 		return
 	}
 
+	current := currentTime(rec, format)
 	resp, err := json.Marshal(NewTime{
 		TimeId:      id,
-		CurrentTime: timeStr,
+		CurrentTime: current.CurrentTime,
+		Label:       rec.Label,
+		Format:      rec.Format,
+		Precision:   rec.Precision,
+		Zone:        rec.Zone,
+		Date:        rec.Date,
+		ExpiresAt:   expiresAt(rec),
 	})
 
 	if err != nil {
@@ -68,6 +121,9 @@ func (t *TimeHandler) CreateTime(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Backends start every new record at version 1.
+	w.Header().Set("ETag", variantETag(1, format, ""))
+	w.Header().Add("Vary", "Accept")
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	_, err = w.Write(resp)
 	if err != nil {
@@ -81,24 +137,63 @@ func (t *TimeHandler) GetTime(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "timeId")
 
 	if _, err := uuid.FromString(id); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		t.badRequest(w, errInvalidTimeId)
 		return
 	}
 
-	val, err := t.Db.GetTimeId(id)
+	format, err := requestedFormat(r)
 	if err != nil {
-		if t.Db.NotFoundErrCheck(err) {
-			t.Log.Debug().Err(err)
-			w.WriteHeader(http.StatusNotFound)
+		t.badRequest(w, err)
+		return
+	}
+
+	var tz *time.Location
+	if name := r.URL.Query().Get("tz"); name != "" {
+		if tz, err = loadZone(name); err != nil {
+			t.badRequest(w, err)
 			return
 		}
-		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	rec, err := t.Db.GetTimeId(r.Context(), id)
+	if err != nil {
+		t.backendError(w, err)
+		return
+	}
+	if tz != nil && rec.Zone == "" {
+		t.badRequest(w, errors.New("the timeId has no zone to convert from"))
 		return
 	}
 
-	var res CurrentTime
-	res.CurrentTime = val
-	resp, err := json.Marshal(res)
+	zone := ""
+	if tz != nil {
+		zone = tz.String()
+	}
+	// The format can come from Accept, and each format and zone is a
+	// representation of its own, with its own tag.
+	tag := variantETag(rec.Version, format, zone)
+	w.Header().Set("ETag", tag)
+	w.Header().Add("Vary", "Accept")
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatch(inm, tag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	current := currentTime(rec, format)
+	if tz != nil {
+		zoned, err := zonedTime(rec)
+		if err != nil {
+			t.backendError(w, err)
+			return
+		}
+		if format == "" {
+			format = rec.Format
+		}
+		converted := zonedView(zoned.In(tz), rec, format)
+		current.Converted = &converted
+	}
+
+	resp, err := json.Marshal(current)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -117,12 +212,18 @@ func (t *TimeHandler) ChangeTime(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "timeId")
 
 	if _, err := uuid.FromString(id); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		t.badRequest(w, errInvalidTimeId)
 		return
 	}
 
 	if r.ContentLength == 0 {
-		w.WriteHeader(http.StatusBadRequest)
+		t.badRequest(w, errNoBody)
+		return
+	}
+
+	format, err := requestedFormat(r)
+	if err != nil {
+		t.badRequest(w, err)
 		return
 	}
 
@@ -136,30 +237,127 @@ func (t *TimeHandler) ChangeTime(w http.ResponseWriter, r *http.Request) {
 	timeChange := ChangeTimeRequest{}
 	err = json.Unmarshal(bdy, &timeChange)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		t.badRequest(w, errors.Wrap(err, "invalid body"))
 		return
 	}
 
-	current, err := t.Db.GetTimeId(id)
+	minutes, seconds, err := validateChange(timeChange)
 	if err != nil {
-		if t.Db.NotFoundErrCheck(err) {
-			t.Log.Debug().Err(err)
-			w.WriteHeader(http.StatusNotFound)
-			return
+		t.badRequest(w, err)
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	rec, err := t.Db.UpdateTimeId(r.Context(), id, func(current backend.Record) (backend.Record, backend.Change, error) {
+		if ifMatch != "" && !etagMatch(ifMatch, etag(current.Version), false) {
+			return backend.Record{}, backend.Change{}, errPreconditionFailed
 		}
-		w.WriteHeader(http.StatusInternalServerError)
+		if err := checkSeconds(timeChange, seconds, current); err != nil {
+			return backend.Record{}, backend.Change{}, err
+		}
+		var change backend.Change
+		if timeChange.SetTime != "" {
+			next := current.SetSecondOfDay(timeToSeconds(timeChange.SetTime))
+			change = moveChange(r, backend.ChangeSet, current, next)
+			current = next
+		} else {
+			next := addTime(current, minutes, seconds)
+			change = moveChange(r, backend.ChangeAdd, current, next)
+			current = next
+		}
+		if timeChange.TTL != nil {
+			current.ExpiresAt = time.Now().Add(time.Duration(*timeChange.TTL) * time.Second)
+		}
+		if timeChange.Label != nil {
+			current.Label = *timeChange.Label
+		}
+		if timeChange.Format != nil {
+			current.Format = *timeChange.Format
+		}
+		return current, change, nil
+	})
+	if errors.Cause(err) == errNoSeconds {
+		t.badRequest(w, err)
+		return
+	}
+	if err != nil {
+		t.backendError(w, err)
 		return
 	}
 
-	newTime := calculateTime(current, timeChange.AddMinutes)
-	err = t.Db.SetTimeId(id, newTime)
+	resp, err := json.Marshal(currentTime(rec, format))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	var res CurrentTime
-	res.CurrentTime = newTime
+	w.Header().Set("ETag", variantETag(rec.Version, format, ""))
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	_, err = w.Write(resp)
+	if err != nil {
+		t.Log.Debug().
+			Err(err).
+			Msg("failure during write response")
+	}
+}
+
+func (t *TimeHandler) DeleteTime(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "timeId")
+	if _, err := uuid.FromString(id); err != nil {
+		t.badRequest(w, errInvalidTimeId)
+		return
+	}
+
+	var check func(backend.Record) error
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		check = func(current backend.Record) error {
+			if !etagMatch(ifMatch, etag(current.Version), false) {
+				return errPreconditionFailed
+			}
+			return nil
+		}
+	}
+
+	err := t.Db.DeleteTimeId(r.Context(), id, check, newChange(r, backend.ChangeDelete, 0))
+	if err != nil {
+		t.backendError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListTimes pages through the live timeIds, optionally filtered by current
+// time, creation time and label.
+func (t *TimeHandler) ListTimes(w http.ResponseWriter, r *http.Request) {
+	q, err := listQuery(r.URL.Query())
+	if err != nil {
+		t.badRequest(w, err)
+		return
+	}
+	format, err := requestedFormat(r)
+	if err != nil {
+		t.badRequest(w, err)
+		return
+	}
+
+	listings, next, err := t.Db.ListTimeIds(r.Context(), q)
+	if err != nil {
+		t.backendError(w, err)
+		return
+	}
+
+	res := TimeList{
+		TimeIds:    make([]ListedTime, len(listings)),
+		NextCursor: next,
+	}
+	for i, l := range listings {
+		res.TimeIds[i] = ListedTime{
+			TimeId:      l.Id,
+			CurrentTime: currentTime(l.Record, format),
+		}
+	}
 
 	resp, err := json.Marshal(res)
 	if err != nil {
@@ -167,6 +365,7 @@ func (t *TimeHandler) ChangeTime(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Add("Vary", "Accept")
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	_, err = w.Write(resp)
 	if err != nil {
@@ -176,23 +375,252 @@ func (t *TimeHandler) ChangeTime(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (t *TimeHandler) DeleteTime(w http.ResponseWriter, r *http.Request) {
+// UndoTime reverts the most recent change of the time of a timeId.
+func (t *TimeHandler) UndoTime(w http.ResponseWriter, r *http.Request) {
+	t.step(w, r, backend.ChangeUndo, backend.Record.Undo)
+}
+
+// RedoTime re-applies the most recently undone change of the time of a timeId.
+func (t *TimeHandler) RedoTime(w http.ResponseWriter, r *http.Request) {
+	t.step(w, r, backend.ChangeRedo, backend.Record.Redo)
+}
+
+// step moves a timeId through its undo or redo stack, responding with 409 if
+// the stack is empty.
+func (t *TimeHandler) step(w http.ResponseWriter, r *http.Request, op string, move func(backend.Record) (backend.Record, bool)) {
 	id := chi.URLParam(r, "timeId")
 	if _, err := uuid.FromString(id); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		t.badRequest(w, errInvalidTimeId)
+		return
+	}
+	format, err := requestedFormat(r)
+	if err != nil {
+		t.badRequest(w, err)
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	rec, err := t.Db.UpdateTimeId(r.Context(), id, func(current backend.Record) (backend.Record, backend.Change, error) {
+		if ifMatch != "" && !etagMatch(ifMatch, etag(current.Version), false) {
+			return backend.Record{}, backend.Change{}, errPreconditionFailed
+		}
+		next, ok := move(current)
+		if !ok {
+			return backend.Record{}, backend.Change{}, errors.Wrapf(errNothingToStep, "nothing to %s", op)
+		}
+		return next, moveChange(r, op, current, next), nil
+	})
+	if err != nil {
+		t.backendError(w, err)
 		return
 	}
 
-	err := t.Db.DeleteTimeId(id)
+	resp, err := json.Marshal(currentTime(rec, format))
 	if err != nil {
-		if t.Db.NotFoundErrCheck(err) {
-			t.Log.Debug().Err(err)
-			w.WriteHeader(http.StatusNotFound)
-			return
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", variantETag(rec.Version, format, ""))
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	_, err = w.Write(resp)
+	if err != nil {
+		t.Log.Debug().
+			Err(err).
+			Msg("failure during write response")
+	}
+}
+
+// GetTimeHistory pages through the changes made to a timeId, oldest first. It
+// keeps working after the timeId is deleted or expires.
+func (t *TimeHandler) GetTimeHistory(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "timeId")
+	if _, err := uuid.FromString(id); err != nil {
+		t.badRequest(w, errInvalidTimeId)
+		return
+	}
+
+	q, err := historyQuery(r.URL.Query())
+	if err != nil {
+		t.badRequest(w, err)
+		return
+	}
+
+	// Ask for one more entry than the page holds to learn whether another
+	// page follows.
+	limit := q.Limit
+	q.Limit++
+	entries, err := t.Db.GetHistory(r.Context(), id, q)
+	if errors.Cause(err) == backend.ErrNotFound {
+		// TimeIds created before history was recorded have none yet.
+		if _, getErr := t.Db.GetTimeId(r.Context(), id); getErr == nil {
+			entries, err = []backend.HistoryEntry{}, nil
 		}
+	}
+	if err != nil {
+		t.backendError(w, err)
+		return
+	}
+
+	var res History
+	res.Entries = entries
+	if len(entries) > limit {
+		res.Entries = entries[:limit]
+		res.NextCursor = strconv.FormatInt(entries[limit-1].Seq, 10)
+	}
+
+	resp, err := json.Marshal(res)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	_, err = w.Write(resp)
+	if err != nil {
+		t.Log.Debug().
+			Err(err).
+			Msg("failure during write response")
+	}
+}
+
+// errPreconditionFailed aborts a write whose If-Match header does not match the
+// current version of the timeId.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// errInvalidTimeId rejects requests for a timeId that is not a UUID.
+var errInvalidTimeId = errors.New("invalid timeId")
+
+// errNoBody rejects requests missing the body they need.
+var errNoBody = errors.New("missing request body")
+
+// errNothingToStep aborts an undo or redo when its stack is empty.
+var errNothingToStep = errors.New("no change to step through")
+
+// backendError responds with the status matching the kind of a backend error.
+// Errors blaming the request, such as an invalid cursor, get the body of any
+// other invalid request.
+func (t *TimeHandler) backendError(w http.ResponseWriter, err error) {
+	setRetryAfter(w, err)
+	status := t.errorStatus(err)
+	if status == http.StatusBadRequest {
+		t.badRequest(w, err)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// badRequest responds with 400 and the reason the request was rejected.
+func (t *TimeHandler) badRequest(w http.ResponseWriter, err error) {
+	t.Log.Debug().Err(err).Msg("invalid request")
+	resp, err := json.Marshal(ErrorResponse{Error: err.Error()})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(resp)
+}
+
+// setRetryAfter tells the client when to try again if the backend said when
+// it may recover, in whole seconds rounded up.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	after, ok := backend.RetryAfter(err)
+	if !ok {
+		return
+	}
+	secs := int((after + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+}
+
+// errorStatus logs err and returns the response status it maps to.
+func (t *TimeHandler) errorStatus(err error) int {
+	switch errors.Cause(err) {
+	case context.DeadlineExceeded:
+		t.Log.Info().Err(err).Msg("request timed out")
+		return http.StatusGatewayTimeout
+	case context.Canceled:
+		t.Log.Debug().Err(err).Msg("request canceled by client")
+		return StatusClientClosedRequest
+	case backend.ErrNotFound:
+		t.Log.Debug().Err(err).Msg("timeId not found")
+		return http.StatusNotFound
+	case errPreconditionFailed:
+		t.Log.Debug().Err(err).Msg("timeId version does not match If-Match")
+		return http.StatusPreconditionFailed
+	case errNothingToStep:
+		t.Log.Debug().Err(err).Msg("undo or redo stack empty")
+		return http.StatusConflict
+	case backend.ErrInvalidCursor:
+		t.Log.Debug().Err(err).Msg("invalid list cursor")
+		return http.StatusBadRequest
+	case backend.ErrUnsupported:
+		t.Log.Info().Err(err).Msg("operation not supported by backend")
+		return http.StatusNotImplemented
+	case backend.ErrConflict:
+		t.Log.Info().Err(err).Msg("backend write conflict")
+		return http.StatusConflict
+	case backend.ErrExists:
+		t.Log.Info().Err(err).Msg("timeId already exists")
+		return http.StatusConflict
+	case transfer.ErrInvalidLine:
+		t.Log.Debug().Err(err).Msg("invalid import")
+		return http.StatusBadRequest
+	case backend.ErrUnavailable:
+		t.Log.Error().Err(err).Msg("backend unavailable")
+		return http.StatusServiceUnavailable
+	default:
+		t.Log.Error().Err(err).Msg("backend failure")
+		return http.StatusInternalServerError
+	}
+}
+
+// newRecord validates a request for a new timeId and builds its record.
+func (t *TimeHandler) newRecord(req NewTimeRequest) (backend.Record, error) {
+	if !validTimeFormat(req.InitialTime) {
+		return backend.Record{}, errors.Errorf("invalid initialTime %q", req.InitialTime)
+	}
+	if req.TTL < 0 {
+		return backend.Record{}, errors.New("ttl must not be negative")
+	}
+	if !validLabel(req.Label) {
+		return backend.Record{}, errors.Errorf("label longer than %d characters", maxLabelLength)
+	}
+	if !validFormat(req.Format) {
+		return backend.Record{}, errors.Errorf("unknown format %q", req.Format)
+	}
+	if !validPrecision(req.Precision) {
+		return backend.Record{}, errors.Errorf("unknown precision %q", req.Precision)
+	}
+	if req.Precision != backend.PrecisionSeconds && timeHasSeconds(req.InitialTime) {
+		return backend.Record{}, errors.Errorf("initialTime %q has seconds, which need precision %q", req.InitialTime, backend.PrecisionSeconds)
+	}
+	date, err := newDate(req.Zone, req.Date)
+	if err != nil {
+		return backend.Record{}, err
+	}
+
+	second := timeToSeconds(req.InitialTime)
+	rec := backend.Record{
+		Minutes:   second / 60,
+		Seconds:   second % 60,
+		Precision: req.Precision,
+		Label:     req.Label,
+		Format:    req.Format,
+		Zone:      req.Zone,
+		Date:      date,
+	}
+	ttl := t.DefaultTTL
+	if req.TTL > 0 {
+		ttl = time.Duration(req.TTL) * time.Second
+	}
+	if ttl > 0 {
+		rec.ExpiresAt = time.Now().Add(ttl)
+	}
+	return rec, nil
 }
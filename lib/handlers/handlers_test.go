@@ -11,59 +11,156 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
 
 	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	uuid "github.com/satori/go.uuid"
 )
 
-type testBackend struct{}
-
-func (b *testBackend) SetTimeId(id, val string) error      { return nil }
-func (b *testBackend) GetTimeId(id string) (string, error) { return "12:00 PM", nil }
-func (b *testBackend) DeleteTimeId(id string) error        { return nil }
-func (b *testBackend) NotFoundErrCheck(error) bool         { return false }
+var testCreatedAt = time.Date(2018, 6, 1, 9, 30, 0, 0, time.UTC)
 
-type testBackendFail struct{}
+// testRecord is the record every timeId of testBackend holds.
+var testRecord = backend.Record{Minutes: 720, CreatedAt: testCreatedAt, UpdatedAt: testCreatedAt, Version: 1}
 
-func (b *testBackendFail) SetTimeId(id, val string) error      { return fmt.Errorf("Err") }
-func (b *testBackendFail) GetTimeId(id string) (string, error) { return "", fmt.Errorf("Err") }
-func (b *testBackendFail) DeleteTimeId(id string) error        { return fmt.Errorf("Err") }
-func (b *testBackendFail) NotFoundErrCheck(error) bool         { return false }
+// testBackend holds testRecord under every timeId. A non-nil err fails every
+// call with it, and slow blocks every call until the request context is done.
+type testBackend struct {
+	err  error
+	slow bool
+}
 
-type testBackendNotFound struct{}
+// fail returns the error every call to b ends with, or nil if calls succeed.
+func (b *testBackend) fail(ctx context.Context) error {
+	if b.slow {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return b.err
+}
 
-func (b *testBackendNotFound) SetTimeId(id, val string) error      { return fmt.Errorf("Err") }
-func (b *testBackendNotFound) GetTimeId(id string) (string, error) { return "", fmt.Errorf("Err") }
-func (b *testBackendNotFound) DeleteTimeId(id string) error        { return fmt.Errorf("Err") }
-func (b *testBackendNotFound) NotFoundErrCheck(error) bool         { return true }
+func (b *testBackend) Ping(ctx context.Context) error {
+	return b.fail(ctx)
+}
+func (b *testBackend) SetTimeId(ctx context.Context, id string, rec backend.Record, change backend.Change) error {
+	return b.fail(ctx)
+}
+func (b *testBackend) GetTimeId(ctx context.Context, id string) (backend.Record, error) {
+	if err := b.fail(ctx); err != nil {
+		return backend.Record{}, err
+	}
+	return testRecord, nil
+}
+func (b *testBackend) UpdateTimeId(ctx context.Context, id string, fn func(backend.Record) (backend.Record, backend.Change, error)) (backend.Record, error) {
+	if err := b.fail(ctx); err != nil {
+		return backend.Record{}, err
+	}
+	rec, _, err := fn(testRecord)
+	if err != nil {
+		return backend.Record{}, err
+	}
+	rec.Version++
+	return rec, nil
+}
+func (b *testBackend) DeleteTimeId(ctx context.Context, id string, fn func(backend.Record) error, change backend.Change) error {
+	if err := b.fail(ctx); err != nil {
+		return err
+	}
+	if fn != nil {
+		return fn(testRecord)
+	}
+	return nil
+}
+func (b *testBackend) GetHistory(ctx context.Context, id string, q backend.HistoryQuery) ([]backend.HistoryEntry, error) {
+	if err := b.fail(ctx); err != nil {
+		return nil, err
+	}
+	var entries []backend.HistoryEntry
+	for seq := q.After + 1; seq <= 3 && len(entries) < q.Limit; seq++ {
+		entries = append(entries, backend.HistoryEntry{Seq: seq, Op: backend.ChangeAdd, Delta: 1, Minutes: 720, Version: seq, Time: testCreatedAt})
+	}
+	return entries, nil
+}
+func (b *testBackend) ListTimeIds(ctx context.Context, q backend.ListQuery) ([]backend.Listing, string, error) {
+	if err := b.fail(ctx); err != nil {
+		return nil, "", err
+	}
+	return []backend.Listing{{Id: "a3a4e7b4-5d9b-4f5e-9c57-2bb5c7d3a3c1", Record: testRecord}}, "", nil
+}
+func (b *testBackend) SetTimeIds(ctx context.Context, items []backend.BatchItem, change backend.Change) ([]backend.BatchItem, error) {
+	if err := b.fail(ctx); err != nil {
+		return nil, err
+	}
+	res := make([]backend.BatchItem, len(items))
+	for i, item := range items {
+		res[i] = backend.BatchItem{Id: item.Id, Record: testRecord}
+	}
+	return res, nil
+}
+func (b *testBackend) GetTimeIds(ctx context.Context, ids []string) ([]backend.BatchItem, error) {
+	if err := b.fail(ctx); err != nil {
+		return nil, err
+	}
+	res := make([]backend.BatchItem, len(ids))
+	for i, id := range ids {
+		res[i] = backend.BatchItem{Id: id, Record: testRecord}
+	}
+	return res, nil
+}
+func (b *testBackend) DeleteTimeIds(ctx context.Context, ids []string, change backend.Change) ([]backend.BatchItem, error) {
+	if err := b.fail(ctx); err != nil {
+		return nil, err
+	}
+	res := make([]backend.BatchItem, len(ids))
+	for i, id := range ids {
+		res[i] = backend.BatchItem{Id: id}
+	}
+	return res, nil
+}
+func (b *testBackend) ImportTimeId(ctx context.Context, id string, rec backend.Record, overwrite bool, change backend.Change) error {
+	return b.fail(ctx)
+}
 
 var testTimeHandler = TimeHandler{
 	Db: &testBackend{},
 }
 
 var failingTestTimeHandler = TimeHandler{
-	Db: &testBackendFail{},
+	Db: &testBackend{err: fmt.Errorf("Err")},
 }
 
 var notFoundTestTimeHandler = TimeHandler{
-	Db: &testBackendNotFound{},
+	Db: &testBackend{err: backend.ErrNotFound},
 }
 
 func TestNewRouter(t *testing.T) {
 	mux := chi.NewMux()
 	logger := zerolog.New(os.Stderr)
-	testRtr := SetupRoutes(mux, &testBackend{}, logger)
-	x := testRtr.Routes()
-	if len(x) > 1 {
-		t.Errorf("root pattern length: got <%d> want <%d>", len(x), 1)
+	testRtr := SetupRoutes(mux, &testBackend{}, logger, Options{})
+	routes := testRtr.Routes()
+	if len(routes) != 4 {
+		t.Fatalf("root pattern length: got <%d> want <%d>", len(routes), 4)
+	}
+
+	roots := map[string]chi.Route{}
+	for _, route := range routes {
+		roots[route.Pattern] = route
+	}
+	for _, pattern := range []string{"/time:batchCreate", "/time:batchGet", "/time:batchDelete"} {
+		if roots[pattern].Handlers["POST"] == nil {
+			t.Errorf("no configured POST handler: %s", pattern)
+		}
 	}
 
 	expectedRoot := "/time/*"
-	actualRoot := x[0].Pattern
-	if x[0].Pattern != expectedRoot {
-		t.Errorf("root pattern: got <%s> want <%s>", actualRoot, expectedRoot)
+	root, ok := roots[expectedRoot]
+	if !ok {
+		t.Fatalf("root pattern: no <%s>", expectedRoot)
 	}
+	x := []chi.Route{root}
 
 	routes1 := x[0].SubRoutes.Routes()
 	noParamsRoutes := routes1[0]
@@ -96,6 +193,29 @@ func TestNewRouter(t *testing.T) {
 	}
 }
 
+func TestChaosRoute(t *testing.T) {
+	chaos := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	values := []struct {
+		name     string
+		opts     Options
+		expected int
+	}{
+		{"Disabled", Options{}, http.StatusNotFound},
+		{"Enabled", Options{Chaos: chaos}, http.StatusTeapot},
+	}
+
+	for _, tt := range values {
+		rtr := SetupRoutes(chi.NewMux(), &testBackend{}, zerolog.New(ioutil.Discard), tt.opts)
+		rr := httptest.NewRecorder()
+		rtr.ServeHTTP(rr, httptest.NewRequest("PUT", "/admin/chaos", nil))
+		if rr.Code != tt.expected {
+			t.Errorf("TestChaosRoute - %s - Response Status Code: got <%d> want <%d>", tt.name, rr.Code, tt.expected)
+		}
+	}
+}
+
 func TestCreateTimeHandler(t *testing.T) {
 	t.Run("No Request Body - Success", func(t *testing.T) {
 		req, err := http.NewRequest("POST", "/time", nil)
@@ -157,6 +277,53 @@ func TestCreateTimeHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("Request Body - TTL", func(t *testing.T) {
+		b := strings.NewReader(`{"initialTime":"03:33 PM","ttl":3600}`)
+		req, err := http.NewRequest("POST", "/time", b)
+		if err != nil {
+			t.Error(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(testTimeHandler.CreateTime)
+
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("TestCreateTimeHandler Request Body - TTL - Response Status Code: got <%d> want <%d>", rr.Code, http.StatusOK)
+		}
+
+		var tgt NewTime
+		err = json.Unmarshal(rr.Body.Bytes(), &tgt)
+		if err != nil {
+			t.Errorf("TestCreateTimeHandler Request Body - TTL - JSON Response Unmarshal failed: <%s>", err)
+		}
+		if tgt.ExpiresAt == nil {
+			t.Fatal("TestCreateTimeHandler Request Body - TTL - JSON Response expiresAt missing")
+		}
+		if d := time.Until(*tgt.ExpiresAt); d < 59*time.Minute || d > time.Hour {
+			t.Errorf("TestCreateTimeHandler Request Body - TTL - JSON Response expiresAt: got <%s> from now want <%s>", d, time.Hour)
+		}
+	})
+
+	t.Run("Request Body - Invalid TTL", func(t *testing.T) {
+		b := strings.NewReader(`{"initialTime":"03:33 PM","ttl":-1}`)
+		req, err := http.NewRequest("POST", "/time", b)
+		if err != nil {
+			t.Error(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(testTimeHandler.CreateTime)
+
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("TestCreateTimeHandler Request Body - Invalid TTL - Response Status Code: got <%d> want <%d>", rr.Code, http.StatusBadRequest)
+		}
+		if expected := `{"error":"ttl must not be negative"}`; rr.Body.String() != expected {
+			t.Errorf("TestCreateTimeHandler Request Body - Invalid TTL - Response Body: got <%s> want <%s>", rr.Body.String(), expected)
+		}
+	})
+
 	t.Run("Request Body - Invalid Request Format", func(t *testing.T) {
 		b := strings.NewReader(`{"spongeBob":"squarePants"}`)
 		req, err := http.NewRequest("POST", "/time", b)
@@ -187,6 +354,12 @@ func TestCreateTimeHandler(t *testing.T) {
 		if rr.Code != http.StatusBadRequest {
 			t.Errorf("TestCreateTimeHandler Request Body - Invalid Time Format - Response Status Code: got <%d> want <%d>", rr.Code, http.StatusBadRequest)
 		}
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json; charset=UTF-8" {
+			t.Errorf("TestCreateTimeHandler Request Body - Invalid Time Format - Content-Type: got <%s> want <%s>", ct, "application/json; charset=UTF-8")
+		}
+		if expected := `{"error":"invalid initialTime \"13:33 PM\""}`; rr.Body.String() != expected {
+			t.Errorf("TestCreateTimeHandler Request Body - Invalid Time Format - Response Body: got <%s> want <%s>", rr.Body.String(), expected)
+		}
 	})
 
 	t.Run("Request Body - Malformed JSON Failure", func(t *testing.T) {
@@ -241,7 +414,7 @@ func TestGetTimeHandler(t *testing.T) {
 			t.Errorf("TestGetTimeHandler - Success - Response Status Code: got <%d> want <%d>", rr.Code, http.StatusOK)
 		}
 
-		expected := []byte(`{"currentTime":"12:00 PM"}`)
+		expected := []byte(`{"currentTime":"12:00 PM","minutes":720,"dayOffset":0,"createdAt":"2018-06-01T09:30:00Z","updatedAt":"2018-06-01T09:30:00Z","version":1}`)
 		if !bytes.Equal(rr.Body.Bytes(), expected) {
 			t.Errorf("TestGetTimeHandler - Success - Response Body: got <%v> want <%v>", rr.Body.Bytes(), expected)
 		}
@@ -345,6 +518,102 @@ func TestChangeTimeHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("Set Time", func(t *testing.T) {
+		b := strings.NewReader(`{"setTime":"03:45 am"}`)
+		r, err := http.NewRequest("PUT", "/time", b)
+		if err != nil {
+			t.Error(err)
+		}
+		ctx := chi.NewRouteContext()
+		ctx.URLParams.Add("timeId", uuid.NewV4().String())
+		req := r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, ctx))
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(testTimeHandler.ChangeTime)
+
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("TestChangeTimeHandler - Set Time - Response Status Code: got <%d> want <%d>", rr.Code, http.StatusOK)
+		}
+
+		var tgt CurrentTime
+		if err := json.Unmarshal(rr.Body.Bytes(), &tgt); err != nil {
+			t.Errorf("TestChangeTimeHandler - Set Time - JSON Response Unmarshal failed: <%s>", err)
+		}
+		if tgt.CurrentTime != "03:45 AM" {
+			t.Errorf("TestChangeTimeHandler - Set Time - JSON Response currentTime invalid: got <%s> want <%s>", tgt.CurrentTime, "03:45 AM")
+		}
+	})
+
+	t.Run("Invalid Set Time", func(t *testing.T) {
+		for _, body := range []string{`{"setTime":"13:00 PM"}`, `{"setTime":"03:45 AM","addMinutes":5}`} {
+			r, err := http.NewRequest("PUT", "/time", strings.NewReader(body))
+			if err != nil {
+				t.Error(err)
+			}
+			ctx := chi.NewRouteContext()
+			ctx.URLParams.Add("timeId", uuid.NewV4().String())
+			req := r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, ctx))
+
+			rr := httptest.NewRecorder()
+			handler := http.HandlerFunc(testTimeHandler.ChangeTime)
+
+			handler.ServeHTTP(rr, req)
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("TestChangeTimeHandler - Invalid Set Time %s - Response Status Code: got <%d> want <%d>", body, rr.Code, http.StatusBadRequest)
+			}
+		}
+	})
+
+	t.Run("Refresh TTL", func(t *testing.T) {
+		b := strings.NewReader(`{"addMinutes":10,"ttl":60}`)
+		r, err := http.NewRequest("PUT", "/time", b)
+		if err != nil {
+			t.Error(err)
+		}
+		u2 := uuid.NewV4()
+		ctx := chi.NewRouteContext()
+		ctx.URLParams.Add("timeId", u2.String())
+		req := r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, ctx))
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(testTimeHandler.ChangeTime)
+
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("TestChangeTimeHandler - Refresh TTL - Response Status Code: got <%d> want <%d>", rr.Code, http.StatusOK)
+		}
+
+		var tgt CurrentTime
+		err = json.Unmarshal(rr.Body.Bytes(), &tgt)
+		if err != nil {
+			t.Errorf("TestChangeTimeHandler - Refresh TTL - JSON Response Unmarshal failed: <%s>", err)
+		}
+		if tgt.ExpiresAt == nil {
+			t.Error("TestChangeTimeHandler - Refresh TTL - JSON Response expiresAt missing")
+		}
+	})
+
+	t.Run("Invalid TTL", func(t *testing.T) {
+		b := strings.NewReader(`{"addMinutes":10,"ttl":0}`)
+		r, err := http.NewRequest("PUT", "/time", b)
+		if err != nil {
+			t.Error(err)
+		}
+		u2 := uuid.NewV4()
+		ctx := chi.NewRouteContext()
+		ctx.URLParams.Add("timeId", u2.String())
+		req := r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, ctx))
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(testTimeHandler.ChangeTime)
+
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("TestChangeTimeHandler - Invalid TTL - Response Status Code: got <%d> want <%d>", rr.Code, http.StatusBadRequest)
+		}
+	})
+
 	t.Run("Invalid timeId Format", func(t *testing.T) {
 		r, err := http.NewRequest("PUT", "/time", nil)
 		if err != nil {
@@ -539,3 +808,917 @@ func TestDeleteTimeHandler(t *testing.T) {
 		}
 	})
 }
+
+func TestConditionalRequests(t *testing.T) {
+	values := []struct {
+		name     string
+		method   string
+		header   string
+		value    string
+		body     string
+		handler  func(http.ResponseWriter, *http.Request)
+		expected int
+		etag     string
+	}{
+		{"Get", "GET", "", "", "", testTimeHandler.GetTime, http.StatusOK, `"1"`},
+		{"Get - If-None-Match Match", "GET", "If-None-Match", `"1"`, "", testTimeHandler.GetTime, http.StatusNotModified, `"1"`},
+		{"Get - If-None-Match Weak Match", "GET", "If-None-Match", `"7", W/"1"`, "", testTimeHandler.GetTime, http.StatusNotModified, `"1"`},
+		{"Get - If-None-Match Mismatch", "GET", "If-None-Match", `"2"`, "", testTimeHandler.GetTime, http.StatusOK, `"1"`},
+		{"Get - Accept Format", "GET", "Accept", `application/json; profile="24h"`, "", testTimeHandler.GetTime, http.StatusOK, `"1;format=24h"`},
+		{"Get - If-None-Match Other Format", "GET", "If-None-Match", `"1;format=24h"`, "", testTimeHandler.GetTime, http.StatusOK, `"1"`},
+		{"Create", "POST", "", "", "", testTimeHandler.CreateTime, http.StatusOK, `"1"`},
+		{"Create - Accept Format", "POST", "Accept", `application/json; profile="24h"`, "", testTimeHandler.CreateTime, http.StatusOK, `"1;format=24h"`},
+		{"Change", "PUT", "", "", `{"addMinutes":1}`, testTimeHandler.ChangeTime, http.StatusOK, `"2"`},
+		{"Change - Accept Format", "PUT", "Accept", `application/json; profile="24h"`, `{"addMinutes":1}`, testTimeHandler.ChangeTime, http.StatusOK, `"2;format=24h"`},
+		{"Change - If-Match Match", "PUT", "If-Match", `"1"`, `{"addMinutes":1}`, testTimeHandler.ChangeTime, http.StatusOK, `"2"`},
+		{"Change - If-Match Any", "PUT", "If-Match", "*", `{"addMinutes":1}`, testTimeHandler.ChangeTime, http.StatusOK, `"2"`},
+		{"Change - If-Match Mismatch", "PUT", "If-Match", `"2"`, `{"addMinutes":1}`, testTimeHandler.ChangeTime, http.StatusPreconditionFailed, ""},
+		{"Change - If-Match Format", "PUT", "If-Match", `"1;format=24h"`, `{"addMinutes":1}`, testTimeHandler.ChangeTime, http.StatusOK, `"2"`},
+		{"Change - If-Match Weak", "PUT", "If-Match", `W/"1"`, `{"addMinutes":1}`, testTimeHandler.ChangeTime, http.StatusPreconditionFailed, ""},
+		{"Delete - If-Match Match", "DELETE", "If-Match", `"0", "1"`, "", testTimeHandler.DeleteTime, http.StatusNoContent, ""},
+		{"Delete - If-Match Mismatch", "DELETE", "If-Match", `"2"`, "", testTimeHandler.DeleteTime, http.StatusPreconditionFailed, ""},
+	}
+
+	for _, tt := range values {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(tt.method, "/time", strings.NewReader(tt.body))
+			if err != nil {
+				t.Error(err)
+			}
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			ctx := chi.NewRouteContext()
+			ctx.URLParams.Add("timeId", uuid.NewV4().String())
+			req := r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, ctx))
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(tt.handler).ServeHTTP(rr, req)
+			if rr.Code != tt.expected {
+				t.Errorf("TestConditionalRequests - %s - Response Status Code: got <%d> want <%d>", tt.name, rr.Code, tt.expected)
+			}
+			if etag := rr.Header().Get("ETag"); etag != tt.etag {
+				t.Errorf("TestConditionalRequests - %s - ETag: got <%s> want <%s>", tt.name, etag, tt.etag)
+			}
+			if vary := rr.Header().Get("Vary"); tt.etag != "" && vary != "Accept" {
+				t.Errorf("TestConditionalRequests - %s - Vary: got <%s> want <%s>", tt.name, vary, "Accept")
+			}
+			if tt.expected == http.StatusNotModified && rr.Body.Len() != 0 {
+				t.Errorf("TestConditionalRequests - %s - Response Body: got <%s> want none", tt.name, rr.Body.String())
+			}
+		})
+	}
+
+	// The tag of a change is the tag a read of the same format gets.
+	db := backend.NewMemory()
+	router := SetupRoutes(chi.NewMux(), db, zerolog.New(ioutil.Discard), Options{})
+	id := uuid.NewV4().String()
+	if err := db.SetTimeId(context.Background(), id, backend.Record{Minutes: 720}, backend.Change{Op: backend.ChangeCreate}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("PUT", "/time/"+id+"?format=24h", strings.NewReader(`{"addMinutes":1}`))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	tag := rr.Header().Get("ETag")
+	req = httptest.NewRequest("GET", "/time/"+id+"?format=24h", nil)
+	req.Header.Set("If-None-Match", tag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("TestConditionalRequests - Change Then Get - Response Status Code: got <%d> want <%d>", rr.Code, http.StatusNotModified)
+	}
+}
+
+func TestUndoRedoHandler(t *testing.T) {
+	db := backend.NewMemory()
+	router := SetupRoutes(chi.NewMux(), db, zerolog.New(ioutil.Discard), Options{})
+	id := uuid.NewV4().String()
+	if err := db.SetTimeId(context.Background(), id, backend.Record{Minutes: 720}, backend.Change{Op: backend.ChangeCreate}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		expected int
+		time     string
+	}{
+		{"Undo Nothing", "POST", "/undo", "", http.StatusConflict, ""},
+		{"Add", "PUT", "", `{"addMinutes":30}`, http.StatusOK, "12:30 PM"},
+		{"Set", "PUT", "", `{"setTime":"03:00 AM"}`, http.StatusOK, "03:00 AM"},
+		{"Undo Set", "POST", "/undo", "", http.StatusOK, "12:30 PM"},
+		{"Undo Add", "POST", "/undo", "", http.StatusOK, "12:00 PM"},
+		{"Redo Add", "POST", "/redo", "", http.StatusOK, "12:30 PM"},
+		{"Add Again", "PUT", "", `{"addMinutes":-60}`, http.StatusOK, "11:30 AM"},
+		{"Redo Nothing", "POST", "/redo", "", http.StatusConflict, ""},
+	}
+
+	for _, tt := range steps {
+		req := httptest.NewRequest(tt.method, "/time/"+id+tt.path, strings.NewReader(tt.body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.expected {
+			t.Errorf("TestUndoRedoHandler - %s - Response Status Code: got <%d> want <%d>", tt.name, rr.Code, tt.expected)
+			continue
+		}
+		if tt.time == "" {
+			continue
+		}
+		var tgt CurrentTime
+		if err := json.Unmarshal(rr.Body.Bytes(), &tgt); err != nil {
+			t.Errorf("TestUndoRedoHandler - %s - JSON Response Unmarshal failed: <%s>", tt.name, err)
+		}
+		if tgt.CurrentTime != tt.time {
+			t.Errorf("TestUndoRedoHandler - %s - currentTime: got <%s> want <%s>", tt.name, tgt.CurrentTime, tt.time)
+		}
+	}
+
+	history, err := db.GetHistory(context.Background(), id, backend.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	redo := history[len(history)-2]
+	if redo.Op != backend.ChangeRedo || redo.Delta != 30 {
+		t.Errorf("TestUndoRedoHandler - redo history entry: got <%s, %d> want <%s, %d>", redo.Op, redo.Delta, backend.ChangeRedo, 30)
+	}
+}
+
+func TestChangeTimeDeltas(t *testing.T) {
+	db := backend.NewMemory()
+	router := SetupRoutes(chi.NewMux(), db, zerolog.New(ioutil.Discard), Options{})
+	id := uuid.NewV4().String()
+	if err := db.SetTimeId(context.Background(), id, backend.Record{Minutes: 720}, backend.Change{Op: backend.ChangeCreate}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name     string
+		body     string
+		expected int
+		time     string
+		err      string
+	}{
+		{"Duration", `{"addDuration":"PT1H30M"}`, http.StatusOK, "01:30 PM", ""},
+		{"Negative Duration", `{"addDuration":"-P1DT2H"}`, http.StatusOK, "11:30 AM", ""},
+		{"Units", `{"add":{"hours":2,"minutes":15,"seconds":-60}}`, http.StatusOK, "01:44 PM", ""},
+		{"Minutes", `{"addMinutes":1}`, http.StatusOK, "01:45 PM", ""},
+		{"Two Forms", `{"addMinutes":0,"addDuration":"PT1H"}`, http.StatusBadRequest, "", "only one of addMinutes, addSeconds, addDuration, add and setTime may be given, got addMinutes and addDuration"},
+		{"Invalid Duration", `{"addDuration":"1 hour"}`, http.StatusBadRequest, "", `invalid addDuration: "1 hour" is not an ISO 8601 duration such as PT1H30M`},
+		{"Partial Minute", `{"add":{"seconds":30}}`, http.StatusBadRequest, "", "add must be a whole number of minutes: the timeId is not kept to the second"},
+		{"Seconds", `{"addSeconds":60}`, http.StatusOK, "01:46 PM", ""},
+		{"Partial Minute Seconds", `{"addSeconds":-30}`, http.StatusBadRequest, "", "addSeconds must be a whole number of minutes: the timeId is not kept to the second"},
+		{"Set Time With Seconds", `{"setTime":"13:00:00"}`, http.StatusBadRequest, "", `setTime "13:00:00" has seconds: the timeId is not kept to the second`},
+		{"Unchanged", `{"label":"x"}`, http.StatusOK, "01:46 PM", ""},
+	}
+
+	for _, tt := range steps {
+		req := httptest.NewRequest("PUT", "/time/"+id, strings.NewReader(tt.body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.expected {
+			t.Errorf("TestChangeTimeDeltas - %s - Response Status Code: got <%d> want <%d>", tt.name, rr.Code, tt.expected)
+			continue
+		}
+		if tt.err != "" {
+			var tgt ErrorResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &tgt); err != nil {
+				t.Errorf("TestChangeTimeDeltas - %s - JSON Response Unmarshal failed: <%s>", tt.name, err)
+			}
+			if tgt.Error != tt.err {
+				t.Errorf("TestChangeTimeDeltas - %s - error: got <%s> want <%s>", tt.name, tgt.Error, tt.err)
+			}
+			continue
+		}
+		var tgt CurrentTime
+		if err := json.Unmarshal(rr.Body.Bytes(), &tgt); err != nil {
+			t.Errorf("TestChangeTimeDeltas - %s - JSON Response Unmarshal failed: <%s>", tt.name, err)
+		}
+		if tgt.CurrentTime != tt.time {
+			t.Errorf("TestChangeTimeDeltas - %s - currentTime: got <%s> want <%s>", tt.name, tgt.CurrentTime, tt.time)
+		}
+	}
+
+	history, err := db.GetHistory(context.Background(), id, backend.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := history[2]; entry.Op != backend.ChangeAdd || entry.Delta != -1560 {
+		t.Errorf("TestChangeTimeDeltas - history entry: got <%s, %d> want <%s, %d>", entry.Op, entry.Delta, backend.ChangeAdd, -1560)
+	}
+}
+
+func TestTimeFormats(t *testing.T) {
+	router := SetupRoutes(chi.NewMux(), backend.NewMemory(), zerolog.New(ioutil.Discard), Options{})
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/time", strings.NewReader(`{"initialTime":"13:45","format":"24h"}`)))
+	var created NewTime
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("TestTimeFormats - Create - JSON Response Unmarshal failed: <%s>", err)
+	}
+	if created.CurrentTime != "13:45" || created.Format != "24h" {
+		t.Errorf("TestTimeFormats - Create: got <%s, %s> want <%s, %s>", created.CurrentTime, created.Format, "13:45", "24h")
+	}
+
+	steps := []struct {
+		name     string
+		method   string
+		query    string
+		accept   string
+		body     string
+		expected int
+		time     string
+	}{
+		{"Stored Format", "GET", "", "", "", http.StatusOK, "13:45"},
+		{"Query", "GET", "?format=12h", "", "", http.StatusOK, "01:45 PM"},
+		{"Accept Profile", "GET", "", "application/json; profile=12h", "", http.StatusOK, "01:45 PM"},
+		{"Query Over Accept", "GET", "?format=24h", "application/json; profile=12h", "", http.StatusOK, "13:45"},
+		{"Unknown Query", "GET", "?format=iso", "", "", http.StatusBadRequest, ""},
+		{"Set 12h", "PUT", "", "", `{"setTime":"09:05 PM"}`, http.StatusOK, "21:05"},
+		{"Set 24h", "PUT", "?format=12h", "", `{"setTime":"0:30"}`, http.StatusOK, "12:30 AM"},
+		{"Reset Format", "PUT", "", "", `{"format":""}`, http.StatusOK, "12:30 AM"},
+		{"Default Format", "GET", "", "", "", http.StatusOK, "12:30 AM"},
+		{"Store 24h", "PUT", "", "", `{"format":"24h","addMinutes":60}`, http.StatusOK, "01:30"},
+		{"Unknown Format", "PUT", "", "", `{"format":"iso"}`, http.StatusBadRequest, ""},
+		{"Invalid 24h Time", "PUT", "", "", `{"setTime":"24:00"}`, http.StatusBadRequest, ""},
+		{"Undo", "POST", "/undo?format=12h", "", "", http.StatusOK, "12:30 AM"},
+	}
+
+	for _, tt := range steps {
+		req := httptest.NewRequest(tt.method, "/time/"+created.TimeId+tt.query, strings.NewReader(tt.body))
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.expected {
+			t.Errorf("TestTimeFormats - %s - Response Status Code: got <%d> want <%d>", tt.name, rr.Code, tt.expected)
+			continue
+		}
+		if tt.time == "" {
+			continue
+		}
+		var tgt CurrentTime
+		if err := json.Unmarshal(rr.Body.Bytes(), &tgt); err != nil {
+			t.Errorf("TestTimeFormats - %s - JSON Response Unmarshal failed: <%s>", tt.name, err)
+		}
+		if tgt.CurrentTime != tt.time {
+			t.Errorf("TestTimeFormats - %s - currentTime: got <%s> want <%s>", tt.name, tgt.CurrentTime, tt.time)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/time", strings.NewReader(`{"initialTime":"13:45","format":"iso"}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("TestTimeFormats - Create Unknown Format - Response Status Code: got <%d> want <%d>", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSecondsPrecision(t *testing.T) {
+	db := backend.NewMemory()
+	router := SetupRoutes(chi.NewMux(), db, zerolog.New(ioutil.Discard), Options{})
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/time", strings.NewReader(`{"initialTime":"01:45:30 PM","precision":"seconds"}`)))
+	var created NewTime
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("TestSecondsPrecision - Create - JSON Response Unmarshal failed: <%s>", err)
+	}
+	if created.CurrentTime != "01:45:30 PM" || created.Precision != "seconds" {
+		t.Errorf("TestSecondsPrecision - Create: got <%s, %s> want <%s, %s>", created.CurrentTime, created.Precision, "01:45:30 PM", "seconds")
+	}
+
+	steps := []struct {
+		name     string
+		method   string
+		query    string
+		body     string
+		expected int
+		time     string
+		seconds  int
+	}{
+		{"Get", "GET", "", "", http.StatusOK, "01:45:30 PM", 30},
+		{"Get 24h", "GET", "?format=24h", "", http.StatusOK, "13:45:30", 30},
+		{"Add Seconds", "PUT", "", `{"addSeconds":45}`, http.StatusOK, "01:46:15 PM", 15},
+		{"Add Duration", "PUT", "", `{"addDuration":"-PT1M15S"}`, http.StatusOK, "01:45:00 PM", 0},
+		{"Add Minutes", "PUT", "", `{"addMinutes":-1}`, http.StatusOK, "01:44:00 PM", 0},
+		{"Set 12h", "PUT", "", `{"setTime":"11:59:59 PM"}`, http.StatusOK, "11:59:59 PM", 59},
+		{"Wrap", "PUT", "", `{"addSeconds":2}`, http.StatusOK, "12:00:01 AM", 1},
+		{"Set 24h", "PUT", "?format=24h", `{"setTime":"9:05"}`, http.StatusOK, "09:05:00", 0},
+		{"Undo", "POST", "/undo", "", http.StatusOK, "12:00:01 AM", 1},
+		{"Redo", "POST", "/redo", "", http.StatusOK, "09:05:00 AM", 0},
+	}
+
+	for _, tt := range steps {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(tt.method, "/time/"+created.TimeId+tt.query, strings.NewReader(tt.body)))
+		if rr.Code != tt.expected {
+			t.Errorf("TestSecondsPrecision - %s - Response Status Code: got <%d> want <%d>", tt.name, rr.Code, tt.expected)
+			continue
+		}
+		var tgt CurrentTime
+		if err := json.Unmarshal(rr.Body.Bytes(), &tgt); err != nil {
+			t.Errorf("TestSecondsPrecision - %s - JSON Response Unmarshal failed: <%s>", tt.name, err)
+		}
+		if tgt.CurrentTime != tt.time || tgt.Seconds == nil || *tgt.Seconds != tt.seconds {
+			t.Errorf("TestSecondsPrecision - %s - currentTime: got <%s, %v> want <%s, %d>", tt.name, tgt.CurrentTime, tgt.Seconds, tt.time, tt.seconds)
+		}
+	}
+
+	history, err := db.GetHistory(context.Background(), created.TimeId, backend.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := history[1]; entry.Delta != 0 || entry.DeltaSeconds != 45 || entry.Seconds != 15 {
+		t.Errorf("TestSecondsPrecision - history entry: got <%d, %d, %d> want <%d, %d, %d>", entry.Delta, entry.DeltaSeconds, entry.Seconds, 0, 45, 15)
+	}
+
+	// Timers kept to the minute reject seconds and never show them.
+	invalid := []struct {
+		name string
+		body string
+	}{
+		{"Seconds Without Precision", `{"initialTime":"01:45:30 PM"}`},
+		{"Unknown Precision", `{"initialTime":"01:45 PM","precision":"hours"}`},
+	}
+	for _, tt := range invalid {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", "/time", strings.NewReader(tt.body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("TestSecondsPrecision - %s - Response Status Code: got <%d> want <%d>", tt.name, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/time", strings.NewReader(`{"initialTime":"01:45 PM"}`)))
+	if strings.Contains(rr.Body.String(), "precision") {
+		t.Errorf("TestSecondsPrecision - Minutes - Create: got <%s> want no precision", rr.Body.String())
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("TestSecondsPrecision - Minutes - JSON Response Unmarshal failed: <%s>", err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/time/"+created.TimeId, nil))
+	if body := rr.Body.String(); strings.Contains(body, "seconds") || !strings.Contains(body, `"currentTime":"01:45 PM"`) {
+		t.Errorf("TestSecondsPrecision - Minutes - Get: got <%s> want no seconds", body)
+	}
+}
+
+func TestDayOffset(t *testing.T) {
+	db := backend.NewMemory()
+	router := SetupRoutes(chi.NewMux(), db, zerolog.New(ioutil.Discard), Options{})
+	id := uuid.NewV4().String()
+	if err := db.SetTimeId(context.Background(), id, backend.Record{Minutes: 720}, backend.Change{Op: backend.ChangeCreate}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		time   string
+		offset int
+	}{
+		{"Get", "GET", "", "", "12:00 PM", 0},
+		{"Two Midnights", "PUT", "", `{"addMinutes":3000}`, "02:00 PM", 2},
+		{"Back A Day", "PUT", "", `{"addDuration":"-P1DT2H"}`, "12:00 PM", 1},
+		{"Set Keeps Day", "PUT", "", `{"setTime":"11:00 PM"}`, "11:00 PM", 1},
+		{"Past Midnight", "PUT", "", `{"addMinutes":90}`, "12:30 AM", 2},
+		{"Undo", "POST", "/undo", "", "11:00 PM", 1},
+		{"Before Creation", "PUT", "", `{"add":{"hours":-50}}`, "09:00 PM", -1},
+		{"Get Again", "GET", "", "", "09:00 PM", -1},
+	}
+
+	for _, tt := range steps {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(tt.method, "/time/"+id+tt.path, strings.NewReader(tt.body)))
+		if rr.Code != http.StatusOK {
+			t.Errorf("TestDayOffset - %s - Response Status Code: got <%d> want <%d>", tt.name, rr.Code, http.StatusOK)
+			continue
+		}
+		var tgt CurrentTime
+		if err := json.Unmarshal(rr.Body.Bytes(), &tgt); err != nil {
+			t.Errorf("TestDayOffset - %s - JSON Response Unmarshal failed: <%s>", tt.name, err)
+		}
+		if tgt.CurrentTime != tt.time || tgt.DayOffset != tt.offset {
+			t.Errorf("TestDayOffset - %s - currentTime: got <%s, %d> want <%s, %d>", tt.name, tgt.CurrentTime, tgt.DayOffset, tt.time, tt.offset)
+		}
+	}
+
+	history, err := db.GetHistory(context.Background(), id, backend.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := history[5]; entry.Op != backend.ChangeUndo || entry.Delta != -90 || entry.DayOffset != 1 {
+		t.Errorf("TestDayOffset - history entry: got <%s, %d, %d> want <%s, %d, %d>", entry.Op, entry.Delta, entry.DayOffset, backend.ChangeUndo, -90, 1)
+	}
+}
+
+func TestTimeZones(t *testing.T) {
+	router := SetupRoutes(chi.NewMux(), backend.NewMemory(), zerolog.New(ioutil.Discard), Options{})
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/time", strings.NewReader(`{"initialTime":"11:30 PM","zone":"Europe/Rome","date":"2018-03-24"}`)))
+	var created NewTime
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("TestTimeZones - Create - JSON Response Unmarshal failed: <%s>", err)
+	}
+	if created.Zone != "Europe/Rome" || created.Date != "2018-03-24" {
+		t.Errorf("TestTimeZones - Create: got <%s, %s> want <%s, %s>", created.Zone, created.Date, "Europe/Rome", "2018-03-24")
+	}
+
+	steps := []struct {
+		name      string
+		method    string
+		query     string
+		body      string
+		expected  int
+		offset    string
+		converted *ZonedTime
+	}{
+		{"Get", "GET", "", "", http.StatusOK, "+01:00", nil},
+		{"Convert", "GET", "?tz=Asia/Tokyo", "", http.StatusOK, "+01:00", &ZonedTime{"Asia/Tokyo", "07:30 AM", "2018-03-25", "+09:00"}},
+		{"Convert 24h", "GET", "?tz=UTC&format=24h", "", http.StatusOK, "+01:00", &ZonedTime{"UTC", "22:30", "2018-03-24", "+00:00"}},
+		{"Next Day", "PUT", "", `{"addMinutes":1440}`, http.StatusOK, "+02:00", nil},
+		{"Convert After DST", "GET", "?tz=Asia/Tokyo", "", http.StatusOK, "+02:00", &ZonedTime{"Asia/Tokyo", "06:30 AM", "2018-03-26", "+09:00"}},
+		{"Unknown Zone", "GET", "?tz=Mars/Olympus", "", http.StatusBadRequest, "", nil},
+		{"Host Zone", "GET", "?tz=Local", "", http.StatusBadRequest, "", nil},
+	}
+
+	for _, tt := range steps {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(tt.method, "/time/"+created.TimeId+tt.query, strings.NewReader(tt.body)))
+		if rr.Code != tt.expected {
+			t.Errorf("TestTimeZones - %s - Response Status Code: got <%d> want <%d>", tt.name, rr.Code, tt.expected)
+			continue
+		}
+		if tt.expected != http.StatusOK {
+			continue
+		}
+		var tgt CurrentTime
+		if err := json.Unmarshal(rr.Body.Bytes(), &tgt); err != nil {
+			t.Errorf("TestTimeZones - %s - JSON Response Unmarshal failed: <%s>", tt.name, err)
+		}
+		if tgt.Zone != "Europe/Rome" || tgt.Offset != tt.offset {
+			t.Errorf("TestTimeZones - %s - zone: got <%s, %s> want <%s, %s>", tt.name, tgt.Zone, tgt.Offset, "Europe/Rome", tt.offset)
+		}
+		if (tgt.Converted == nil) != (tt.converted == nil) || (tt.converted != nil && *tgt.Converted != *tt.converted) {
+			t.Errorf("TestTimeZones - %s - converted: got <%+v> want <%+v>", tt.name, tgt.Converted, tt.converted)
+		}
+	}
+
+	invalid := []struct {
+		name string
+		body string
+	}{
+		{"Unknown Zone", `{"initialTime":"11:30 PM","zone":"Mars/Olympus"}`},
+		{"Date Without Zone", `{"initialTime":"11:30 PM","date":"2018-03-24"}`},
+		{"Invalid Date", `{"initialTime":"11:30 PM","zone":"Europe/Rome","date":"24/03/2018"}`},
+	}
+	for _, tt := range invalid {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", "/time", strings.NewReader(tt.body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("TestTimeZones - %s - Response Status Code: got <%d> want <%d>", tt.name, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Timers without a zone cannot be converted.
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/time", nil))
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("TestTimeZones - No Zone - JSON Response Unmarshal failed: <%s>", err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/time/"+created.TimeId+"?tz=Asia/Tokyo", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("TestTimeZones - No Zone - Response Status Code: got <%d> want <%d>", rr.Code, http.StatusBadRequest)
+	}
+
+	// Not even with the tag it would have had.
+	req := httptest.NewRequest("GET", "/time/"+created.TimeId+"?tz=Asia/Tokyo", nil)
+	req.Header.Set("If-None-Match", `"1;tz=Asia/Tokyo"`)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("TestTimeZones - No Zone If-None-Match - Response Status Code: got <%d> want <%d>", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGetTimeHistoryHandler(t *testing.T) {
+	values := []struct {
+		name     string
+		query    string
+		handler  TimeHandler
+		expected int
+		seqs     []int64
+		cursor   string
+	}{
+		{"Success", "", testTimeHandler, http.StatusOK, []int64{1, 2, 3}, ""},
+		{"First Page", "?limit=2", testTimeHandler, http.StatusOK, []int64{1, 2}, "2"},
+		{"Last Page", "?limit=2&cursor=2", testTimeHandler, http.StatusOK, []int64{3}, ""},
+		{"Time Range", "?from=2018-06-01T00:00:00Z&to=2018-06-02T00:00:00Z", testTimeHandler, http.StatusOK, []int64{1, 2, 3}, ""},
+		{"Invalid Limit", "?limit=0", testTimeHandler, http.StatusBadRequest, nil, ""},
+		{"Limit Too Large", "?limit=1001", testTimeHandler, http.StatusBadRequest, nil, ""},
+		{"Invalid Cursor", "?cursor=abc", testTimeHandler, http.StatusBadRequest, nil, ""},
+		{"Invalid From", "?from=yesterday", testTimeHandler, http.StatusBadRequest, nil, ""},
+		{"timeId Not Found", "", notFoundTestTimeHandler, http.StatusNotFound, nil, ""},
+		{"DB Failure", "", failingTestTimeHandler, http.StatusInternalServerError, nil, ""},
+	}
+
+	for _, tt := range values {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest("GET", "/time/history"+tt.query, nil)
+			if err != nil {
+				t.Error(err)
+			}
+			ctx := chi.NewRouteContext()
+			ctx.URLParams.Add("timeId", uuid.NewV4().String())
+			req := r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, ctx))
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(tt.handler.GetTimeHistory).ServeHTTP(rr, req)
+			if rr.Code != tt.expected {
+				t.Errorf("TestGetTimeHistoryHandler - %s - Response Status Code: got <%d> want <%d>", tt.name, rr.Code, tt.expected)
+			}
+			if tt.expected != http.StatusOK {
+				return
+			}
+
+			var tgt History
+			if err := json.Unmarshal(rr.Body.Bytes(), &tgt); err != nil {
+				t.Errorf("TestGetTimeHistoryHandler - %s - JSON Response Unmarshal failed: <%s>", tt.name, err)
+			}
+			var seqs []int64
+			for _, e := range tgt.Entries {
+				seqs = append(seqs, e.Seq)
+			}
+			if fmt.Sprint(seqs) != fmt.Sprint(tt.seqs) {
+				t.Errorf("TestGetTimeHistoryHandler - %s - entries: got <%v> want <%v>", tt.name, seqs, tt.seqs)
+			}
+			if tgt.NextCursor != tt.cursor {
+				t.Errorf("TestGetTimeHistoryHandler - %s - nextCursor: got <%s> want <%s>", tt.name, tgt.NextCursor, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestListTimesHandler(t *testing.T) {
+	mux := chi.NewMux()
+	db := backend.NewMemory()
+	rtr := SetupRoutes(mux, db, zerolog.New(ioutil.Discard), Options{})
+
+	create := func(body string) {
+		req, _ := http.NewRequest("POST", "/time", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		rtr.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("TestListTimesHandler - Create: got <%d> want <%d>", rr.Code, http.StatusOK)
+		}
+	}
+	create(`{"initialTime":"09:00 AM","label":"standup"}`)
+	create(`{"initialTime":"11:30 PM","label":"standup"}`)
+	create(`{"initialTime":"01:00 PM"}`)
+
+	list := func(query string) (int, TimeList) {
+		req, _ := http.NewRequest("GET", "/time"+query, nil)
+		rr := httptest.NewRecorder()
+		rtr.ServeHTTP(rr, req)
+		var res TimeList
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+				t.Errorf("TestListTimesHandler - %s - Unmarshal: %v", query, err)
+			}
+		}
+		return rr.Code, res
+	}
+
+	values := []struct {
+		name     string
+		query    string
+		status   int
+		expected int
+	}{
+		{"All", "", http.StatusOK, 3},
+		{"Label", "?label=standup", http.StatusOK, 2},
+		{"Range", "?from=08:00%20AM&to=02:00%20PM", http.StatusOK, 2},
+		{"Wrapping Range", "?from=11:00%20PM&to=10:00%20AM", http.StatusOK, 2},
+		{"Created Before", "?createdBefore=2000-01-01T00:00:00Z", http.StatusOK, 0},
+		{"Only From", "?from=08:00%20AM", http.StatusBadRequest, 0},
+		{"Invalid Limit", "?limit=0", http.StatusBadRequest, 0},
+		{"Invalid Cursor", "?cursor=!!", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range values {
+		t.Run(tt.name, func(t *testing.T) {
+			status, res := list(tt.query)
+			if status != tt.status {
+				t.Errorf("TestListTimesHandler - %s - Response Status Code: got <%d> want <%d>", tt.name, status, tt.status)
+			}
+			if len(res.TimeIds) != tt.expected {
+				t.Errorf("TestListTimesHandler - %s - TimeIds: got <%d> want <%d>", tt.name, len(res.TimeIds), tt.expected)
+			}
+		})
+	}
+
+	t.Run("Pagination", func(t *testing.T) {
+		seen := map[string]bool{}
+		query := "?limit=2"
+		for pages := 0; ; pages++ {
+			if pages > 3 {
+				t.Fatalf("TestListTimesHandler - Pagination: cursor did not terminate")
+			}
+			status, res := list(query)
+			if status != http.StatusOK {
+				t.Fatalf("TestListTimesHandler - Pagination - Response Status Code: got <%d> want <%d>", status, http.StatusOK)
+			}
+			for _, lt := range res.TimeIds {
+				if seen[lt.TimeId] {
+					t.Errorf("TestListTimesHandler - Pagination: got <%s> twice", lt.TimeId)
+				}
+				seen[lt.TimeId] = true
+			}
+			if res.NextCursor == "" {
+				break
+			}
+			query = "?limit=2&cursor=" + res.NextCursor
+		}
+		if len(seen) != 3 {
+			t.Errorf("TestListTimesHandler - Pagination: got <%d> want <%d>", len(seen), 3)
+		}
+	})
+}
+
+func TestBatchHandlers(t *testing.T) {
+	mux := chi.NewMux()
+	rtr := SetupRoutes(mux, backend.NewMemory(), zerolog.New(ioutil.Discard), Options{})
+
+	batch := func(path, body string) (int, BatchResult) {
+		req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		rtr.ServeHTTP(rr, req)
+		var res BatchResult
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+				t.Errorf("TestBatchHandlers - %s - Unmarshal: %v", path, err)
+			}
+		}
+		return rr.Code, res
+	}
+	statuses := func(res BatchResult) []int {
+		codes := make([]int, len(res.Items))
+		for i, item := range res.Items {
+			codes[i] = item.Status
+		}
+		return codes
+	}
+
+	status, created := batch("/time:batchCreate", `{"times":[{"initialTime":"09:00 AM"},{"initialTime":"25:00 PM"},{"initialTime":"01:15 PM","label":"batch"}]}`)
+	if status != http.StatusOK {
+		t.Fatalf("TestBatchHandlers - Create - Response Status Code: got <%d> want <%d>", status, http.StatusOK)
+	}
+	if got := fmt.Sprint(statuses(created)); got != "[200 400 200]" {
+		t.Fatalf("TestBatchHandlers - Create - Statuses: got <%s> want <%s>", got, "[200 400 200]")
+	}
+	if created.Items[0].CurrentTime == nil || created.Items[0].CurrentTime.CurrentTime != "09:00 AM" {
+		t.Errorf("TestBatchHandlers - Create - Time: got <%v> want <%s>", created.Items[0].CurrentTime, "09:00 AM")
+	}
+	if created.Items[1].TimeId != "" || created.Items[1].Error == "" {
+		t.Errorf("TestBatchHandlers - Create - Invalid Item: got <%+v>", created.Items[1])
+	}
+	first, last := created.Items[0].TimeId, created.Items[2].TimeId
+	missing := uuid.NewV4().String()
+
+	values := []struct {
+		name     string
+		path     string
+		body     string
+		status   int
+		statuses string
+	}{
+		{"Get", "/time:batchGet", `{"timeIds":["` + last + `","` + missing + `","bad"]}`, http.StatusOK, "[200 404 400]"},
+		{"Get - Empty", "/time:batchGet", `{"timeIds":[]}`, http.StatusBadRequest, "[]"},
+		{"Get - Repeated", "/time:batchGet", `{"timeIds":["` + first + `","` + first + `"]}`, http.StatusBadRequest, "[]"},
+		{"Get - No Body", "/time:batchGet", ``, http.StatusBadRequest, "[]"},
+		{"Delete", "/time:batchDelete", `{"timeIds":["` + first + `","` + missing + `"]}`, http.StatusOK, "[204 404]"},
+		{"Get - After Delete", "/time:batchGet", `{"timeIds":["` + first + `","` + last + `"]}`, http.StatusOK, "[404 200]"},
+		{"Create - Empty", "/time:batchCreate", `{"times":[]}`, http.StatusBadRequest, "[]"},
+	}
+
+	for _, tt := range values {
+		t.Run(tt.name, func(t *testing.T) {
+			status, res := batch(tt.path, tt.body)
+			if status != tt.status {
+				t.Errorf("TestBatchHandlers - %s - Response Status Code: got <%d> want <%d>", tt.name, status, tt.status)
+			}
+			if got := fmt.Sprint(statuses(res)); got != tt.statuses {
+				t.Errorf("TestBatchHandlers - %s - Statuses: got <%s> want <%s>", tt.name, got, tt.statuses)
+			}
+		})
+	}
+
+	t.Run("Backend Failure", func(t *testing.T) {
+		rtr := SetupRoutes(chi.NewMux(), &testBackend{err: backend.ErrUnavailable}, zerolog.New(ioutil.Discard), Options{})
+		req, _ := http.NewRequest("POST", "/time:batchGet", strings.NewReader(`{"timeIds":["`+first+`"]}`))
+		rr := httptest.NewRecorder()
+		rtr.ServeHTTP(rr, req)
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("TestBatchHandlers - Backend Failure - Response Status Code: got <%d> want <%d>", rr.Code, http.StatusServiceUnavailable)
+		}
+	})
+}
+
+func TestExportImportHandlers(t *testing.T) {
+	ctx := context.Background()
+	src := backend.NewMemory()
+	id := uuid.NewV4().String()
+	if err := src.SetTimeId(ctx, id, backend.Record{Minutes: 540}, backend.Change{Op: backend.ChangeCreate}); err != nil {
+		t.Fatal(err)
+	}
+	rtr := SetupRoutes(chi.NewMux(), src, zerolog.New(ioutil.Discard), Options{Transfer: true})
+
+	req, _ := http.NewRequest("GET", "/admin/export", nil)
+	rr := httptest.NewRecorder()
+	rtr.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("TestExportImportHandlers - Export - Response Status Code: got <%d> want <%d>", rr.Code, http.StatusOK)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("TestExportImportHandlers - Export - Content-Type: got <%s> want <%s>", ct, "application/x-ndjson")
+	}
+	export := rr.Body.String()
+
+	values := []struct {
+		name     string
+		query    string
+		body     string
+		status   int
+		expected string
+	}{
+		{"Import", "", export, http.StatusOK, `{"imported":1,"overwritten":0,"skipped":0}`},
+		{"Import - Skip", "", export, http.StatusOK, `{"imported":0,"overwritten":0,"skipped":1}`},
+		{"Import - Overwrite", "?onConflict=overwrite", export, http.StatusOK, `{"imported":0,"overwritten":1,"skipped":0}`},
+		{"Import - Fail", "?onConflict=fail", export, http.StatusConflict, ""},
+		{"Import - Invalid Line", "", "not json\n", http.StatusBadRequest, ""},
+		{"Import - Unknown Policy", "?onConflict=merge", export, http.StatusBadRequest, ""},
+	}
+
+	dst := SetupRoutes(chi.NewMux(), backend.NewMemory(), zerolog.New(ioutil.Discard), Options{Transfer: true})
+	for _, tt := range values {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/admin/import"+tt.query, strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			dst.ServeHTTP(rr, req)
+			if rr.Code != tt.status {
+				t.Errorf("TestExportImportHandlers - %s - Response Status Code: got <%d> want <%d>", tt.name, rr.Code, tt.status)
+			}
+			if tt.expected != "" && rr.Body.String() != tt.expected {
+				t.Errorf("TestExportImportHandlers - %s - Body: got <%s> want <%s>", tt.name, rr.Body.String(), tt.expected)
+			}
+		})
+	}
+
+	t.Run("Export - Unsupported", func(t *testing.T) {
+		rtr := SetupRoutes(chi.NewMux(), &testBackend{err: backend.ErrUnsupported}, zerolog.New(ioutil.Discard), Options{Transfer: true})
+		req, _ := http.NewRequest("GET", "/admin/export", nil)
+		rr := httptest.NewRecorder()
+		rtr.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNotImplemented {
+			t.Errorf("TestExportImportHandlers - Export - Unsupported: got <%d> want <%d>", rr.Code, http.StatusNotImplemented)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		rtr := SetupRoutes(chi.NewMux(), src, zerolog.New(ioutil.Discard), Options{})
+		for _, req := range []*http.Request{
+			httptest.NewRequest("GET", "/admin/export", nil),
+			httptest.NewRequest("POST", "/admin/import", strings.NewReader(export)),
+		} {
+			rr := httptest.NewRecorder()
+			rtr.ServeHTTP(rr, req)
+			if rr.Code != http.StatusNotFound {
+				t.Errorf("TestExportImportHandlers - Disabled - %s %s: got <%d> want <%d>", req.Method, req.URL.Path, rr.Code, http.StatusNotFound)
+			}
+		}
+	})
+}
+
+func TestBadRequestErrors(t *testing.T) {
+	id := uuid.NewV4().String()
+	values := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		expected string
+	}{
+		{"Create", "POST", "/time/?format=bogus", "", `unknown format "bogus"`},
+		{"Get", "GET", "/time/abc", "", "invalid timeId"},
+		{"Change", "PUT", "/time/" + id + "?format=bogus", `{"addMinutes":1}`, `unknown format "bogus"`},
+		{"Change Without Body", "PUT", "/time/" + id, "", "missing request body"},
+		{"Delete", "DELETE", "/time/abc", "", "invalid timeId"},
+		{"List", "GET", "/time/?limit=0", "", "limit must be between 1 and 1000"},
+		{"History", "GET", "/time/" + id + "/history?cursor=abc", "", "invalid cursor"},
+		{"Undo", "POST", "/time/abc/undo", "", "invalid timeId"},
+		{"Redo", "POST", "/time/" + id + "/redo?format=bogus", "", `unknown format "bogus"`},
+		{"Batch Create", "POST", "/time:batchCreate", `{"times":[]}`, "batches must hold between 1 and 1000 times"},
+		{"Batch Get", "POST", "/time:batchGet", "", "missing request body"},
+		{"Batch Delete", "POST", "/time:batchDelete", `{"timeIds":["` + id + `","` + id + `"]}`, "timeId " + id + " repeated"},
+		{"Import", "POST", "/admin/import?onConflict=bogus", "", `unknown onConflict "bogus"`},
+	}
+
+	rtr := SetupRoutes(chi.NewMux(), &testBackend{}, zerolog.New(ioutil.Discard), Options{Transfer: true})
+	for _, tt := range values {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			rtr.ServeHTTP(rr, req)
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("TestBadRequestErrors - %s - Response Status Code: got <%d> want <%d>", tt.name, rr.Code, http.StatusBadRequest)
+			}
+			var res ErrorResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+				t.Errorf("TestBadRequestErrors - %s - JSON Response Unmarshal failed: <%s>", tt.name, err)
+			}
+			if res.Error != tt.expected {
+				t.Errorf("TestBadRequestErrors - %s - Error: got <%s> want <%s>", tt.name, res.Error, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBackendErrorStatus(t *testing.T) {
+	values := []struct {
+		err        error
+		expected   int
+		retryAfter string
+	}{
+		{backend.ErrNotFound, http.StatusNotFound, ""},
+		{errors.Wrap(backend.ErrNotFound, "wrapped"), http.StatusNotFound, ""},
+		{backend.ErrConflict, http.StatusConflict, ""},
+		{backend.ErrUnavailable, http.StatusServiceUnavailable, ""},
+		{backend.ErrCorrupt, http.StatusInternalServerError, ""},
+		{backend.ErrInvalidCursor, http.StatusBadRequest, ""},
+		{backend.ErrUnsupported, http.StatusNotImplemented, ""},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, ""},
+		{context.Canceled, StatusClientClosedRequest, ""},
+		{fmt.Errorf("Err"), http.StatusInternalServerError, ""},
+		{backend.WithRetryAfter(errors.Wrap(backend.ErrUnavailable, "breaker open"), 1500*time.Millisecond), http.StatusServiceUnavailable, "2"},
+		{backend.WithRetryAfter(backend.ErrUnavailable, 0), http.StatusServiceUnavailable, "1"},
+	}
+
+	for _, tt := range values {
+		h := TimeHandler{Db: &testBackend{err: tt.err}}
+
+		r, err := http.NewRequest("GET", "/time", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		ctx := chi.NewRouteContext()
+		ctx.URLParams.Add("timeId", uuid.NewV4().String())
+		req := r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, ctx))
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(h.GetTime).ServeHTTP(rr, req)
+		if rr.Code != tt.expected {
+			t.Errorf("TestBackendErrorStatus(%v) - Response Status Code: got <%d> want <%d>", tt.err, rr.Code, tt.expected)
+		}
+		if got := rr.Header().Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("TestBackendErrorStatus(%v) - Retry-After: got <%s> want <%s>", tt.err, got, tt.retryAfter)
+		}
+	}
+}
+
+func TestRouteTimeout(t *testing.T) {
+	mux := chi.NewMux()
+	logger := zerolog.New(ioutil.Discard)
+	rtr := SetupRoutes(mux, &testBackend{slow: true}, logger, Options{
+		Timeouts:       map[string]time.Duration{"getTime": 10 * time.Millisecond},
+		DefaultTimeout: 20 * time.Millisecond,
+	})
+
+	values := []struct {
+		method string
+		body   string
+	}{
+		{"GET", ""},
+		{"PUT", `{"addMinutes":1}`},
+		{"DELETE", ""},
+	}
+
+	for _, tt := range values {
+		req, err := http.NewRequest(tt.method, "/time/"+uuid.NewV4().String(), strings.NewReader(tt.body))
+		if err != nil {
+			t.Error(err)
+		}
+
+		rr := httptest.NewRecorder()
+		rtr.ServeHTTP(rr, req)
+		if rr.Code != http.StatusGatewayTimeout {
+			t.Errorf("TestRouteTimeout - %s - Response Status Code: got <%d> want <%d>", tt.method, rr.Code, http.StatusGatewayTimeout)
+		}
+	}
+}
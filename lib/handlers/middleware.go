@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// StatusClientClosedRequest is the non-standard status logged when the client
+// goes away before the response is written.
+const StatusClientClosedRequest = 499
+
+// Timeout bounds the request context to d. Backend calls observe the deadline
+// and handlers respond with 504 Gateway Timeout once it passes. A zero
+// duration leaves the request unbounded.
+func Timeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if d <= 0 {
+			return next
+		}
+
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
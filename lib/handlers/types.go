@@ -1,34 +1,227 @@
 package handlers
 
 import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+	"github.com/mdellandrea/minutes-server/lib/transfer"
+
 	"github.com/rs/zerolog"
 )
 
+// Backend is the data store for timeIds. Implementations report failures as
+// the error kinds defined in the backend package, or the context's error once
+// ctx is done.
 type Backend interface {
-	SetTimeId(id, val string) error
-	GetTimeId(id string) (string, error)
-	DeleteTimeId(id string) error
-	NotFoundErrCheck(err error) bool
+	// Ping checks that the data store can be reached.
+	Ping(ctx context.Context) error
+	// SetTimeId, UpdateTimeId and DeleteTimeId append the change they make to
+	// the history of the timeId atomically with the write itself.
+	SetTimeId(ctx context.Context, id string, rec backend.Record, change backend.Change) error
+	GetTimeId(ctx context.Context, id string) (backend.Record, error)
+	// UpdateTimeId atomically replaces the record of an existing timeId with
+	// the result of fn applied to its current record. fn may be called more
+	// than once if the update has to be retried.
+	UpdateTimeId(ctx context.Context, id string, fn func(current backend.Record) (backend.Record, backend.Change, error)) (backend.Record, error)
+	// DeleteTimeId removes a timeId. When fn is not nil it is called with the
+	// current record and the delete is abandoned with its error, atomically
+	// with respect to other writes.
+	DeleteTimeId(ctx context.Context, id string, fn func(current backend.Record) error, change backend.Change) error
+	// GetHistory returns the entries of the history of a timeId selected by
+	// q, in order. It fails with backend.ErrNotFound if the timeId has no
+	// history at all.
+	GetHistory(ctx context.Context, id string, q backend.HistoryQuery) ([]backend.HistoryEntry, error)
+	// ListTimeIds returns a page of the live timeIds selected by q together
+	// with the cursor of the next page, which is empty on the last one.
+	ListTimeIds(ctx context.Context, q backend.ListQuery) ([]backend.Listing, string, error)
+	// SetTimeIds, GetTimeIds and DeleteTimeIds are the batch forms of
+	// SetTimeId, GetTimeId and DeleteTimeId. They return one item per timeId,
+	// in order, holding the error of each timeId that failed; the error
+	// returned alongside means the batch failed as a whole. The timeIds of a
+	// batch must be distinct.
+	SetTimeIds(ctx context.Context, items []backend.BatchItem, change backend.Change) ([]backend.BatchItem, error)
+	GetTimeIds(ctx context.Context, ids []string) ([]backend.BatchItem, error)
+	DeleteTimeIds(ctx context.Context, ids []string, change backend.Change) ([]backend.BatchItem, error)
+	// ImportTimeId stores rec under id exactly as given, for restoring
+	// exports. Unless overwrite is set it fails with backend.ErrExists if
+	// the timeId is live.
+	ImportTimeId(ctx context.Context, id string, rec backend.Record, overwrite bool, change backend.Change) error
+}
+
+// Options tune the routes registered by SetupRoutes.
+type Options struct {
+	// DefaultTTL applies to new timeIds created without a ttl. Zero means
+	// they never expire.
+	DefaultTTL time.Duration
+	// Timeouts bound the handling of each operation, keyed by its operationId
+	// in openapi.yaml. Operations without an entry use DefaultTimeout, and a
+	// zero duration disables the timeout.
+	Timeouts       map[string]time.Duration
+	DefaultTimeout time.Duration
+	// Chaos serves /admin/chaos, which controls the faults injected into the
+	// backend. It is only set when fault injection is enabled.
+	Chaos http.Handler
+	// Transfer mounts /admin/export and /admin/import. They are not
+	// authenticated, so only enable them behind a listener that is.
+	Transfer bool
 }
 
 type TimeHandler struct {
 	Db  Backend
 	Log zerolog.Logger
+	// DefaultTTL applies to new timeIds created without a ttl. Zero means
+	// they never expire.
+	DefaultTTL time.Duration
 }
 
 type NewTimeRequest struct {
 	InitialTime string `json:"initialTime"`
+	Label       string `json:"label"`
+	// TTL is the lifetime of the timeId in seconds.
+	TTL int `json:"ttl"`
+	// Format is the output format of the timeId, "12h" or "24h", used when
+	// requests do not ask for one.
+	Format string `json:"format"`
+	// Precision "seconds" keeps the time to the second. Times with seconds
+	// are only accepted, and shown, for such timeIds.
+	Precision string `json:"precision"`
+	// Zone is an IANA time zone, e.g. "Europe/Rome", that places the timeId
+	// on real dates, starting from Date as YYYY-MM-DD. Date defaults to the
+	// current date in the zone and may only be given with a zone.
+	Zone string `json:"zone"`
+	Date string `json:"date"`
 }
 
 type NewTime struct {
-	TimeId      string `json:"timeId"`
-	CurrentTime string `json:"currentTime"`
+	TimeId      string     `json:"timeId"`
+	CurrentTime string     `json:"currentTime"`
+	Label       string     `json:"label,omitempty"`
+	Format      string     `json:"format,omitempty"`
+	Precision   string     `json:"precision,omitempty"`
+	Zone        string     `json:"zone,omitempty"`
+	Date        string     `json:"date,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
 }
 
 type CurrentTime struct {
 	CurrentTime string `json:"currentTime"`
+	// Minutes is the current time as minutes since midnight.
+	Minutes int `json:"minutes"`
+	// Seconds is the number of seconds past Minutes. It and Precision are
+	// only set for timeIds kept to the second.
+	Seconds   *int   `json:"seconds,omitempty"`
+	Precision string `json:"precision,omitempty"`
+	// DayOffset counts the midnights the time crossed since the timeId was
+	// created, negative when it went back before that day.
+	DayOffset int `json:"dayOffset"`
+	// CreatedAt and UpdatedAt are omitted for timeIds stored before they
+	// were tracked, until their next change.
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+	Version   int64      `json:"version"`
+	Label     string     `json:"label,omitempty"`
+	// Format is the output format stored for the timeId, omitted if it has
+	// none.
+	Format string `json:"format,omitempty"`
+	// Zone is the time zone of the timeId, if any. Date is then the date of
+	// the current time in that zone, and Offset its UTC offset, e.g. "+02:00".
+	Zone   string `json:"zone,omitempty"`
+	Date   string `json:"date,omitempty"`
+	Offset string `json:"offset,omitempty"`
+	// Converted is the current time in the zone asked for with tz.
+	Converted *ZonedTime `json:"converted,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// ZonedTime is the current time of a zoned timeId as seen in another zone.
+type ZonedTime struct {
+	Zone        string `json:"zone"`
+	CurrentTime string `json:"currentTime"`
+	Date        string `json:"date"`
+	Offset      string `json:"offset"`
+}
+
+type ListedTime struct {
+	TimeId string `json:"timeId"`
+	CurrentTime
 }
 
+type TimeList struct {
+	TimeIds []ListedTime `json:"timeIds"`
+	// NextCursor is passed as the cursor parameter to fetch the next page. It
+	// is omitted on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// ChangeTimeRequest moves the time by one of AddMinutes, AddSeconds,
+// AddDuration and Add, or replaces it with SetTime. At most one of them may
+// be given. Only timeIds kept to the second can be moved by part of a minute.
 type ChangeTimeRequest struct {
-	AddMinutes int `json:"addMinutes"`
+	AddMinutes *int `json:"addMinutes"`
+	AddSeconds *int `json:"addSeconds"`
+	// AddDuration is an ISO 8601 duration to add, e.g. "PT1H30M" or "-P1DT2H".
+	AddDuration string `json:"addDuration"`
+	// Add is a duration to add given in several units.
+	Add *Delta `json:"add"`
+	// SetTime, when present, replaces the current time instead of adding to it.
+	SetTime string `json:"setTime"`
+	// TTL, when present, restarts the lifetime of the timeId at this many seconds.
+	TTL *int `json:"ttl"`
+	// Label, when present, replaces the label. The empty string removes it.
+	Label *string `json:"label"`
+	// Format, when present, replaces the output format. The empty string
+	// returns to the default.
+	Format *string `json:"format"`
+}
+
+// Delta is a duration given in several units, which are added up. Units may
+// be negative.
+type Delta struct {
+	Hours   int `json:"hours"`
+	Minutes int `json:"minutes"`
+	Seconds int `json:"seconds"`
+}
+
+// ErrorResponse explains why a request was rejected.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type History struct {
+	Entries []backend.HistoryEntry `json:"entries"`
+	// NextCursor is passed as the cursor parameter to fetch the next page. It
+	// is omitted on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+type ImportResult struct {
+	transfer.Summary
+	// Error describes why the import stopped early. The counts cover the
+	// lines applied before it.
+	Error string `json:"error,omitempty"`
+}
+
+type BatchCreateRequest struct {
+	Times []NewTimeRequest `json:"times"`
+}
+
+type BatchTimeIdsRequest struct {
+	TimeIds []string `json:"timeIds"`
+}
+
+// BatchResult reports the outcome of every item of a batch request, in the
+// order of the request.
+type BatchResult struct {
+	Items []BatchItemResult `json:"items"`
+}
+
+// BatchItemResult holds the status the single-item request would have
+// responded with. The time is only included for items created or read.
+type BatchItemResult struct {
+	TimeId string `json:"timeId,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	*CurrentTime
 }
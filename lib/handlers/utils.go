@@ -2,53 +2,107 @@ package handlers
 
 import (
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/hlog"
 )
 
 var timeFormatValidator = regexp.MustCompile(`(\d{2}):(\d{2})\s([AaPp][Mm])`)
 
-func validTimeFormat(timeStr string) bool {
-	if !timeFormatValidator.MatchString(timeStr) {
-		return false
-	}
-	matches := timeFormatValidator.FindStringSubmatch(timeStr)
-	h, _ := strconv.Atoi(matches[1]) // Hours
-	m, _ := strconv.Atoi(matches[2]) // Minutes
-	if h > 12 || h < 1 {
-		return false
-	}
-	if m > 59 || m < 0 {
-		return false
-	}
+// time24Validator matches the 24-hour clock, e.g. "13:45", "9:05" or, with
+// seconds, "13:45:30". Unlike the 12-hour form it must match the whole string.
+var time24Validator = regexp.MustCompile(`^(\d{1,2}):(\d{2})(?::(\d{2}))?$`)
+
+// time12SecondsValidator matches the 12-hour clock with seconds, e.g.
+// "01:45:30 PM".
+var time12SecondsValidator = regexp.MustCompile(`^(\d{2}):(\d{2}):(\d{2})\s([AaPp][Mm])$`)
+
+// Output formats of times of day. Timers without a format of their own use
+// format12h.
+const (
+	format12h = "12h"
+	format24h = "24h"
+)
 
-	return true
+func validTimeFormat(timeStr string) bool {
+	_, _, ok := parseTime(timeStr)
+	return ok
 }
 
-func calculateTime(timeStr string, change int) string {
-	start := timeToMinutes(timeStr)
-	// 1440 minutes == 24 hours
-	ch := change % 1440
-	diff := (start + ch) % 1440
+// timeHasSeconds reports whether a valid time gives seconds, which only
+// timers with seconds precision accept.
+func timeHasSeconds(timeStr string) bool {
+	_, withSeconds, _ := parseTime(timeStr)
+	return withSeconds
+}
 
-	if diff < 0 {
-		diff = diff + 1440
+// parseTime converts a time in either clock, with or without seconds, to
+// seconds since midnight. ok is false if the time is invalid.
+func parseTime(timeStr string) (second int, withSeconds bool, ok bool) {
+	if matches := time12SecondsValidator.FindStringSubmatch(timeStr); matches != nil {
+		h, _ := strconv.Atoi(matches[1]) // Hours
+		m, _ := strconv.Atoi(matches[2]) // Minutes
+		s, _ := strconv.Atoi(matches[3]) // Seconds
+		if h > 12 || h < 1 || m > 59 || s > 59 {
+			return 0, false, false
+		}
+		return clock12ToMinutes(h, m, matches[4])*60 + s, true, true
 	}
 
-	return minutesToTime(diff)
-}
+	if matches := time24Validator.FindStringSubmatch(timeStr); matches != nil {
+		h, _ := strconv.Atoi(matches[1]) // Hours
+		m, _ := strconv.Atoi(matches[2]) // Minutes
+		if h > 23 || m > 59 {
+			return 0, false, false
+		}
+		if matches[3] == "" {
+			return (h*60 + m) * 60, false, true
+		}
+		s, _ := strconv.Atoi(matches[3]) // Seconds
+		if s > 59 {
+			return 0, false, false
+		}
+		return (h*60+m)*60 + s, true, true
+	}
 
-func timeToMinutes(timeStr string) int {
+	// The 12-hour form is not anchored, so it would find "02:03 PM" within
+	// a malformed time with seconds such as "1:02:03 PM".
+	if strings.Count(timeStr, ":") > 1 {
+		return 0, false, false
+	}
 	matches := timeFormatValidator.FindStringSubmatch(timeStr)
+	if matches == nil {
+		return 0, false, false
+	}
 	h, _ := strconv.Atoi(matches[1]) // Hours
 	m, _ := strconv.Atoi(matches[2]) // Minutes
+	if h > 12 || h < 1 {
+		return 0, false, false
+	}
+	if m > 59 || m < 0 {
+		return 0, false, false
+	}
+	return clock12ToMinutes(h, m, matches[3]) * 60, false, true
+}
 
+// clock12ToMinutes converts an hour and minute of the 12-hour clock to
+// minutes since midnight.
+func clock12ToMinutes(h int, m int, meridiem string) int {
 	if h == 12 {
 		h = 0
 	}
 
 	var mm int
-	switch v := matches[3]; v {
+	switch v := strings.ToUpper(meridiem); v {
 	case "AM":
 		mm = 0
 	case "PM":
@@ -58,6 +112,43 @@ func timeToMinutes(timeStr string) int {
 	return ((h + mm) * 60) + m
 }
 
+// validFormat reports whether format names an output format. The empty
+// string stands for the default.
+func validFormat(format string) bool {
+	return format == "" || format == format12h || format == format24h
+}
+
+// addSeconds moves a time given in seconds since midnight by change seconds,
+// wrapping around midnight in either direction. days is the number of
+// midnights crossed, negative when moving back.
+func addSeconds(start int, change int) (second int, days int) {
+	// 86400 seconds == 24 hours
+	days = change / 86400
+	second = start + change%86400
+	switch {
+	case second < 0:
+		second += 86400
+		days--
+	case second >= 86400:
+		second -= 86400
+		days++
+	}
+	return second, days
+}
+
+// timeToMinutes converts a valid time in either clock to minutes since
+// midnight, dropping any seconds.
+func timeToMinutes(timeStr string) int {
+	return timeToSeconds(timeStr) / 60
+}
+
+// timeToSeconds converts a valid time in either clock to seconds since
+// midnight.
+func timeToSeconds(timeStr string) int {
+	second, _, _ := parseTime(timeStr)
+	return second
+}
+
 func minutesToTime(minutes int) string {
 	var x = minutes
 	var mm = "AM"
@@ -76,3 +167,433 @@ func minutesToTime(minutes int) string {
 
 	return fmt.Sprintf("%02d:%02d %s", h, m, mm)
 }
+
+// minutesToTime24 renders minutes since midnight on the 24-hour clock.
+func minutesToTime24(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// formatTime renders minutes since midnight in format, or in the default
+// format if it is empty.
+func formatTime(minutes int, format string) string {
+	if format == format24h {
+		return minutesToTime24(minutes)
+	}
+	return minutesToTime(minutes)
+}
+
+// formatSeconds renders seconds since midnight in format, like formatTime
+// but with the seconds, e.g. "01:45:30 PM" or "13:45:30".
+func formatSeconds(second int, format string) string {
+	minutes, s := second/60, second%60
+	if format == format24h {
+		return fmt.Sprintf("%s:%02d", minutesToTime24(minutes), s)
+	}
+	t := minutesToTime(minutes)
+	return fmt.Sprintf("%s:%02d%s", t[:5], s, t[5:])
+}
+
+// validPrecision reports whether precision can be given to a new timer. The
+// empty string keeps it to the minute.
+func validPrecision(precision string) bool {
+	return precision == "" || precision == backend.PrecisionSeconds
+}
+
+// requestedFormat returns the output format asked for by r, or the empty
+// string if it leaves the choice to the timer. The format query parameter
+// takes precedence over a profile parameter of the Accept header, as in
+// "application/json; profile=24h". Only an invalid query parameter is an
+// error; unknown profiles are ignored like any other media type parameter.
+func requestedFormat(r *http.Request) (string, error) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		if !validFormat(f) {
+			return "", errors.Errorf("unknown format %q", f)
+		}
+		return f, nil
+	}
+
+	for _, accept := range r.Header["Accept"] {
+		for _, mediaType := range strings.Split(accept, ",") {
+			params := strings.Split(mediaType, ";")
+			for _, p := range params[1:] {
+				kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+				if len(kv) != 2 || strings.ToLower(kv[0]) != "profile" {
+					continue
+				}
+				if f := strings.Trim(kv[1], `"`); f != "" && validFormat(f) {
+					return f, nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// isoDuration matches ISO 8601 durations. Years and months are matched only
+// to reject them with a clear error, since they have no fixed length.
+var isoDuration = regexp.MustCompile(`^([+-])?P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// maxDeltaUnits bounds each number of a duration, keeping sums far from
+// overflowing.
+const maxDeltaUnits = 1000000000
+
+// maxDeltaSeconds bounds how far a single change moves the time, about 31
+// years, which keeps the seconds and days it adds up to within range.
+const maxDeltaSeconds = 1000000000
+
+// parseISODuration returns the length of an ISO 8601 duration in seconds. A
+// day is 24 hours and a week 7 days; years and months are not supported.
+func parseISODuration(s string) (int64, error) {
+	matches := isoDuration.FindStringSubmatch(s)
+	if matches == nil || strings.HasSuffix(s, "P") || strings.HasSuffix(s, "T") {
+		return 0, errors.Errorf("%q is not an ISO 8601 duration such as PT1H30M", s)
+	}
+	if matches[2] != "" || matches[3] != "" {
+		return 0, errors.Errorf("%q uses years or months, which have no fixed length", s)
+	}
+
+	var total int64
+	for i, unit := range []int64{0, 0, 0, 0, 7 * 86400, 86400, 3600, 60, 1} {
+		if i < 4 || matches[i] == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(matches[i], 10, 64)
+		if err != nil || n > maxDeltaUnits {
+			return 0, errors.Errorf("%q is out of range", s)
+		}
+		total += n * unit
+	}
+	if matches[1] == "-" {
+		total = -total
+	}
+	return total, nil
+}
+
+// seconds returns the length of d in seconds.
+func (d Delta) seconds() (int64, error) {
+	for _, n := range []int{d.Hours, d.Minutes, d.Seconds} {
+		if n > maxDeltaUnits || n < -maxDeltaUnits {
+			return 0, errors.Errorf("%d is out of range", n)
+		}
+	}
+	return int64(d.Hours)*3600 + int64(d.Minutes)*60 + int64(d.Seconds), nil
+}
+
+// changeForms lists the ways of changing the time given by a change request.
+func changeForms(req ChangeTimeRequest) []string {
+	var given []string
+	if req.AddMinutes != nil {
+		given = append(given, "addMinutes")
+	}
+	if req.AddSeconds != nil {
+		given = append(given, "addSeconds")
+	}
+	if req.AddDuration != "" {
+		given = append(given, "addDuration")
+	}
+	if req.Add != nil {
+		given = append(given, "add")
+	}
+	if req.SetTime != "" {
+		given = append(given, "setTime")
+	}
+	return given
+}
+
+// changeDelta returns the whole minutes and the remaining seconds a change
+// request adds to the time, both zero if it sets the time or adds nothing.
+// The seconds have the sign of the minutes. It fails if the request gives
+// more than one way of changing the time, or moves it by more than
+// maxDeltaSeconds.
+func changeDelta(req ChangeTimeRequest) (minutes int, seconds int, err error) {
+	given := changeForms(req)
+	if len(given) > 1 {
+		return 0, 0, errors.Errorf("only one of addMinutes, addSeconds, addDuration, add and setTime may be given, got %s", strings.Join(given, " and "))
+	}
+
+	var total int64
+	switch {
+	case req.AddMinutes != nil:
+		// Checked before converting to seconds, which could overflow.
+		if m := int64(*req.AddMinutes); m > maxDeltaSeconds/60 || m < -maxDeltaSeconds/60 {
+			total = maxDeltaSeconds + 1
+		} else {
+			total = m * 60
+		}
+	case req.AddSeconds != nil:
+		total = int64(*req.AddSeconds)
+	case req.AddDuration != "":
+		if total, err = parseISODuration(req.AddDuration); err != nil {
+			return 0, 0, errors.Wrap(err, "invalid addDuration")
+		}
+	case req.Add != nil:
+		if total, err = req.Add.seconds(); err != nil {
+			return 0, 0, errors.Wrap(err, "invalid add")
+		}
+	}
+	if total > maxDeltaSeconds || total < -maxDeltaSeconds {
+		return 0, 0, errors.Errorf("%s is out of range: a change moves the time by at most %d seconds", given[0], maxDeltaSeconds)
+	}
+	return int(total / 60), int(total % 60), nil
+}
+
+// validateChange checks a change request, returning the whole minutes and
+// the remaining seconds it adds to the time.
+func validateChange(req ChangeTimeRequest) (int, int, error) {
+	if req.TTL != nil && *req.TTL <= 0 {
+		return 0, 0, errors.New("ttl must be positive")
+	}
+	if req.Label != nil && !validLabel(*req.Label) {
+		return 0, 0, errors.Errorf("label longer than %d characters", maxLabelLength)
+	}
+	if req.Format != nil && !validFormat(*req.Format) {
+		return 0, 0, errors.Errorf("unknown format %q", *req.Format)
+	}
+	minutes, seconds, err := changeDelta(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	if req.SetTime != "" && !validTimeFormat(req.SetTime) {
+		return 0, 0, errors.Errorf("invalid setTime %q", req.SetTime)
+	}
+	return minutes, seconds, nil
+}
+
+// errNoSeconds rejects changes with seconds made to timers without seconds
+// precision.
+var errNoSeconds = errors.New("the timeId is not kept to the second")
+
+// checkSeconds fails with errNoSeconds if req needs seconds precision that
+// rec does not have.
+func checkSeconds(req ChangeTimeRequest, seconds int, rec backend.Record) error {
+	if rec.Precision == backend.PrecisionSeconds {
+		return nil
+	}
+	if seconds != 0 {
+		return errors.WithMessage(errNoSeconds, changeForms(req)[0]+" must be a whole number of minutes")
+	}
+	if req.SetTime != "" && timeHasSeconds(req.SetTime) {
+		return errors.WithMessage(errNoSeconds, fmt.Sprintf("setTime %q has seconds", req.SetTime))
+	}
+	return nil
+}
+
+// addTime moves the time of rec by the given minutes and seconds, which have
+// the same sign, crossing into other days as needed.
+func addTime(rec backend.Record, minutes int, seconds int) backend.Record {
+	second, days := addSeconds(rec.SecondOfDay(), minutes%1440*60+seconds)
+	return rec.MoveTo(rec.DayOffset+minutes/1440+days, second)
+}
+
+// moveChange describes a move of the time from one record to the next, with
+// the delta in seconds for timers kept to the second.
+func moveChange(r *http.Request, op string, from backend.Record, to backend.Record) backend.Change {
+	delta := to.TotalSeconds() - from.TotalSeconds()
+	change := newChange(r, op, delta/60)
+	if to.Precision == backend.PrecisionSeconds {
+		change.DeltaSeconds = delta
+	}
+	return change
+}
+
+// etag is the entity tag of a record with the given version.
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// variantETag is the entity tag of a record rendered in the requested format
+// and converted to zone, either of which may be empty, e.g. "3;format=24h".
+func variantETag(version int64, format string, zone string) string {
+	tag := strconv.FormatInt(version, 10)
+	if format != "" {
+		tag += ";format=" + format
+	}
+	if zone != "" {
+		tag += ";tz=" + zone
+	}
+	return `"` + tag + `"`
+}
+
+// etagMatch reports whether tag is listed in an If-Match or If-None-Match
+// header. If-Match uses the strong comparison, under which weak tags never
+// match, and If-None-Match the weak one. If-Match only compares versions, so
+// the tag of any representation of the record matches.
+func etagMatch(header string, tag string, weak bool) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" {
+			return true
+		}
+		if strings.HasPrefix(t, "W/") {
+			if !weak {
+				continue
+			}
+			t = t[2:]
+		}
+		if i := strings.IndexByte(t, ';'); !weak && i >= 0 {
+			t = t[:i] + `"`
+		}
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// historyQuery parses the limit, cursor, from and to parameters of a history
+// request. from and to are RFC 3339 timestamps.
+func historyQuery(v url.Values) (backend.HistoryQuery, error) {
+	q := backend.HistoryQuery{Limit: defaultHistoryLimit}
+
+	var err error
+	if s := v.Get("limit"); s != "" {
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil || q.Limit < 1 || q.Limit > maxHistoryLimit {
+			return q, errors.Errorf("limit must be between 1 and %d", maxHistoryLimit)
+		}
+	}
+	if s := v.Get("cursor"); s != "" {
+		q.After, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || q.After < 0 {
+			return q, errors.New("invalid cursor")
+		}
+	}
+	if s := v.Get("from"); s != "" {
+		if q.From, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, errors.Wrap(err, "invalid from")
+		}
+	}
+	if s := v.Get("to"); s != "" {
+		if q.To, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, errors.Wrap(err, "invalid to")
+		}
+	}
+	return q, nil
+}
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+	maxLabelLength   = 128
+)
+
+// listQuery parses the parameters of a list request: limit, cursor, from and
+// to as times of day, createdAfter and createdBefore as RFC 3339 timestamps,
+// and label.
+func listQuery(v url.Values) (backend.ListQuery, error) {
+	q := backend.ListQuery{
+		Limit:  defaultListLimit,
+		Cursor: v.Get("cursor"),
+		Label:  v.Get("label"),
+	}
+
+	var err error
+	if s := v.Get("limit"); s != "" {
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil || q.Limit < 1 || q.Limit > maxListLimit {
+			return q, errors.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+	}
+
+	from, to := v.Get("from"), v.Get("to")
+	if from != "" || to != "" {
+		if !validTimeFormat(from) || !validTimeFormat(to) {
+			return q, errors.New("from and to must both be valid times")
+		}
+		fromMinutes, toMinutes := timeToMinutes(from), timeToMinutes(to)
+		q.MinutesFrom, q.MinutesTo = &fromMinutes, &toMinutes
+	}
+
+	if s := v.Get("createdAfter"); s != "" {
+		if q.CreatedFrom, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, errors.Wrap(err, "invalid createdAfter")
+		}
+	}
+	if s := v.Get("createdBefore"); s != "" {
+		if q.CreatedTo, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, errors.Wrap(err, "invalid createdBefore")
+		}
+	}
+	return q, nil
+}
+
+// validLabel reports whether label can be stored.
+func validLabel(label string) bool {
+	return len(label) <= maxLabelLength
+}
+
+// newChange describes a write made by r for the history of the timeId. The
+// caller is the client address, as seen after any proxy middleware.
+func newChange(r *http.Request, op string, delta int) backend.Change {
+	c := backend.Change{
+		Op:     op,
+		Delta:  delta,
+		Caller: r.RemoteAddr,
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		c.Caller = host
+	}
+	if id, ok := hlog.IDFromRequest(r); ok {
+		c.RequestId = id.String()
+	}
+	return c
+}
+
+// currentTime builds the response describing a record, with the time in
+// format, or in the format of the record if format is empty. Seconds are only
+// shown for timers kept to the second.
+func currentTime(rec backend.Record, format string) CurrentTime {
+	if format == "" {
+		format = rec.Format
+	}
+	current := CurrentTime{
+		CurrentTime: formatTime(rec.Minutes, format),
+		Format:      rec.Format,
+		Minutes:     rec.Minutes,
+		DayOffset:   rec.DayOffset,
+		CreatedAt:   timestamp(rec.CreatedAt),
+		UpdatedAt:   timestamp(rec.UpdatedAt),
+		Version:     rec.Version,
+		Label:       rec.Label,
+		ExpiresAt:   expiresAt(rec),
+	}
+	if rec.Precision == backend.PrecisionSeconds {
+		seconds := rec.Seconds
+		current.CurrentTime = formatSeconds(rec.SecondOfDay(), format)
+		current.Seconds = &seconds
+		current.Precision = rec.Precision
+	}
+	if rec.Zone != "" {
+		current.Zone = rec.Zone
+		// A zone that fails to load was stored by a build with another zone
+		// database; the time is still shown without its date.
+		if t, err := zonedTime(rec); err == nil {
+			view := zonedView(t, rec, format)
+			current.Date, current.Offset = view.Date, view.Offset
+		}
+	}
+	return current
+}
+
+// timestamp returns t in UTC for JSON output, or nil if it is unset.
+func timestamp(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// expiresAt returns the expiry of a record for JSON output, or nil if it never expires.
+func expiresAt(rec backend.Record) *time.Time {
+	if rec.ExpiresAt.IsZero() {
+		return nil
+	}
+	t := rec.ExpiresAt.UTC().Truncate(time.Second)
+	return &t
+}
@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"net/http/httptest"
 	"testing"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
 )
 
 func TestValidTimeFormat(t *testing.T) {
@@ -17,7 +20,20 @@ func TestValidTimeFormat(t *testing.T) {
 		{"09:59 PM", true},
 		{"12:00 am", true},
 		{"12:00 pm", true},
+		{"13:45", true},
+		{"00:00", true},
+		{"23:59", true},
+		{"9:05", true},
+		{"01:45:30 PM", true},
+		{"13:45:30", true},
+		{"24:00", false},
+		{"12:60", false},
+		{"1:5", false},
+		{"123:00", false},
+		{" 13:45", false},
 		{"1:00 AM", false},
+		{"1:02:03 PM", false},
+		{"01:02:60 PM", false},
 		{"00:00 PM", false},
 		{"12:60 AM", false},
 		{"11:59am", false},
@@ -43,7 +59,7 @@ func TestValidTimeFormat(t *testing.T) {
 	}
 }
 
-func TestCalculateTime(t *testing.T) {
+func TestAddTime(t *testing.T) {
 	values := []struct {
 		time     string
 		change   int
@@ -61,9 +77,15 @@ func TestCalculateTime(t *testing.T) {
 		{"12:00 PM", -1441, "11:59 AM"},
 	}
 
+	r := httptest.NewRequest("PUT", "/time", nil)
 	for _, tt := range values {
-		if result := calculateTime(tt.time, tt.change); result != tt.expected {
-			t.Errorf("calculateTime(%s, %d) = got <%s> want <%s>", tt.time, tt.change, result, tt.expected)
+		rec := backend.Record{Minutes: timeToMinutes(tt.time)}
+		next := addTime(rec, tt.change, 0)
+		if result := formatTime(next.Minutes, ""); result != tt.expected {
+			t.Errorf("addTime(%s, %d) = got <%s> want <%s>", tt.time, tt.change, result, tt.expected)
+		}
+		if change := moveChange(r, backend.ChangeAdd, rec, next); change.Delta != tt.change {
+			t.Errorf("moveChange(%s, %d) delta = got <%d> want <%d>", tt.time, tt.change, change.Delta, tt.change)
 		}
 	}
 }
@@ -81,6 +103,14 @@ func TestTimeToMinutes(t *testing.T) {
 		{"12:59 PM", 779},
 		{"01:00 PM", 780},
 		{"11:59 PM", 1439},
+		{"01:00 pm", 780},
+		{"12:30 am", 30},
+		{"00:00", 0},
+		{"00:59", 59},
+		{"9:05", 545},
+		{"12:00", 720},
+		{"13:45", 825},
+		{"23:59", 1439},
 	}
 
 	for _, tt := range values {
@@ -111,3 +141,303 @@ func TestMinutesToTime(t *testing.T) {
 		}
 	}
 }
+
+func TestMinutesToTime24(t *testing.T) {
+	values := []struct {
+		minutes  int
+		expected string
+	}{
+		{0, "00:00"},
+		{59, "00:59"},
+		{545, "09:05"},
+		{720, "12:00"},
+		{825, "13:45"},
+		{1439, "23:59"},
+	}
+
+	for _, tt := range values {
+		if result := minutesToTime24(tt.minutes); result != tt.expected {
+			t.Errorf("minutesToTime24(%d) = got <%s> want <%s>", tt.minutes, result, tt.expected)
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	for minutes := 0; minutes < 1440; minutes++ {
+		h12, h24 := minutesToTime(minutes), minutesToTime24(minutes)
+		if result := timeToMinutes(h12); result != minutes {
+			t.Errorf("timeToMinutes(%s) = got <%d> want <%d>", h12, result, minutes)
+		}
+		if result := timeToMinutes(h24); result != minutes {
+			t.Errorf("timeToMinutes(%s) = got <%d> want <%d>", h24, result, minutes)
+		}
+		if result := formatTime(timeToMinutes(h12), format24h); result != h24 {
+			t.Errorf("formatTime(%s, 24h) = got <%s> want <%s>", h12, result, h24)
+		}
+		if result := formatTime(timeToMinutes(h24), format12h); result != h12 {
+			t.Errorf("formatTime(%s, 12h) = got <%s> want <%s>", h24, result, h12)
+		}
+	}
+}
+
+func TestRequestedFormat(t *testing.T) {
+	values := []struct {
+		query    string
+		accept   string
+		expected string
+		fails    bool
+	}{
+		{"", "", "", false},
+		{"?format=24h", "", "24h", false},
+		{"?format=12h", "application/json; profile=24h", "12h", false},
+		{"", "application/json; profile=24h", "24h", false},
+		{"", `application/json;profile="12h"`, "12h", false},
+		{"", "text/html, application/json; q=0.9; profile=24h", "24h", false},
+		{"", "application/json; profile=iso", "", false},
+		{"", "application/json", "", false},
+		{"?format=iso", "", "", true},
+	}
+
+	for _, tt := range values {
+		r := httptest.NewRequest("GET", "/time"+tt.query, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		result, err := requestedFormat(r)
+		if result != tt.expected || (err != nil) != tt.fails {
+			t.Errorf("requestedFormat(%s, %s) = got <%s, %v> want <%s, failure %t>", tt.query, tt.accept, result, err, tt.expected, tt.fails)
+		}
+	}
+}
+
+func TestParseISODuration(t *testing.T) {
+	values := []struct {
+		duration string
+		expected int64
+		fails    bool
+	}{
+		{"PT1H30M", 5400, false},
+		{"-P1DT2H", -93600, false},
+		{"+PT45S", 45, false},
+		{"P1W", 604800, false},
+		{"P2D", 172800, false},
+		{"PT0M", 0, false},
+		{"PT90M", 5400, false},
+		{"P1Y", 0, true},
+		{"P1M", 0, true},
+		{"PT1M30", 0, true},
+		{"PT1.5H", 0, true},
+		{"P", 0, true},
+		{"PT", 0, true},
+		{"P1DT", 0, true},
+		{"1H", 0, true},
+		{"pt1h", 0, true},
+		{"PT99999999999H", 0, true},
+		{"", 0, true},
+	}
+
+	for _, tt := range values {
+		result, err := parseISODuration(tt.duration)
+		if result != tt.expected || (err != nil) != tt.fails {
+			t.Errorf("parseISODuration(%s) = got <%d, %v> want <%d, failure %t>", tt.duration, result, err, tt.expected, tt.fails)
+		}
+	}
+}
+
+func TestChangeDelta(t *testing.T) {
+	number := func(n int) *int { return &n }
+	values := []struct {
+		name    string
+		req     ChangeTimeRequest
+		minutes int
+		seconds int
+		err     string
+	}{
+		{"Nothing", ChangeTimeRequest{}, 0, 0, ""},
+		{"Minutes", ChangeTimeRequest{AddMinutes: number(-61)}, -61, 0, ""},
+		{"Zero Minutes", ChangeTimeRequest{AddMinutes: number(0)}, 0, 0, ""},
+		{"Seconds", ChangeTimeRequest{AddSeconds: number(125)}, 2, 5, ""},
+		{"Negative Seconds", ChangeTimeRequest{AddSeconds: number(-125)}, -2, -5, ""},
+		{"Duration", ChangeTimeRequest{AddDuration: "PT1H30M"}, 90, 0, ""},
+		{"Negative Duration", ChangeTimeRequest{AddDuration: "-P1DT2H"}, -1560, 0, ""},
+		{"Units", ChangeTimeRequest{Add: &Delta{Hours: 1, Minutes: -15, Seconds: 120}}, 47, 0, ""},
+		{"Set Time", ChangeTimeRequest{SetTime: "13:45"}, 0, 0, ""},
+		{"Partial Minute", ChangeTimeRequest{Add: &Delta{Seconds: 90}}, 1, 30, ""},
+		{"Partial Minute Duration", ChangeTimeRequest{AddDuration: "PT30S"}, 0, 30, ""},
+		{"Invalid Duration", ChangeTimeRequest{AddDuration: "P1M"}, 0, 0, `invalid addDuration: "P1M" uses years or months, which have no fixed length`},
+		{"Out Of Range", ChangeTimeRequest{Add: &Delta{Hours: 2000000000}}, 0, 0, "invalid add: 2000000000 is out of range"},
+		{"Units Too Far", ChangeTimeRequest{Add: &Delta{Hours: 300000}}, 0, 0, "add is out of range: a change moves the time by at most 1000000000 seconds"},
+		{"Minutes Too Far", ChangeTimeRequest{AddMinutes: number(-16666667)}, 0, 0, "addMinutes is out of range: a change moves the time by at most 1000000000 seconds"},
+		{"Seconds Too Far", ChangeTimeRequest{AddSeconds: number(1000000001)}, 0, 0, "addSeconds is out of range: a change moves the time by at most 1000000000 seconds"},
+		{"Duration Too Far", ChangeTimeRequest{AddDuration: "P12000D"}, 0, 0, "addDuration is out of range: a change moves the time by at most 1000000000 seconds"},
+		{"Largest Minutes", ChangeTimeRequest{AddMinutes: number(16666666)}, 16666666, 0, ""},
+		{"Minutes And Duration", ChangeTimeRequest{AddMinutes: number(0), AddDuration: "PT1H"}, 0, 0, "only one of addMinutes, addSeconds, addDuration, add and setTime may be given, got addMinutes and addDuration"},
+		{"Minutes And Seconds", ChangeTimeRequest{AddMinutes: number(1), AddSeconds: number(1)}, 0, 0, "only one of addMinutes, addSeconds, addDuration, add and setTime may be given, got addMinutes and addSeconds"},
+		{"Duration And Units", ChangeTimeRequest{AddDuration: "PT1H", Add: &Delta{}}, 0, 0, "only one of addMinutes, addSeconds, addDuration, add and setTime may be given, got addDuration and add"},
+		{"Units And Set Time", ChangeTimeRequest{Add: &Delta{Minutes: 1}, SetTime: "13:45"}, 0, 0, "only one of addMinutes, addSeconds, addDuration, add and setTime may be given, got add and setTime"},
+	}
+
+	for _, tt := range values {
+		minutes, seconds, err := changeDelta(tt.req)
+		var msg string
+		if err != nil {
+			msg = err.Error()
+		}
+		if minutes != tt.minutes || seconds != tt.seconds || msg != tt.err {
+			t.Errorf("changeDelta(%s) = got <%d, %d, %s> want <%d, %d, %s>", tt.name, minutes, seconds, msg, tt.minutes, tt.seconds, tt.err)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	values := []struct {
+		time        string
+		second      int
+		withSeconds bool
+		ok          bool
+	}{
+		{"01:45 PM", 49500, false, true},
+		{"13:45", 49500, false, true},
+		{"01:45:30 PM", 49530, true, true},
+		{"12:00:59 am", 59, true, true},
+		{"13:45:30", 49530, true, true},
+		{"9:05:00", 32700, true, true},
+		{"23:59:59", 86399, true, true},
+		{"13:45:60", 0, false, false},
+		{"01:45:60 PM", 0, false, false},
+		{"13:45:30 PM", 0, false, false},
+		{"1:45:30 PM", 0, false, false},
+		{"01:45:3 PM", 0, false, false},
+		{"01:45:30PM", 0, false, false},
+	}
+
+	for _, tt := range values {
+		second, withSeconds, ok := parseTime(tt.time)
+		if second != tt.second || withSeconds != tt.withSeconds || ok != tt.ok {
+			t.Errorf("parseTime(%s) = got <%d, %t, %t> want <%d, %t, %t>", tt.time, second, withSeconds, ok, tt.second, tt.withSeconds, tt.ok)
+		}
+	}
+}
+
+func TestFormatSeconds(t *testing.T) {
+	values := []struct {
+		second   int
+		format   string
+		expected string
+	}{
+		{0, "", "12:00:00 AM"},
+		{49530, "", "01:45:30 PM"},
+		{49530, format24h, "13:45:30"},
+		{86399, format12h, "11:59:59 PM"},
+		{5, format24h, "00:00:05"},
+	}
+
+	for _, tt := range values {
+		if result := formatSeconds(tt.second, tt.format); result != tt.expected {
+			t.Errorf("formatSeconds(%d, %s) = got <%s> want <%s>", tt.second, tt.format, result, tt.expected)
+		}
+	}
+}
+
+func TestAddSeconds(t *testing.T) {
+	values := []struct {
+		start  int
+		change int
+		second int
+		days   int
+	}{
+		{0, 0, 0, 0},
+		{86399, 1, 0, 1},
+		{0, -1, 86399, -1},
+		{43200, 86400*3 + 30, 43230, 3},
+		{43200, -86400*2 - 30, 43170, -2},
+		{43200, 43200, 0, 1},
+		{43200, -43201, 86399, -1},
+	}
+
+	for _, tt := range values {
+		second, days := addSeconds(tt.start, tt.change)
+		if second != tt.second || days != tt.days {
+			t.Errorf("addSeconds(%d, %d) = got <%d, %d> want <%d, %d>", tt.start, tt.change, second, days, tt.second, tt.days)
+		}
+	}
+}
+
+func TestEtagMatch(t *testing.T) {
+	values := []struct {
+		header   string
+		weak     bool
+		expected bool
+	}{
+		{`"3"`, false, true},
+		{`"4"`, false, false},
+		{`"1", "3"`, false, true},
+		{`"1","3"`, false, true},
+		{`*`, false, true},
+		{`W/"3"`, false, false},
+		{`W/"3"`, true, true},
+		{`"33"`, true, false},
+	}
+
+	for _, tt := range values {
+		if result := etagMatch(tt.header, `"3"`, tt.weak); result != tt.expected {
+			t.Errorf("etagMatch(%s, %t) = got <%t> want <%t>", tt.header, tt.weak, result, tt.expected)
+		}
+	}
+}
+
+func TestLoadZone(t *testing.T) {
+	values := []struct {
+		name     string
+		expected bool
+	}{
+		{"Asia/Tokyo", true},
+		{"America/New_York", true},
+		{"UTC", true},
+		{"Local", false},
+		{"", false},
+		{"Mars/Olympus", false},
+		{"../../etc/passwd", false},
+	}
+
+	for _, tt := range values {
+		if _, err := loadZone(tt.name); (err == nil) != tt.expected {
+			t.Errorf("loadZone(%s) = got <%v> want success <%t>", tt.name, err, tt.expected)
+		}
+	}
+}
+
+func TestZonedTime(t *testing.T) {
+	values := []struct {
+		name      string
+		minutes   int
+		dayOffset int
+		tz        string
+		date      string
+		offset    string
+		converted string
+	}{
+		{"Before DST", 720, 0, "Asia/Tokyo", "2018-03-24", "+01:00", "08:00 PM 2018-03-24 +09:00"},
+		{"After DST", 720, 1, "Asia/Tokyo", "2018-03-25", "+02:00", "07:00 PM 2018-03-25 +09:00"},
+		{"Next Day", 1410, 0, "Asia/Tokyo", "2018-03-24", "+01:00", "07:30 AM 2018-03-25 +09:00"},
+		{"Previous Day", 30, -1, "America/New_York", "2018-03-23", "+01:00", "07:30 PM 2018-03-22 -04:00"},
+	}
+
+	for _, tt := range values {
+		rec := backend.Record{Minutes: tt.minutes, DayOffset: tt.dayOffset, Zone: "Europe/Rome", Date: "2018-03-24"}
+		zoned, err := zonedTime(rec)
+		if err != nil {
+			t.Errorf("zonedTime(%s) = got <%v> want <nil>", tt.name, err)
+			continue
+		}
+		view := zonedView(zoned, rec, "")
+		if view.Date != tt.date || view.Offset != tt.offset {
+			t.Errorf("zonedTime(%s) = got <%s %s> want <%s %s>", tt.name, view.Date, view.Offset, tt.date, tt.offset)
+		}
+		tz, _ := loadZone(tt.tz)
+		converted := zonedView(zoned.In(tz), rec, "")
+		if result := converted.CurrentTime + " " + converted.Date + " " + converted.Offset; result != tt.converted {
+			t.Errorf("zonedTime(%s) in %s = got <%s> want <%s>", tt.name, tt.tz, result, tt.converted)
+		}
+	}
+}
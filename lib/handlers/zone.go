@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+	// Embeds the IANA time zone database, so zones load on hosts without
+	// zoneinfo files, such as the Alpine image the server ships in.
+	_ "time/tzdata"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+
+	"github.com/pkg/errors"
+)
+
+// dateLayout is the layout of the calendar dates of zoned timeIds.
+const dateLayout = "2006-01-02"
+
+// zones caches loaded locations by name, since loading one parses the zone
+// database. Only valid names are cached, which bounds its size.
+var zones sync.Map
+
+// loadZone returns the location of an IANA time zone name such as
+// "Asia/Tokyo". "Local" is rejected as it depends on the host.
+func loadZone(name string) (*time.Location, error) {
+	if loc, ok := zones.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	if name == "" || name == "Local" {
+		return nil, errors.Errorf("unknown time zone %q", name)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.Errorf("unknown time zone %q", name)
+	}
+	zones.Store(name, loc)
+	return loc, nil
+}
+
+// zonedTime returns the instant the current time of a zoned record stands
+// for: its time of day on the date dayOffset days after the one it was
+// created on, in its zone. The date decides which side of a daylight saving
+// change the time is on.
+func zonedTime(rec backend.Record) (time.Time, error) {
+	loc, err := loadZone(rec.Zone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	date, err := time.Parse(dateLayout, rec.Date)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid date %q", rec.Date)
+	}
+	second := rec.SecondOfDay()
+	return time.Date(date.Year(), date.Month(), date.Day()+rec.DayOffset, second/3600, second/60%60, second%60, 0, loc), nil
+}
+
+// zonedView describes t in its own location, rendering the time like the
+// timeId it comes from.
+func zonedView(t time.Time, rec backend.Record, format string) ZonedTime {
+	second := t.Hour()*3600 + t.Minute()*60 + t.Second()
+	current := formatTime(second/60, format)
+	if rec.Precision == backend.PrecisionSeconds {
+		current = formatSeconds(second, format)
+	}
+	return ZonedTime{
+		Zone:        t.Location().String(),
+		CurrentTime: current,
+		Date:        t.Format(dateLayout),
+		Offset:      t.Format("-07:00"),
+	}
+}
+
+// newDate validates the zone and date of a new timeId, returning the date to
+// store: date itself, or the current date in the zone if it is empty.
+func newDate(zone string, date string) (string, error) {
+	if zone == "" {
+		if date != "" {
+			return "", errors.New("date needs a zone")
+		}
+		return "", nil
+	}
+	loc, err := loadZone(zone)
+	if err != nil {
+		return "", err
+	}
+	if date == "" {
+		return time.Now().In(loc).Format(dateLayout), nil
+	}
+	if _, err := time.Parse(dateLayout, date); err != nil {
+		return "", errors.Errorf("invalid date %q, want YYYY-MM-DD", date)
+	}
+	return date, nil
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+	"github.com/mdellandrea/minutes-server/lib/handlers"
+)
+
+// Backend is a handlers.Backend that reports the latency and errors of every
+// operation of the backend it wraps. Per-item errors of batches are not
+// counted, only failures of whole operations.
+type Backend struct {
+	db handlers.Backend
+	m  *Metrics
+}
+
+func (m *Metrics) Backend(db handlers.Backend) *Backend {
+	return &Backend{db: db, m: m}
+}
+
+func (b *Backend) Close() error {
+	return backend.Close(b.db)
+}
+
+func (b *Backend) Ping(ctx context.Context) (err error) {
+	defer func(start time.Time) { b.m.observe("Ping", start, err) }(time.Now())
+	return b.db.Ping(ctx)
+}
+
+func (b *Backend) SetTimeId(ctx context.Context, id string, rec backend.Record, change backend.Change) (err error) {
+	defer func(start time.Time) { b.m.observe("SetTimeId", start, err) }(time.Now())
+	return b.db.SetTimeId(ctx, id, rec, change)
+}
+
+func (b *Backend) GetTimeId(ctx context.Context, id string) (rec backend.Record, err error) {
+	defer func(start time.Time) { b.m.observe("GetTimeId", start, err) }(time.Now())
+	return b.db.GetTimeId(ctx, id)
+}
+
+func (b *Backend) UpdateTimeId(ctx context.Context, id string, fn func(current backend.Record) (backend.Record, backend.Change, error)) (rec backend.Record, err error) {
+	defer func(start time.Time) { b.m.observe("UpdateTimeId", start, err) }(time.Now())
+	return b.db.UpdateTimeId(ctx, id, fn)
+}
+
+func (b *Backend) DeleteTimeId(ctx context.Context, id string, fn func(current backend.Record) error, change backend.Change) (err error) {
+	defer func(start time.Time) { b.m.observe("DeleteTimeId", start, err) }(time.Now())
+	return b.db.DeleteTimeId(ctx, id, fn, change)
+}
+
+func (b *Backend) GetHistory(ctx context.Context, id string, q backend.HistoryQuery) (entries []backend.HistoryEntry, err error) {
+	defer func(start time.Time) { b.m.observe("GetHistory", start, err) }(time.Now())
+	return b.db.GetHistory(ctx, id, q)
+}
+
+func (b *Backend) ListTimeIds(ctx context.Context, q backend.ListQuery) (listings []backend.Listing, next string, err error) {
+	defer func(start time.Time) { b.m.observe("ListTimeIds", start, err) }(time.Now())
+	return b.db.ListTimeIds(ctx, q)
+}
+
+func (b *Backend) SetTimeIds(ctx context.Context, items []backend.BatchItem, change backend.Change) (res []backend.BatchItem, err error) {
+	defer func(start time.Time) { b.m.observe("SetTimeIds", start, err) }(time.Now())
+	return b.db.SetTimeIds(ctx, items, change)
+}
+
+func (b *Backend) GetTimeIds(ctx context.Context, ids []string) (res []backend.BatchItem, err error) {
+	defer func(start time.Time) { b.m.observe("GetTimeIds", start, err) }(time.Now())
+	return b.db.GetTimeIds(ctx, ids)
+}
+
+func (b *Backend) DeleteTimeIds(ctx context.Context, ids []string, change backend.Change) (res []backend.BatchItem, err error) {
+	defer func(start time.Time) { b.m.observe("DeleteTimeIds", start, err) }(time.Now())
+	return b.db.DeleteTimeIds(ctx, ids, change)
+}
+
+func (b *Backend) ImportTimeId(ctx context.Context, id string, rec backend.Record, overwrite bool, change backend.Change) (err error) {
+	defer func(start time.Time) { b.m.observe("ImportTimeId", start, err) }(time.Now())
+	return b.db.ImportTimeId(ctx, id, rec, overwrite, change)
+}
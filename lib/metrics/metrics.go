@@ -0,0 +1,187 @@
+// Package metrics collects Prometheus metrics for the HTTP routes, the
+// backend, its circuit breaker and its Redis connection pool, and serves them
+// in the text format.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+	"github.com/mdellandrea/minutes-server/lib/resilience"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "minutes"
+
+// unmatchedRoute labels requests that matched no route, so unknown paths
+// cannot grow the number of series.
+const unmatchedRoute = "unmatched"
+
+// Metrics has a registry of its own, so tests can create several.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	opDuration      *prometheus.HistogramVec
+	opErrors        *prometheus.CounterVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests handled, by route pattern, method and status.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to handle HTTP requests, by route pattern, method and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		opDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "backend_operation_duration_seconds",
+			Help:      "Time taken by backend operations, by operation.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"operation"}),
+		opErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "backend_operation_errors_total",
+			Help:      "Backend operations that failed, by operation and error kind.",
+		}, []string{"operation", "kind"}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.opDuration,
+		m.opErrors,
+	)
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware must wrap the root mux, as it reads the route pattern matched
+// once the request was handled.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := unmatchedRoute
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		labels := prometheus.Labels{"route": route, "method": r.Method, "status": strconv.Itoa(status)}
+		m.requests.With(labels).Inc()
+		m.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+	}
+	return http.HandlerFunc(fn)
+}
+
+func (m *Metrics) RegisterRedisPool(client redis.UniversalClient) {
+	pooler, ok := client.(interface {
+		PoolStats() *redis.PoolStats
+	})
+	if !ok {
+		return
+	}
+
+	gauge := func(name, help string, value func(*redis.PoolStats) uint32) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "redis_pool",
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return float64(value(pooler.PoolStats())) })
+	}
+	counter := func(name, help string, value func(*redis.PoolStats) uint32) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "redis_pool",
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return float64(value(pooler.PoolStats())) })
+	}
+	m.registry.MustRegister(
+		gauge("connections", "Connections open in the Redis pool.", func(s *redis.PoolStats) uint32 { return s.TotalConns }),
+		gauge("idle_connections", "Idle connections in the Redis pool.", func(s *redis.PoolStats) uint32 { return s.IdleConns }),
+		counter("hits_total", "Times a free connection was found in the Redis pool.", func(s *redis.PoolStats) uint32 { return s.Hits }),
+		counter("misses_total", "Times no free connection was found in the Redis pool.", func(s *redis.PoolStats) uint32 { return s.Misses }),
+		counter("timeouts_total", "Times waiting for a connection of the Redis pool timed out.", func(s *redis.PoolStats) uint32 { return s.Timeouts }),
+		counter("stale_connections_total", "Stale connections removed from the Redis pool.", func(s *redis.PoolStats) uint32 { return s.StaleConns }),
+	)
+}
+
+func (m *Metrics) RegisterBreaker(b *resilience.Backend) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "backend_breaker_state",
+			Help:      "State of the backend circuit breaker: 0 closed, 1 half-open, 2 open.",
+		}, func() float64 { return float64(b.State()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "backend_breaker_opened_total",
+			Help:      "Times the backend circuit breaker opened.",
+		}, func() float64 { return float64(b.Opened()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "backend_retries_total",
+			Help:      "Backend operations tried again after failing.",
+		}, func() float64 { return float64(b.Retries()) }),
+	)
+}
+
+func (m *Metrics) observe(op string, start time.Time, err error) {
+	m.opDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.opErrors.WithLabelValues(op, errorKind(err)).Inc()
+	}
+}
+
+func errorKind(err error) string {
+	switch errors.Cause(err) {
+	case backend.ErrNotFound:
+		return "not_found"
+	case backend.ErrConflict:
+		return "conflict"
+	case backend.ErrUnavailable:
+		return "unavailable"
+	case backend.ErrCorrupt:
+		return "corrupt"
+	case backend.ErrInvalidCursor:
+		return "invalid_cursor"
+	case backend.ErrExists:
+		return "exists"
+	case backend.ErrUnsupported:
+		return "unsupported"
+	case context.DeadlineExceeded:
+		return "deadline_exceeded"
+	case context.Canceled:
+		return "canceled"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+	"github.com/mdellandrea/minutes-server/lib/resilience"
+
+	"github.com/go-chi/chi"
+	"github.com/go-redis/redis"
+)
+
+// scrape returns the metrics of m in the text format.
+func scrape(t *testing.T, m *Metrics) string {
+	rr := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("scrape - Response Status Code: got <%d> want <%d>", rr.Code, http.StatusOK)
+	}
+	body, err := ioutil.ReadAll(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMiddleware(t *testing.T) {
+	m := New()
+	mux := chi.NewMux()
+	mux.Use(m.Middleware)
+	mux.Route("/time", func(r chi.Router) {
+		r.Get("/{timeId}", func(w http.ResponseWriter, r *http.Request) {})
+		r.Delete("/{timeId}", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+	})
+
+	requests := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/time/a"},
+		{"GET", "/time/b"},
+		{"DELETE", "/time/a"},
+		{"GET", "/unknown/a"},
+	}
+	for _, r := range requests {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(r.method, r.path, nil))
+	}
+
+	out := scrape(t, m)
+	expected := []string{
+		`minutes_http_requests_total{method="GET",route="/time/{timeId}",status="200"} 2`,
+		`minutes_http_requests_total{method="DELETE",route="/time/{timeId}",status="204"} 1`,
+		`minutes_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`minutes_http_request_duration_seconds_count{method="GET",route="/time/{timeId}",status="200"} 2`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("TestMiddleware: got <%s> want line <%s>", out, e)
+		}
+	}
+}
+
+func TestBackend(t *testing.T) {
+	ctx := context.Background()
+	m := New()
+	db := m.Backend(backend.NewMemory())
+	id := "0b3c1c8e-8a52-4d3c-9f0a-6c4c1f3e2a01"
+
+	if err := db.SetTimeId(ctx, id, backend.Record{Minutes: 540}, backend.Change{Op: backend.ChangeCreate}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetTimeId(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	db.GetTimeId(ctx, "1d7e9a2b-3f4c-4b5d-8e6f-7a8b9c0d1e02")
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	db.ListTimeIds(canceled, backend.ListQuery{Limit: 10})
+
+	out := scrape(t, m)
+	expected := []string{
+		`minutes_backend_operation_duration_seconds_count{operation="SetTimeId"} 1`,
+		`minutes_backend_operation_duration_seconds_count{operation="GetTimeId"} 2`,
+		`minutes_backend_operation_errors_total{kind="not_found",operation="GetTimeId"} 1`,
+		`minutes_backend_operation_errors_total{kind="canceled",operation="ListTimeIds"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("TestBackend: got <%s> want line <%s>", out, e)
+		}
+	}
+	if strings.Contains(out, `operation_errors_total{kind="not_found",operation="SetTimeId"}`) {
+		t.Errorf("TestBackend - SetTimeId: got error count want none")
+	}
+}
+
+func TestRegisterRedisPool(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})
+	defer client.Close()
+
+	m := New()
+	m.RegisterRedisPool(client)
+	out := scrape(t, m)
+	for _, e := range []string{"minutes_redis_pool_connections 0", "minutes_redis_pool_timeouts_total 0"} {
+		if !strings.Contains(out, e) {
+			t.Errorf("TestRegisterRedisPool: got <%s> want line <%s>", out, e)
+		}
+	}
+}
+
+func TestRegisterBreaker(t *testing.T) {
+	m := New()
+	m.RegisterBreaker(resilience.New(backend.NewMemory(), resilience.Options{}))
+	out := scrape(t, m)
+	for _, e := range []string{"minutes_backend_breaker_state 0", "minutes_backend_breaker_opened_total 0", "minutes_backend_retries_total 0"} {
+		if !strings.Contains(out, e) {
+			t.Errorf("TestRegisterBreaker: got <%s> want line <%s>", out, e)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+// Package resilience keeps short data store outages from failing every
+// request in flight: idempotent operations are retried with backoff, and a
+// circuit breaker turns calls away while the store keeps failing, instead of
+// letting each of them wait on it.
+package resilience
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+	"github.com/mdellandrea/minutes-server/lib/handlers"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultBackoff    = 50 * time.Millisecond
+	defaultMaxBackoff = time.Second
+	defaultThreshold  = 5
+	defaultCooldown   = 10 * time.Second
+)
+
+// Options tune a Backend. Zero values pick the defaults: 50ms growing to 1s
+// between retries, and a breaker opening for 10s after 5 failures in a row.
+// Backoff doubles for each retry up to MaxBackoff. A negative Threshold
+// disables the breaker.
+type Options struct {
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Threshold  int
+	Cooldown   time.Duration
+	Log        zerolog.Logger
+}
+
+type State int32
+
+const (
+	Closed State = iota
+	HalfOpen
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// Backend is a handlers.Backend that retries and guards the operations of the
+// backend it wraps. Only backend.ErrUnavailable counts as a failure: other
+// errors are answers from a working store.
+type Backend struct {
+	db   handlers.Backend
+	opts Options
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+
+	// Read by metrics without taking mu.
+	current int32
+	opened  uint64
+	retries uint64
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+func New(db handlers.Backend, opts Options) *Backend {
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultBackoff
+	}
+	if opts.MaxBackoff < opts.Backoff {
+		opts.MaxBackoff = defaultMaxBackoff
+		if opts.MaxBackoff < opts.Backoff {
+			opts.MaxBackoff = opts.Backoff
+		}
+	}
+	if opts.Threshold == 0 {
+		opts.Threshold = defaultThreshold
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = defaultCooldown
+	}
+	return &Backend{
+		db:   db,
+		opts: opts,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (b *Backend) State() State {
+	return State(atomic.LoadInt32(&b.current))
+}
+
+func (b *Backend) Opened() uint64 {
+	return atomic.LoadUint64(&b.opened)
+}
+
+func (b *Backend) Retries() uint64 {
+	return atomic.LoadUint64(&b.retries)
+}
+
+func (b *Backend) Close() error {
+	return backend.Close(b.db)
+}
+
+func (b *Backend) allow(op string) (probe bool, err error) {
+	if b.opts.Threshold < 0 {
+		return false, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		wait := b.opts.Cooldown - time.Since(b.openedAt)
+		if wait > 0 {
+			return false, b.rejected(op, wait)
+		}
+		b.setState(HalfOpen)
+		fallthrough
+	case HalfOpen:
+		if b.probing {
+			return false, b.rejected(op, time.Second)
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+func (b *Backend) rejected(op string, wait time.Duration) error {
+	err := errors.Wrapf(backend.ErrUnavailable, "circuit breaker open, %s not attempted", op)
+	return backend.WithRetryAfter(err, wait)
+}
+
+// record updates the breaker with the outcome of a call allow let through.
+// Calls let through before the breaker opened may end after it did; only the
+// probe decides whether a half-open breaker closes or opens again.
+func (b *Backend) record(probe bool, err error) {
+	if b.opts.Threshold < 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+
+	switch errors.Cause(err) {
+	case backend.ErrUnavailable:
+		b.failures++
+		if (probe && b.state == HalfOpen) || (b.state == Closed && b.failures >= b.opts.Threshold) {
+			b.openedAt = time.Now()
+			b.setState(Open)
+			atomic.AddUint64(&b.opened, 1)
+			b.opts.Log.Warn().
+				Err(err).
+				Int("failures", b.failures).
+				Dur("cooldown", b.opts.Cooldown).
+				Msg("backend circuit breaker opened")
+		}
+	case context.Canceled, context.DeadlineExceeded:
+		// The caller gave up, which says nothing about the store.
+	default:
+		b.failures = 0
+		if probe && b.state == HalfOpen {
+			b.setState(Closed)
+			b.opts.Log.Info().Msg("backend circuit breaker closed")
+		}
+	}
+}
+
+func (b *Backend) setState(s State) {
+	b.state = s
+	atomic.StoreInt32(&b.current, int32(s))
+	b.opts.Log.Debug().
+		Str("state", s.String()).
+		Msg("backend circuit breaker state changed")
+}
+
+func (b *Backend) call(op string, fn func() error) error {
+	probe, err := b.allow(op)
+	if err != nil {
+		return err
+	}
+	err = fn()
+	b.record(probe, err)
+	return err
+}
+
+// retry runs fn through the breaker, trying it again while it fails with
+// backend.ErrUnavailable, retries remain and ctx is not done. It must only
+// be used for operations that can safely run more than once.
+func (b *Backend) retry(ctx context.Context, op string, fn func() error) error {
+	wait := b.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		err := b.call(op, fn)
+		if errors.Cause(err) != backend.ErrUnavailable || attempt >= b.opts.Retries {
+			return err
+		}
+		if _, open := backend.RetryAfter(err); open {
+			return err
+		}
+
+		b.opts.Log.Debug().
+			Err(err).
+			Str("operation", op).
+			Int("attempt", attempt+1).
+			Msg("retrying backend operation")
+		atomic.AddUint64(&b.retries, 1)
+
+		t := time.NewTimer(b.jitter(wait))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+		if wait *= 2; wait > b.opts.MaxBackoff {
+			wait = b.opts.MaxBackoff
+		}
+	}
+}
+
+func (b *Backend) jitter(d time.Duration) time.Duration {
+	b.randMu.Lock()
+	defer b.randMu.Unlock()
+
+	return d/2 + time.Duration(b.rand.Int63n(int64(d/2)+1))
+}
+
+func (b *Backend) Ping(ctx context.Context) error {
+	return b.call("Ping", func() error { return b.db.Ping(ctx) })
+}
+
+func (b *Backend) SetTimeId(ctx context.Context, id string, rec backend.Record, change backend.Change) error {
+	return b.call("SetTimeId", func() error { return b.db.SetTimeId(ctx, id, rec, change) })
+}
+
+func (b *Backend) GetTimeId(ctx context.Context, id string) (rec backend.Record, err error) {
+	err = b.retry(ctx, "GetTimeId", func() (err error) {
+		rec, err = b.db.GetTimeId(ctx, id)
+		return err
+	})
+	return rec, err
+}
+
+func (b *Backend) UpdateTimeId(ctx context.Context, id string, fn func(current backend.Record) (backend.Record, backend.Change, error)) (rec backend.Record, err error) {
+	err = b.call("UpdateTimeId", func() (err error) {
+		rec, err = b.db.UpdateTimeId(ctx, id, fn)
+		return err
+	})
+	return rec, err
+}
+
+// DeleteTimeId is retried. A delete that reached the store before the
+// connection failed makes the retry fail with backend.ErrNotFound, so after a
+// failed attempt not finding the timeId counts as having deleted it.
+func (b *Backend) DeleteTimeId(ctx context.Context, id string, fn func(current backend.Record) error, change backend.Change) error {
+	failed := false
+	return b.retry(ctx, "DeleteTimeId", func() error {
+		err := b.db.DeleteTimeId(ctx, id, fn, change)
+		switch errors.Cause(err) {
+		case backend.ErrNotFound:
+			if failed {
+				return nil
+			}
+		case backend.ErrUnavailable:
+			failed = true
+		}
+		return err
+	})
+}
+
+func (b *Backend) GetHistory(ctx context.Context, id string, q backend.HistoryQuery) (entries []backend.HistoryEntry, err error) {
+	err = b.call("GetHistory", func() (err error) {
+		entries, err = b.db.GetHistory(ctx, id, q)
+		return err
+	})
+	return entries, err
+}
+
+func (b *Backend) ListTimeIds(ctx context.Context, q backend.ListQuery) (listings []backend.Listing, next string, err error) {
+	err = b.call("ListTimeIds", func() (err error) {
+		listings, next, err = b.db.ListTimeIds(ctx, q)
+		return err
+	})
+	return listings, next, err
+}
+
+func (b *Backend) SetTimeIds(ctx context.Context, items []backend.BatchItem, change backend.Change) (res []backend.BatchItem, err error) {
+	err = b.call("SetTimeIds", func() (err error) {
+		res, err = b.db.SetTimeIds(ctx, items, change)
+		return err
+	})
+	return res, err
+}
+
+func (b *Backend) GetTimeIds(ctx context.Context, ids []string) (res []backend.BatchItem, err error) {
+	err = b.call("GetTimeIds", func() (err error) {
+		res, err = b.db.GetTimeIds(ctx, ids)
+		return err
+	})
+	return res, err
+}
+
+func (b *Backend) DeleteTimeIds(ctx context.Context, ids []string, change backend.Change) (res []backend.BatchItem, err error) {
+	err = b.call("DeleteTimeIds", func() (err error) {
+		res, err = b.db.DeleteTimeIds(ctx, ids, change)
+		return err
+	})
+	return res, err
+}
+
+func (b *Backend) ImportTimeId(ctx context.Context, id string, rec backend.Record, overwrite bool, change backend.Change) error {
+	return b.call("ImportTimeId", func() error { return b.db.ImportTimeId(ctx, id, rec, overwrite, change) })
+}
@@ -0,0 +1,218 @@
+package resilience
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+	"github.com/mdellandrea/minutes-server/lib/handlers"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const testId = "0b3c1c8e-8a52-4d3c-9f0a-6c4c1f3e2a01"
+
+// flakyBackend fails its next fails calls to GetTimeId and DeleteTimeId with
+// err, counting every call that reaches it. With lost set, failed deletes
+// still reach the store, as if only the reply was lost.
+type flakyBackend struct {
+	handlers.Backend
+	fails int32
+	err   error
+	calls int32
+	lost  bool
+}
+
+func (f *flakyBackend) fail() error {
+	atomic.AddInt32(&f.calls, 1)
+	if atomic.AddInt32(&f.fails, -1) >= 0 {
+		return f.err
+	}
+	return nil
+}
+
+func (f *flakyBackend) GetTimeId(ctx context.Context, id string) (backend.Record, error) {
+	if err := f.fail(); err != nil {
+		return backend.Record{}, err
+	}
+	return f.Backend.GetTimeId(ctx, id)
+}
+
+func (f *flakyBackend) DeleteTimeId(ctx context.Context, id string, fn func(current backend.Record) error, change backend.Change) error {
+	if err := f.fail(); err != nil {
+		if f.lost {
+			f.Backend.DeleteTimeId(ctx, id, fn, change)
+		}
+		return err
+	}
+	return f.Backend.DeleteTimeId(ctx, id, fn, change)
+}
+
+func newFlaky(t *testing.T, fails int32, err error) *flakyBackend {
+	db := backend.NewMemory()
+	if err := db.SetTimeId(context.Background(), testId, backend.Record{Minutes: 540}, backend.Change{Op: backend.ChangeCreate}); err != nil {
+		t.Fatal(err)
+	}
+	return &flakyBackend{Backend: db, fails: fails, err: err}
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := errors.Wrap(backend.ErrUnavailable, "connection reset")
+	values := []struct {
+		name    string
+		fails   int32
+		err     error
+		retries int
+		want    error
+		calls   int32
+	}{
+		{"No Failure", 0, unavailable, 2, nil, 1},
+		{"Recovers", 2, unavailable, 2, nil, 3},
+		{"Retries Exhausted", 3, unavailable, 2, backend.ErrUnavailable, 3},
+		{"Retries Disabled", 1, unavailable, 0, backend.ErrUnavailable, 1},
+		{"Not Retried", 1, backend.ErrCorrupt, 2, backend.ErrCorrupt, 1},
+	}
+
+	for _, tt := range values {
+		for _, op := range []string{"GetTimeId", "DeleteTimeId"} {
+			db := newFlaky(t, tt.fails, tt.err)
+			b := New(db, Options{Retries: tt.retries, Backoff: time.Millisecond, Threshold: -1, Log: zerolog.Nop()})
+
+			var err error
+			switch op {
+			case "GetTimeId":
+				_, err = b.GetTimeId(context.Background(), testId)
+			case "DeleteTimeId":
+				err = b.DeleteTimeId(context.Background(), testId, func(backend.Record) error { return nil }, backend.Change{Op: backend.ChangeDelete})
+			}
+			if errors.Cause(err) != tt.want {
+				t.Errorf("TestRetry - %s - %s - Error: got <%v> want <%v>", tt.name, op, err, tt.want)
+			}
+			if calls := atomic.LoadInt32(&db.calls); calls != tt.calls {
+				t.Errorf("TestRetry - %s - %s - Calls: got <%d> want <%d>", tt.name, op, calls, tt.calls)
+			}
+			if retries := b.Retries(); retries != uint64(tt.calls-1) {
+				t.Errorf("TestRetry - %s - %s - Retries: got <%d> want <%d>", tt.name, op, retries, tt.calls-1)
+			}
+		}
+	}
+}
+
+func TestRetryDelete(t *testing.T) {
+	unavailable := errors.Wrap(backend.ErrUnavailable, "connection reset")
+	values := []struct {
+		name  string
+		id    string
+		fails int32
+		lost  bool
+		want  error
+	}{
+		{"Reply Lost", testId, 1, true, nil},
+		{"Request Lost", testId, 1, false, nil},
+		{"Not Found", "missing", 0, false, backend.ErrNotFound},
+	}
+
+	for _, tt := range values {
+		db := newFlaky(t, tt.fails, unavailable)
+		db.lost = tt.lost
+		b := New(db, Options{Retries: 2, Backoff: time.Millisecond, Threshold: -1, Log: zerolog.Nop()})
+
+		err := b.DeleteTimeId(context.Background(), tt.id, nil, backend.Change{Op: backend.ChangeDelete})
+		if errors.Cause(err) != tt.want {
+			t.Errorf("TestRetryDelete - %s - Error: got <%v> want <%v>", tt.name, err, tt.want)
+		}
+		if _, err := db.Backend.GetTimeId(context.Background(), testId); tt.want == nil && errors.Cause(err) != backend.ErrNotFound {
+			t.Errorf("TestRetryDelete - %s - Get: got <%v> want <%v>", tt.name, err, backend.ErrNotFound)
+		}
+	}
+}
+
+func TestRetryStopsWithContext(t *testing.T) {
+	db := newFlaky(t, 10, backend.ErrUnavailable)
+	b := New(db, Options{Retries: 5, Backoff: time.Second, Threshold: -1, Log: zerolog.Nop()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := b.GetTimeId(ctx, testId); errors.Cause(err) != backend.ErrUnavailable {
+		t.Errorf("TestRetryStopsWithContext - Error: got <%v> want <%v>", err, backend.ErrUnavailable)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("TestRetryStopsWithContext - Elapsed: got <%v> want less than <%v>", elapsed, 400*time.Millisecond)
+	}
+	if calls := atomic.LoadInt32(&db.calls); calls != 1 {
+		t.Errorf("TestRetryStopsWithContext - Calls: got <%d> want <%d>", calls, 1)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	ctx := context.Background()
+	db := newFlaky(t, 3, backend.ErrUnavailable)
+	b := New(db, Options{Threshold: 3, Cooldown: 50 * time.Millisecond, Log: zerolog.Nop()})
+
+	// Failures in a row open the breaker, which then turns calls away.
+	for i := 0; i < 3; i++ {
+		b.GetTimeId(ctx, testId)
+	}
+	if b.State() != Open {
+		t.Errorf("TestBreaker - Opened - State: got <%v> want <%v>", b.State(), Open)
+	}
+	_, err := b.GetTimeId(ctx, testId)
+	if errors.Cause(err) != backend.ErrUnavailable {
+		t.Errorf("TestBreaker - Open - Error: got <%v> want <%v>", err, backend.ErrUnavailable)
+	}
+	if after, ok := backend.RetryAfter(err); !ok || after <= 0 || after > 50*time.Millisecond {
+		t.Errorf("TestBreaker - Open - Retry After: got <%v> want between <0> and <%v>", after, 50*time.Millisecond)
+	}
+	if calls := atomic.LoadInt32(&db.calls); calls != 3 {
+		t.Errorf("TestBreaker - Open - Calls: got <%d> want <%d>", calls, 3)
+	}
+	if b.Opened() != 1 {
+		t.Errorf("TestBreaker - Open - Opened: got <%d> want <%d>", b.Opened(), 1)
+	}
+
+	// After the cooldown a failing probe opens it again.
+	atomic.StoreInt32(&db.fails, 1)
+	time.Sleep(60 * time.Millisecond)
+	if _, err := b.GetTimeId(ctx, testId); errors.Cause(err) != backend.ErrUnavailable {
+		t.Errorf("TestBreaker - Failed Probe - Error: got <%v> want <%v>", err, backend.ErrUnavailable)
+	}
+	if b.State() != Open || b.Opened() != 2 {
+		t.Errorf("TestBreaker - Failed Probe - State: got <%v, %d> want <%v, %d>", b.State(), b.Opened(), Open, 2)
+	}
+
+	// A successful probe closes it.
+	time.Sleep(60 * time.Millisecond)
+	if _, err := b.GetTimeId(ctx, testId); err != nil {
+		t.Errorf("TestBreaker - Probe - Error: got <%v> want <nil>", err)
+	}
+	if b.State() != Closed {
+		t.Errorf("TestBreaker - Closed - State: got <%v> want <%v>", b.State(), Closed)
+	}
+}
+
+func TestBreakerIgnoresOtherErrors(t *testing.T) {
+	values := []struct {
+		name string
+		err  error
+	}{
+		{"Not Found", backend.ErrNotFound},
+		{"Corrupt", backend.ErrCorrupt},
+		{"Deadline Exceeded", context.DeadlineExceeded},
+		{"Canceled", context.Canceled},
+	}
+
+	for _, tt := range values {
+		db := newFlaky(t, 10, tt.err)
+		b := New(db, Options{Retries: 2, Threshold: 2, Log: zerolog.Nop()})
+		for i := 0; i < 5; i++ {
+			b.GetTimeId(context.Background(), testId)
+		}
+		if b.State() != Closed {
+			t.Errorf("TestBreakerIgnoresOtherErrors - %s - State: got <%v> want <%v>", tt.name, b.State(), Closed)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// readyTimeout bounds the backend ping of a readiness probe.
+	readyTimeout = time.Second
+	// connectRetryMin and connectRetryMax bound the delay between attempts
+	// to connect to the backend at startup.
+	connectRetryMin = time.Second
+	connectRetryMax = 30 * time.Second
+)
+
+// probes answers the liveness and readiness probes ahead of the access log,
+// like the /ping heartbeat:
+//
+//	/healthz responds 200 as long as the process serves HTTP.
+//	/readyz responds 200 when the backend answers a ping and the server is
+//	not shutting down, and 503 otherwise.
+func (s *Server) probes(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/healthz":
+			probeStatus(w, http.StatusOK, "ok")
+		case "/readyz":
+			s.readyz(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	}
+	return http.HandlerFunc(fn)
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.draining) == 1 {
+		probeStatus(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	db := s.backend()
+	if db == nil {
+		probeStatus(w, http.StatusServiceUnavailable, "connecting to backend")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	if err := db.Ping(ctx); err != nil {
+		s.log.Error().
+			Err(err).
+			Msg("readiness probe failed")
+		probeStatus(w, http.StatusServiceUnavailable, "backend unavailable")
+		return
+	}
+	probeStatus(w, http.StatusOK, "ok")
+}
+
+func probeStatus(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write([]byte(msg + "\n"))
+}
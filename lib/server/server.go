@@ -1,16 +1,25 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mdellandrea/minutes-server/lib/backend"
+	"github.com/mdellandrea/minutes-server/lib/cache"
+	"github.com/mdellandrea/minutes-server/lib/chaos"
 	"github.com/mdellandrea/minutes-server/lib/handlers"
+	"github.com/mdellandrea/minutes-server/lib/metrics"
+	"github.com/mdellandrea/minutes-server/lib/resilience"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/kelseyhightower/envconfig"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 )
@@ -20,6 +29,193 @@ type serverConfig struct {
 	DbHost     string `envconfig:"DBHOST" default:"127.0.0.1"`
 	DbPort     string `envconfig:"DBPORT" default:"6379"`
 	Debug      bool   `envconfig:"DEBUG"`
+	// RedisAddrs overrides DBHOST/DBPORT with a Sentinel or Cluster seed list.
+	RedisAddrs        []string      `envconfig:"REDIS_ADDRS"`
+	RedisMasterName   string        `envconfig:"REDIS_MASTER_NAME"`
+	RedisPassword     string        `envconfig:"REDIS_PASSWORD"`
+	RedisDB           int           `envconfig:"REDIS_DB"`
+	RedisTLS          bool          `envconfig:"REDIS_TLS"`
+	RedisCAFile       string        `envconfig:"REDIS_TLS_CA_FILE"`
+	RedisCertFile     string        `envconfig:"REDIS_TLS_CERT_FILE"`
+	RedisKeyFile      string        `envconfig:"REDIS_TLS_KEY_FILE"`
+	RedisPoolSize     int           `envconfig:"REDIS_POOL_SIZE"`
+	RedisDialTimeout  time.Duration `envconfig:"REDIS_DIAL_TIMEOUT" default:"5s"`
+	RedisReadTimeout  time.Duration `envconfig:"REDIS_READ_TIMEOUT" default:"1s"`
+	RedisWriteTimeout time.Duration `envconfig:"REDIS_WRITE_TIMEOUT" default:"1s"`
+	// Backend selects the data store implementation: "redis", "memory", "file" or "sql".
+	Backend       string `envconfig:"BACKEND" default:"redis"`
+	DataDir       string `envconfig:"DATADIR" default:"data"`
+	SnapshotEvery int    `envconfig:"SNAPSHOT_EVERY" default:"1000"`
+	SqlDriver     string `envconfig:"SQL_DRIVER" default:"sqlite3"`
+	SqlDsn        string `envconfig:"SQL_DSN" default:"minutes.db"`
+	// HistoryLimit caps the history entries kept per timeId; zero keeps them all.
+	HistoryLimit int `envconfig:"HISTORY_LIMIT" default:"1000"`
+	// DefaultTTL is the lifetime of timeIds created without a ttl; zero keeps them forever.
+	DefaultTTL time.Duration `envconfig:"DEFAULT_TTL"`
+	// RouteTimeouts overrides RequestTimeout per operationId, e.g. "getTime:200ms,changeTime:1s".
+	RequestTimeout time.Duration            `envconfig:"REQUEST_TIMEOUT" default:"5s"`
+	RouteTimeouts  map[string]time.Duration `envconfig:"ROUTE_TIMEOUTS"`
+	// CacheSize enables the record cache; CacheRedisAddrs carries its
+	// invalidations for backends other than redis.
+	CacheSize       int           `envconfig:"CACHE_SIZE"`
+	CacheTTL        time.Duration `envconfig:"CACHE_TTL" default:"10s"`
+	CacheChannel    string        `envconfig:"CACHE_CHANNEL" default:"minutes:invalidations"`
+	CacheRedisAddrs []string      `envconfig:"CACHE_REDIS_ADDRS"`
+	// BackendRetries bounds the retries of idempotent operations; the breaker
+	// opens after BreakerThreshold failures in a row, 0 disabling it.
+	BackendRetries      int           `envconfig:"BACKEND_RETRIES" default:"2"`
+	BackendRetryBackoff time.Duration `envconfig:"BACKEND_RETRY_BACKOFF" default:"50ms"`
+	BreakerThreshold    int           `envconfig:"BREAKER_THRESHOLD" default:"5"`
+	BreakerCooldown     time.Duration `envconfig:"BREAKER_COOLDOWN" default:"10s"`
+	// DrainDelay is how long readiness fails before shutting down on SIGTERM.
+	DrainDelay time.Duration `envconfig:"DRAIN_DELAY"`
+	// ChaosFaults holds the JSON faults injected from startup when
+	// ChaosEnabled is set.
+	ChaosEnabled bool   `envconfig:"CHAOS_ENABLED"`
+	ChaosFaults  string `envconfig:"CHAOS_FAULTS"`
+	// TransferEnabled serves /admin/export and /admin/import.
+	TransferEnabled bool `envconfig:"TRANSFER_ENABLED"`
+	// ReadOnly opens the file backend without compacting it, for commands
+	// that only read the data store.
+	ReadOnly bool `ignored:"true"`
+}
+
+// newBackend opens the configured store behind retries and a circuit
+// breaker, with the faults of inj injected below them and measured by m above
+// them, unless inj and m are nil, and behind the record cache when CACHE_SIZE
+// is set. Replicas of the redis backend share invalidations over its own
+// connection, others only if CACHE_REDIS_ADDRS is set, over a connection
+// closed along with the backend.
+func newBackend(c serverConfig, log zerolog.Logger, m *metrics.Metrics, inj *chaos.Injector) (handlers.Backend, error) {
+	store, err := newStore(c)
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := store.(historyLimiter); ok {
+		l.SetHistoryLimit(c.HistoryLimit)
+	}
+
+	db := store
+	if inj != nil {
+		db = inj.Wrap(db)
+	}
+	guarded := resilience.New(db, resilienceOptions(c, log))
+	db = guarded
+	if m != nil {
+		db = m.Backend(db)
+	}
+	if c.CacheSize > 0 {
+		opts := cache.Options{Size: c.CacheSize, TTL: c.CacheTTL, Log: log}
+		switch {
+		case len(c.CacheRedisAddrs) > 0:
+			cfg := redisConfig(c)
+			cfg.Addrs = c.CacheRedisAddrs
+			client, err := backend.NewBackend(cfg)
+			if err != nil {
+				closeStore(store)
+				return nil, errors.Wrap(err, "cache invalidation")
+			}
+			opts.Bus = cache.NewDedicatedRedisBus(client.Client, c.CacheChannel, log)
+		case c.Backend == "redis":
+			opts.Bus = cache.NewRedisBus(store.(*backend.Client).Client, c.CacheChannel, log)
+		}
+		db = cache.New(db, opts)
+	}
+
+	// The breaker and pool are registered last, so a failed attempt to
+	// connect leaves nothing registered for the next one.
+	if m != nil {
+		m.RegisterBreaker(guarded)
+		if client, ok := store.(*backend.Client); ok {
+			m.RegisterRedisPool(client.Client)
+		}
+	}
+	return db, nil
+}
+
+func resilienceOptions(c serverConfig, log zerolog.Logger) resilience.Options {
+	threshold := c.BreakerThreshold
+	if threshold <= 0 {
+		threshold = -1
+	}
+	return resilience.Options{
+		Retries:   c.BackendRetries,
+		Backoff:   c.BackendRetryBackoff,
+		Threshold: threshold,
+		Cooldown:  c.BreakerCooldown,
+		Log:       log,
+	}
+}
+
+// historyLimiter is implemented by stores that can bound the history they keep.
+type historyLimiter interface {
+	SetHistoryLimit(n int)
+}
+
+func closeStore(db handlers.Backend) {
+	backend.Close(db)
+}
+
+func newStore(c serverConfig) (handlers.Backend, error) {
+	switch c.Backend {
+	case "redis":
+		return backend.NewBackend(redisConfig(c))
+	case "memory":
+		return backend.NewMemory(), nil
+	case "file":
+		if c.ReadOnly {
+			return backend.NewFileReadOnly(c.DataDir)
+		}
+		return backend.NewFile(c.DataDir, c.SnapshotEvery)
+	case "sql":
+		return backend.NewSQL(c.SqlDriver, c.SqlDsn)
+	default:
+		return nil, errors.Errorf("unknown backend %q", c.Backend)
+	}
+}
+
+// OpenBackend connects to the backend configured by the environment, for
+// commands that work on the data store without serving HTTP. With the cache
+// configured, writes are announced to the caches of running servers.
+func OpenBackend(log zerolog.Logger) (handlers.Backend, error) {
+	return openBackend(log, false)
+}
+
+// OpenBackendReadOnly is like OpenBackend for commands that only read, and
+// leaves the data directory of the file backend untouched.
+func OpenBackendReadOnly(log zerolog.Logger) (handlers.Backend, error) {
+	return openBackend(log, true)
+}
+
+func openBackend(log zerolog.Logger, readOnly bool) (handlers.Backend, error) {
+	var c serverConfig
+	if err := envconfig.Process("", &c); err != nil {
+		return nil, errors.Wrap(err, "environment variable configuration")
+	}
+	c.ReadOnly = readOnly
+	return newBackend(c, log, nil, nil)
+}
+
+func redisConfig(c serverConfig) backend.RedisConfig {
+	addrs := c.RedisAddrs
+	if len(addrs) == 0 {
+		addrs = []string{fmt.Sprintf("%s:%s", c.DbHost, c.DbPort)}
+	}
+
+	return backend.RedisConfig{
+		Addrs:        addrs,
+		MasterName:   c.RedisMasterName,
+		Password:     c.RedisPassword,
+		DB:           c.RedisDB,
+		TLS:          c.RedisTLS,
+		CAFile:       c.RedisCAFile,
+		CertFile:     c.RedisCertFile,
+		KeyFile:      c.RedisKeyFile,
+		PoolSize:     c.RedisPoolSize,
+		DialTimeout:  c.RedisDialTimeout,
+		ReadTimeout:  c.RedisReadTimeout,
+		WriteTimeout: c.RedisWriteTimeout,
+	}
 }
 
 func setupMiddleware(log zerolog.Logger, mux *chi.Mux) {
@@ -41,7 +237,30 @@ func setupMiddleware(log zerolog.Logger, mux *chi.Mux) {
 	mux.Use(hlog.RequestIDHandler("req_id", "Request-Id"))
 }
 
-func Init(log zerolog.Logger) *http.Server {
+// Server serves the API. It answers from the start, before the backend is
+// connected: until then the API routes respond 503 and /readyz fails, while
+// the backend is retried in the background.
+type Server struct {
+	*http.Server
+
+	log        zerolog.Logger
+	drainDelay time.Duration
+	stop       context.CancelFunc
+
+	// router holds the http.Handler serving requests, replaced by the full
+	// router once the backend is connected. db holds the backend.
+	router   atomic.Value
+	db       atomic.Value
+	draining int32
+	// connMu orders connecting to the backend against closing it on
+	// shutdown, so a backend connected late is never left open.
+	connMu sync.Mutex
+
+	metrics *metrics.Metrics
+	chaos   *chaos.Injector
+}
+
+func Init(log zerolog.Logger) *Server {
 	var c serverConfig
 	err := envconfig.Process("", &c)
 	if err != nil {
@@ -53,21 +272,146 @@ func Init(log zerolog.Logger) *http.Server {
 	if c.Debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	}
-	log.Debug().Msgf("Server Config: %#v", c)
+	redacted := c
+	if redacted.RedisPassword != "" {
+		redacted.RedisPassword = "REDACTED"
+	}
+	log.Debug().Msgf("Server Config: %#v", redacted)
 
-	client, err := backend.NewBackend(c.DbHost, c.DbPort)
+	ctx, stop := context.WithCancel(context.Background())
+	s := &Server{
+		log:        log,
+		drainDelay: c.DrainDelay,
+		stop:       stop,
+		metrics:    metrics.New(),
+	}
+	s.Server = &http.Server{
+		Addr:    fmt.Sprintf(":%s", c.ListenPort),
+		Handler: http.HandlerFunc(s.serveHTTP),
+	}
+	if c.ChaosEnabled {
+		faults := chaos.Faults{}
+		if c.ChaosFaults != "" {
+			faults, err = chaos.ParseFaults([]byte(c.ChaosFaults))
+			if err != nil {
+				log.Fatal().
+					Err(err).
+					Msg("environment variable configuration")
+			}
+		}
+		s.chaos = chaos.NewInjector(faults)
+		log.Warn().Msg("fault injection enabled")
+	}
+
+	s.router.Store(s.routes(c, nil))
+	client, err := newBackend(c, log, s.metrics, s.chaos)
 	if err != nil {
-		log.Fatal().
+		log.Error().
 			Err(err).
-			Msg("backend failure")
+			Msg("backend failure, retrying in the background")
+		go s.connect(ctx, c)
+	} else {
+		s.ready(c, client)
 	}
+	return s
+}
 
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+// routes builds the router of the server. Without a backend every route but
+// the probes, /ping and /metrics responds 503.
+func (s *Server) routes(c serverConfig, db handlers.Backend) http.Handler {
 	mux := chi.NewMux()
-	setupMiddleware(log, mux)
-	router := handlers.SetupRoutes(mux, client, log)
+	mux.Use(s.probes)
+	setupMiddleware(s.log, mux)
+	mux.Use(s.metrics.Middleware)
+	mux.Handle("/metrics", s.metrics.Handler())
 
-	return &http.Server{
-		Addr:    fmt.Sprintf(":%s", c.ListenPort),
-		Handler: router,
+	if db == nil {
+		mux.NotFound(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+		return mux
+	}
+	opts := handlers.Options{
+		DefaultTTL:     c.DefaultTTL,
+		Timeouts:       c.RouteTimeouts,
+		DefaultTimeout: c.RequestTimeout,
+		Transfer:       c.TransferEnabled,
+	}
+	if s.chaos != nil {
+		opts.Chaos = s.chaos
+	}
+	return handlers.SetupRoutes(mux, db, s.log, opts)
+}
+
+// connect retries opening the backend, backing off up to connectRetryMax,
+// until it succeeds or the server shuts down.
+func (s *Server) connect(ctx context.Context, c serverConfig) {
+	delay := connectRetryMin
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		db, err := newBackend(c, s.log, s.metrics, s.chaos)
+		if err == nil {
+			s.connMu.Lock()
+			defer s.connMu.Unlock()
+			if ctx.Err() != nil {
+				closeStore(db)
+				return
+			}
+			s.log.Info().Msg("backend connected")
+			s.ready(c, db)
+			return
+		}
+		s.log.Error().
+			Err(err).
+			Msg("backend failure, retrying in the background")
+
+		delay *= 2
+		if delay > connectRetryMax {
+			delay = connectRetryMax
+		}
+	}
+}
+
+// ready starts serving the API with db.
+func (s *Server) ready(c serverConfig, db handlers.Backend) {
+	s.db.Store(db)
+	s.router.Store(s.routes(c, db))
+}
+
+// backend returns the backend, or nil while it is not connected.
+func (s *Server) backend() handlers.Backend {
+	db, _ := s.db.Load().(handlers.Backend)
+	return db
+}
+
+// Drain makes readiness fail from now on, then waits DRAIN_DELAY so load
+// balancers stop sending requests before the server shuts down.
+func (s *Server) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+	time.Sleep(s.drainDelay)
+}
+
+// Shutdown stops connecting to the backend, if that is still going on,
+// gracefully shuts the HTTP server down and then closes the backend, which
+// compacts the log of the file backend and releases connections.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.draining, 1)
+	s.stop()
+	err := s.Server.Shutdown(ctx)
+
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if cerr := backend.Close(s.backend()); cerr != nil && err == nil {
+		err = errors.Wrap(cerr, "unable to close backend")
 	}
+	return err
 }
@@ -0,0 +1,497 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+	"github.com/mdellandrea/minutes-server/lib/cache"
+	"github.com/mdellandrea/minutes-server/lib/handlers"
+
+	"github.com/go-chi/chi"
+	"github.com/rs/zerolog"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestInitMemoryBackend(t *testing.T) {
+	os.Setenv("BACKEND", "memory")
+	defer os.Unsetenv("BACKEND")
+
+	s := Init(zerolog.New(ioutil.Discard))
+	ts := httptest.NewServer(s.Handler)
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/time", "application/json", strings.NewReader(`{"initialTime":"11:30 PM"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		TimeId      string `json:"timeId"`
+		CurrentTime string `json:"currentTime"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("PUT", ts.URL+"/time/"+created.TimeId, strings.NewReader(`{"addMinutes":45}`))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("TestInitMemoryBackend - PUT - Response Status Code: got <%d> want <%d>", resp.StatusCode, http.StatusOK)
+	}
+
+	resp, err = http.Get(ts.URL + "/time/" + created.TimeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var current struct {
+		CurrentTime string `json:"currentTime"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&current)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.CurrentTime != "12:15 AM" {
+		t.Errorf("TestInitMemoryBackend - GET - currentTime: got <%s> want <%s>", current.CurrentTime, "12:15 AM")
+	}
+
+	req, _ = http.NewRequest("DELETE", ts.URL+"/time/"+created.TimeId, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("TestInitMemoryBackend - DELETE - Response Status Code: got <%d> want <%d>", resp.StatusCode, http.StatusNoContent)
+	}
+
+	resp, err = http.Get(ts.URL + "/time/" + created.TimeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("TestInitMemoryBackend - GET after DELETE - Response Status Code: got <%d> want <%d>", resp.StatusCode, http.StatusNotFound)
+	}
+
+	resp, err = http.Get(ts.URL + "/time/" + created.TimeId + "/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var history struct {
+		Entries []backend.HistoryEntry `json:"entries"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&history)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Entries) != 3 {
+		t.Fatalf("TestInitMemoryBackend - GET history - entries: got <%d> want <%d>", len(history.Entries), 3)
+	}
+	for _, e := range history.Entries {
+		if e.RequestId == "" || e.Caller != "127.0.0.1" {
+			t.Errorf("TestInitMemoryBackend - GET history - %s entry: got request id <%s> caller <%s>", e.Op, e.RequestId, e.Caller)
+		}
+	}
+
+	resp, err = http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []string{
+		`minutes_http_requests_total{method="PUT",route="/time/{timeId}",status="200"} 1`,
+		`minutes_backend_operation_duration_seconds_count{operation="DeleteTimeId"} 1`,
+	} {
+		if !strings.Contains(string(body), e) {
+			t.Errorf("TestInitMemoryBackend - GET metrics: got <%s> want line <%s>", body, e)
+		}
+	}
+}
+
+func TestProbes(t *testing.T) {
+	os.Setenv("BACKEND", "memory")
+	defer os.Unsetenv("BACKEND")
+
+	s := Init(zerolog.New(ioutil.Discard))
+	ts := httptest.NewServer(s.Handler)
+	defer ts.Close()
+
+	values := []struct {
+		name     string
+		path     string
+		drain    bool
+		expected int
+	}{
+		{"Live", "/healthz", false, http.StatusOK},
+		{"Ready", "/readyz", false, http.StatusOK},
+		{"Draining Live", "/healthz", true, http.StatusOK},
+		{"Draining Not Ready", "/readyz", true, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range values {
+		if tt.drain {
+			s.Drain()
+		}
+		resp, err := http.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.expected {
+			t.Errorf("TestProbes - %s - Response Status Code: got <%d> want <%d>", tt.name, resp.StatusCode, tt.expected)
+		}
+	}
+}
+
+func TestInitWaitsForBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minutes-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A file where the data directory should be keeps the file backend from
+	// opening until it is removed.
+	blocker := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("BACKEND", "file")
+	os.Setenv("DATADIR", filepath.Join(blocker, "minutes"))
+	defer os.Unsetenv("BACKEND")
+	defer os.Unsetenv("DATADIR")
+
+	s := Init(zerolog.New(ioutil.Discard))
+	defer s.Shutdown(context.Background())
+	ts := httptest.NewServer(s.Handler)
+	defer ts.Close()
+
+	status := func(method, path string) int {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	values := []struct {
+		name     string
+		method   string
+		path     string
+		expected int
+	}{
+		{"Live", "GET", "/healthz", http.StatusOK},
+		{"Not Ready", "GET", "/readyz", http.StatusServiceUnavailable},
+		{"API Unavailable", "POST", "/time", http.StatusServiceUnavailable},
+	}
+	for _, tt := range values {
+		if got := status(tt.method, tt.path); got != tt.expected {
+			t.Errorf("TestInitWaitsForBackend - %s - Response Status Code: got <%d> want <%d>", tt.name, got, tt.expected)
+		}
+	}
+
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for status("GET", "/readyz") != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatalf("TestInitWaitsForBackend - Ready: backend not connected after retrying")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := status("POST", "/time"); got != http.StatusOK {
+		t.Errorf("TestInitWaitsForBackend - API Available - Response Status Code: got <%d> want <%d>", got, http.StatusOK)
+	}
+}
+
+func TestInitChaos(t *testing.T) {
+	os.Setenv("BACKEND", "memory")
+	os.Setenv("CHAOS_ENABLED", "true")
+	os.Setenv("CHAOS_FAULTS", `{"GetTimeId":{"notFoundRate":1}}`)
+	defer os.Unsetenv("BACKEND")
+	defer os.Unsetenv("CHAOS_ENABLED")
+	defer os.Unsetenv("CHAOS_FAULTS")
+
+	s := Init(zerolog.New(ioutil.Discard))
+	ts := httptest.NewServer(s.Handler)
+	defer ts.Close()
+
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do("POST", "/time", "")
+	var created struct {
+		TimeId string `json:"timeId"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		expected int
+	}{
+		{"Injected Not Found", "GET", "/time/" + created.TimeId, "", http.StatusNotFound},
+		{"Clear Faults", "PUT", "/admin/chaos", `{}`, http.StatusOK},
+		{"Found", "GET", "/time/" + created.TimeId, "", http.StatusOK},
+	}
+	for _, tt := range values {
+		resp := do(tt.method, tt.path, tt.body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.expected {
+			t.Errorf("TestInitChaos - %s - Response Status Code: got <%d> want <%d>", tt.name, resp.StatusCode, tt.expected)
+		}
+	}
+}
+
+func TestNewBackendCache(t *testing.T) {
+	values := []struct {
+		name   string
+		size   int
+		cached bool
+	}{
+		{"Disabled", 0, false},
+		{"Enabled", 100, true},
+	}
+
+	for _, tt := range values {
+		db, err := newBackend(serverConfig{Backend: "memory", CacheSize: tt.size}, zerolog.New(ioutil.Discard), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := db.(*cache.Cache); ok != tt.cached {
+			t.Errorf("TestNewBackendCache - %s: got <%T> want cached <%t>", tt.name, db, tt.cached)
+		}
+	}
+}
+
+func TestShutdownClosesBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minutes-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("BACKEND", "file")
+	os.Setenv("DATADIR", dir)
+	defer os.Unsetenv("BACKEND")
+	defer os.Unsetenv("DATADIR")
+
+	s := Init(zerolog.New(ioutil.Discard))
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("TestShutdownClosesBackend - Shutdown: got <%v> want <nil>", err)
+	}
+
+	// Closing the file backend released its lock on the data directory.
+	file, err := backend.NewFile(dir, 0)
+	if err != nil {
+		t.Fatalf("TestShutdownClosesBackend - NewFile: got <%v> want <nil>", err)
+	}
+	file.Close()
+}
+
+func TestChangeTimeConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minutes-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := backend.NewFile(filepath.Join(dir, "file"), 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	sql, err := backend.NewSQL("sqlite3", filepath.Join(dir, "minutes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sql.Close()
+
+	backends := []struct {
+		name string
+		db   handlers.Backend
+	}{
+		{"memory", backend.NewMemory()},
+		{"file", file},
+		{"sql", sql},
+		{"cache", cache.New(backend.NewMemory(), cache.Options{Size: 10, TTL: time.Minute})},
+	}
+	// Redis runs the additions as WATCH/MULTI transactions, so it needs a
+	// real server, which REDIS_HOST points to.
+	var redis *backend.Client
+	if host := os.Getenv("REDIS_HOST"); host != "" {
+		redis, err = backend.NewBackend(backend.RedisConfig{Addrs: []string{host}, DialTimeout: time.Second, ReadTimeout: time.Second, WriteTimeout: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer redis.Client.Close()
+		backends = append(backends, struct {
+			name string
+			db   handlers.Backend
+		}{"redis", redis})
+	}
+
+	for _, tt := range backends {
+		t.Run(tt.name, func(t *testing.T) {
+			router := handlers.SetupRoutes(chi.NewMux(), tt.db, zerolog.New(ioutil.Discard), handlers.Options{})
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			id := uuid.NewV4().String()
+			if err := tt.db.SetTimeId(context.Background(), id, backend.Record{Minutes: 0}, backend.Change{Op: backend.ChangeCreate}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.db == redis {
+				defer redis.Client.Del(id, "{"+id+"}:history")
+			}
+
+			// 300 parallel additions of 7 minutes == 2100 minutes == 11:00 AM the next day.
+			var wg sync.WaitGroup
+			for i := 0; i < 300; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req, _ := http.NewRequest("PUT", ts.URL+"/time/"+id, strings.NewReader(`{"addMinutes":7}`))
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusOK {
+						t.Errorf("TestChangeTimeConcurrent - %s - Response Status Code: got <%d> want <%d>", tt.name, resp.StatusCode, http.StatusOK)
+					}
+				}()
+			}
+			wg.Wait()
+
+			rec, err := tt.db.GetTimeId(context.Background(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Minutes != 660 {
+				t.Errorf("TestChangeTimeConcurrent - %s - final time: got <%d> want <%d>", tt.name, rec.Minutes, 660)
+			}
+			if rec.Version != 301 {
+				t.Errorf("TestChangeTimeConcurrent - %s - version: got <%d> want <%d>", tt.name, rec.Version, 301)
+			}
+
+			history, err := tt.db.GetHistory(context.Background(), id, backend.HistoryQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 301 {
+				t.Errorf("TestChangeTimeConcurrent - %s - history entries: got <%d> want <%d>", tt.name, len(history), 301)
+			}
+		})
+	}
+}
+
+func TestInitBreaker(t *testing.T) {
+	os.Setenv("BACKEND", "memory")
+	os.Setenv("CHAOS_ENABLED", "true")
+	os.Setenv("CHAOS_FAULTS", `{"GetTimeId":{"errorRate":1}}`)
+	os.Setenv("BACKEND_RETRIES", "1")
+	os.Setenv("BACKEND_RETRY_BACKOFF", "1ms")
+	os.Setenv("BREAKER_THRESHOLD", "4")
+	defer os.Unsetenv("BACKEND")
+	defer os.Unsetenv("CHAOS_ENABLED")
+	defer os.Unsetenv("CHAOS_FAULTS")
+	defer os.Unsetenv("BACKEND_RETRIES")
+	defer os.Unsetenv("BACKEND_RETRY_BACKOFF")
+	defer os.Unsetenv("BREAKER_THRESHOLD")
+
+	s := Init(zerolog.New(ioutil.Discard))
+	ts := httptest.NewServer(s.Handler)
+	defer ts.Close()
+
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do("POST", "/time", "")
+	var created struct {
+		TimeId string `json:"timeId"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each GET tries twice, so the second one opens the breaker.
+	values := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		expected   int
+		retryAfter string
+	}{
+		{"Failing", "GET", "/time/" + created.TimeId, "", http.StatusServiceUnavailable, ""},
+		{"Opening", "GET", "/time/" + created.TimeId, "", http.StatusServiceUnavailable, ""},
+		{"Clear Faults", "PUT", "/admin/chaos", `{}`, http.StatusOK, ""},
+		{"Open", "GET", "/time/" + created.TimeId, "", http.StatusServiceUnavailable, "10"},
+		{"Not Ready", "GET", "/readyz", "", http.StatusServiceUnavailable, ""},
+	}
+	for _, tt := range values {
+		resp := do(tt.method, tt.path, tt.body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.expected {
+			t.Errorf("TestInitBreaker - %s - Response Status Code: got <%d> want <%d>", tt.name, resp.StatusCode, tt.expected)
+		}
+		if got := resp.Header.Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("TestInitBreaker - %s - Retry-After: got <%s> want <%s>", tt.name, got, tt.retryAfter)
+		}
+	}
+
+	resp = do("GET", "/metrics", "")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, e := range []string{"minutes_backend_breaker_state 2", "minutes_backend_retries_total 2"} {
+		if !strings.Contains(string(body), e) {
+			t.Errorf("TestInitBreaker - Metrics: got <%s> want line <%s>", body, e)
+		}
+	}
+}
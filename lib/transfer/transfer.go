@@ -0,0 +1,156 @@
+// Package transfer moves timeIds in and out of a backend as NDJSON, one JSON
+// object per line, for backups and migrations between environments.
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+)
+
+// exportPageSize is the number of timeIds read from the backend at a time.
+const exportPageSize = 1000
+
+// maxLineSize bounds a single line of an import.
+const maxLineSize = 1 << 20
+
+// Conflict policies decide what an import does with timeIds that already
+// exist in the backend.
+const (
+	Skip      = "skip"
+	Overwrite = "overwrite"
+	Fail      = "fail"
+)
+
+// ErrInvalidLine means a line of an import could not be read as a timeId.
+var ErrInvalidLine = errors.New("invalid import line")
+
+// Line is one timeId of an export. The record is kept whole, including its
+// version, timestamps and undo history, so an import restores it exactly.
+type Line struct {
+	TimeId string         `json:"timeId"`
+	Record backend.Record `json:"record"`
+}
+
+// Summary counts what an import did with the lines it read. Expired timeIds
+// are counted as skipped.
+type Summary struct {
+	Imported    int `json:"imported"`
+	Overwritten int `json:"overwritten"`
+	Skipped     int `json:"skipped"`
+}
+
+type Source interface {
+	ListTimeIds(ctx context.Context, q backend.ListQuery) ([]backend.Listing, string, error)
+}
+
+type Sink interface {
+	ImportTimeId(ctx context.Context, id string, rec backend.Record, overwrite bool, change backend.Change) error
+}
+
+// ValidPolicy reports whether policy is one of the conflict policies.
+func ValidPolicy(policy string) bool {
+	return policy == Skip || policy == Overwrite || policy == Fail
+}
+
+// Export writes every live timeId of src to w and returns how many it wrote.
+// Nothing is written if the first page cannot be read, so callers can still
+// report the failure; later failures leave the output truncated.
+func Export(ctx context.Context, src Source, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	n := 0
+	q := backend.ListQuery{Limit: exportPageSize}
+	for {
+		listings, next, err := src.ListTimeIds(ctx, q)
+		if err != nil {
+			return n, err
+		}
+		for _, l := range listings {
+			if err := enc.Encode(Line{TimeId: l.Id, Record: l.Record}); err != nil {
+				return n, errors.Wrap(err, "unable to write export")
+			}
+			n++
+		}
+		if next == "" {
+			return n, nil
+		}
+		q.Cursor = next
+	}
+}
+
+// Import reads lines written by Export from r into dst. TimeIds that already
+// exist are handled according to policy; with Fail the import stops at the
+// first one with backend.ErrExists. Lines are applied as they are read, so a
+// failed import keeps the lines before the failure, as the summary reports.
+func Import(ctx context.Context, dst Sink, r io.Reader, policy string, change backend.Change) (Summary, error) {
+	var sum Summary
+	if !ValidPolicy(policy) {
+		return sum, errors.Errorf("unknown conflict policy %q", policy)
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for n := 1; scanner.Scan(); n++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		var l Line
+		if err := json.Unmarshal(data, &l); err != nil {
+			return sum, errors.Wrapf(withCause(ErrInvalidLine, err), "line %d", n)
+		}
+		if _, err := uuid.FromString(l.TimeId); err != nil {
+			return sum, errors.Wrapf(withCause(ErrInvalidLine, err), "line %d", n)
+		}
+		if l.Record.Expired(time.Now()) {
+			sum.Skipped++
+			continue
+		}
+
+		err := dst.ImportTimeId(ctx, l.TimeId, l.Record, false, change)
+		switch {
+		case err == nil:
+			sum.Imported++
+		case errors.Cause(err) != backend.ErrExists:
+			return sum, errors.Wrapf(err, "line %d", n)
+		case policy == Skip:
+			sum.Skipped++
+		case policy == Fail:
+			return sum, errors.Wrapf(err, "line %d: timeId %s", n, l.TimeId)
+		default:
+			if err := dst.ImportTimeId(ctx, l.TimeId, l.Record, true, change); err != nil {
+				return sum, errors.Wrapf(err, "line %d", n)
+			}
+			sum.Overwritten++
+		}
+	}
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		return sum, errors.Wrapf(withCause(ErrInvalidLine, err), "line longer than %d bytes", maxLineSize)
+	} else if err != nil {
+		return sum, errors.Wrap(err, "unable to read import")
+	}
+	return sum, nil
+}
+
+// causeError keeps the message of err while errors.Cause resolves to cause.
+type causeError struct {
+	cause error
+	err   error
+}
+
+func (e *causeError) Error() string { return e.cause.Error() + ": " + e.err.Error() }
+
+func (e *causeError) Cause() error { return e.cause }
+
+func withCause(cause, err error) error {
+	return &causeError{cause: cause, err: err}
+}
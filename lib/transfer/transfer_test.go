@@ -0,0 +1,148 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdellandrea/minutes-server/lib/backend"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+const (
+	idA = "0b3c1c8e-8a52-4d3c-9f0a-6c4c1f3e2a01"
+	idB = "1d7e9a2b-3f4c-4b5d-8e6f-7a8b9c0d1e02"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	src := backend.NewMemory()
+	for id, minutes := range map[string]int{idA: 540, idB: 780} {
+		if err := src.SetTimeId(ctx, id, backend.Record{Minutes: minutes, Label: "moved"}, backend.Change{Op: backend.ChangeCreate}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	n, err := Export(ctx, src, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || strings.Count(buf.String(), "\n") != 2 {
+		t.Fatalf("TestExportImport - Export: got <%d> lines want <%d>", n, 2)
+	}
+
+	dst := backend.NewMemory()
+	sum, err := Import(ctx, dst, &buf, Fail, backend.Change{Op: backend.ChangeImport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != (Summary{Imported: 2}) {
+		t.Errorf("TestExportImport - Import: got <%+v> want <%+v>", sum, Summary{Imported: 2})
+	}
+	for _, id := range []string{idA, idB} {
+		want, _ := src.GetTimeId(ctx, id)
+		got, err := dst.GetTimeId(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Minutes != want.Minutes || got.Version != want.Version || !got.CreatedAt.Equal(want.CreatedAt) || got.Label != want.Label {
+			t.Errorf("TestExportImport - %s: got <%+v> want <%+v>", id, got, want)
+		}
+	}
+}
+
+func TestImportPolicies(t *testing.T) {
+	ctx := context.Background()
+	input := `{"timeId":"` + idA + `","record":{"minutes":600,"version":3}}` + "\n" +
+		"\n" +
+		`{"timeId":"` + idB + `","record":{"minutes":60,"version":1,"expiresAt":"2000-01-01T00:00:00Z"}}` + "\n"
+
+	values := []struct {
+		name     string
+		policy   string
+		expected Summary
+		err      error
+		minutes  int
+	}{
+		{"Skip", Skip, Summary{Skipped: 2}, nil, 540},
+		{"Overwrite", Overwrite, Summary{Overwritten: 1, Skipped: 1}, nil, 600},
+		{"Fail", Fail, Summary{}, backend.ErrExists, 540},
+	}
+
+	for _, tt := range values {
+		t.Run(tt.name, func(t *testing.T) {
+			db := backend.NewMemory()
+			if err := db.SetTimeId(ctx, idA, backend.Record{Minutes: 540}, backend.Change{Op: backend.ChangeCreate}); err != nil {
+				t.Fatal(err)
+			}
+
+			sum, err := Import(ctx, db, strings.NewReader(input), tt.policy, backend.Change{Op: backend.ChangeImport})
+			if errors.Cause(err) != tt.err {
+				t.Errorf("TestImportPolicies - %s - Error: got <%v> want <%v>", tt.name, err, tt.err)
+			}
+			if sum != tt.expected {
+				t.Errorf("TestImportPolicies - %s - Summary: got <%+v> want <%+v>", tt.name, sum, tt.expected)
+			}
+			rec, err := db.GetTimeId(ctx, idA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Minutes != tt.minutes {
+				t.Errorf("TestImportPolicies - %s - Minutes: got <%d> want <%d>", tt.name, rec.Minutes, tt.minutes)
+			}
+			if _, err := db.GetTimeId(ctx, idB); errors.Cause(err) != backend.ErrNotFound {
+				t.Errorf("TestImportPolicies - %s - Expired: got <%v> want <%v>", tt.name, err, backend.ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	values := []struct {
+		name   string
+		input  string
+		policy string
+	}{
+		{"Not JSON", `{"timeId":`, Skip},
+		{"Invalid TimeId", `{"timeId":"a","record":{"minutes":1}}`, Skip},
+		{"Line Too Long", `{"timeId":"` + strings.Repeat("a", maxLineSize) + `"}`, Skip},
+	}
+
+	for _, tt := range values {
+		t.Run(tt.name, func(t *testing.T) {
+			valid := `{"timeId":"` + idA + `","record":{"minutes":1,"createdAt":"` + time.Now().UTC().Format(time.RFC3339) + `"}}`
+			db := backend.NewMemory()
+			sum, err := Import(context.Background(), db, strings.NewReader(valid+"\n"+tt.input), tt.policy, backend.Change{Op: backend.ChangeImport})
+			if errors.Cause(err) != ErrInvalidLine {
+				t.Errorf("TestImportInvalid - %s: got <%v> want <%v>", tt.name, err, ErrInvalidLine)
+			}
+			if sum.Imported != 1 {
+				t.Errorf("TestImportInvalid - %s - Imported: got <%d> want <%d>", tt.name, sum.Imported, 1)
+			}
+		})
+	}
+
+	if _, err := Import(context.Background(), backend.NewMemory(), strings.NewReader(""), "replace", backend.Change{}); err == nil {
+		t.Errorf("TestImportInvalid - Unknown Policy: got <nil> want error")
+	}
+}
+
+func TestExportCluster(t *testing.T) {
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{"127.0.0.1:1"}, DialTimeout: 100 * time.Millisecond})
+	defer client.Close()
+
+	// Redis Cluster cannot list timeIds, so nothing is exported.
+	var buf bytes.Buffer
+	n, err := Export(context.Background(), &backend.Client{Client: client}, &buf)
+	if errors.Cause(err) != backend.ErrUnsupported {
+		t.Errorf("TestExportCluster - Error: got <%v> want <%v>", err, backend.ErrUnsupported)
+	}
+	if n != 0 || buf.Len() != 0 {
+		t.Errorf("TestExportCluster - Exported: got <%d> lines, <%d> bytes want none", n, buf.Len())
+	}
+}
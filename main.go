@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -15,26 +16,53 @@ import (
 func main() {
 	log := zerolog.New(os.Stderr).With().Timestamp().Logger()
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	if len(os.Args) > 1 {
+		if err := runCommand(log, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal().
+				Err(err).
+				Msgf("%s failed", os.Args[1])
+		}
+		return
+	}
+
 	s := server.Init(log)
 
+	// Both a signal and the server failing shut it down, whichever comes
+	// first; the other waits for the backend to be closed.
+	var once sync.Once
+	shutdown := func() {
+		once.Do(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Info().
+					Err(err).
+					Msg("error during shutdown")
+			}
+		})
+	}
+
 	go func() {
 		stopChan := make(chan os.Signal, 1)
 		signal.Notify(stopChan, os.Interrupt, syscall.SIGTERM)
 		<-stopChan
 
 		log.Info().Msg("shutting down server")
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
-		if err := s.Shutdown(ctx); err != nil {
-			log.Info().
-				Err(err).
-				Msg("http server error during shutdown")
-		}
+		s.Drain()
+		shutdown()
 	}()
 
-	if err := s.ListenAndServe(); err != http.ErrServerClosed {
-		log.Info().
+	err := s.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Error().
 			Err(err).
 			Msg("http server terminated unexpectedly")
 	}
+	// ListenAndServe returns as soon as shutdown starts, so this waits for
+	// the backend to be closed before exiting.
+	shutdown()
+	if err != http.ErrServerClosed {
+		os.Exit(1)
+	}
 }